@@ -0,0 +1,657 @@
+package builders_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	envoy_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	envoy_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoy_tcp_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	envoy_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v2"
+
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestFixtures(t *testing.T) {
+
+	t.Run("listener-tcp-l4-only", func(t *testing.T) {
+		got, err := builders.New().BuildListener(tenant.Default(), []*types.Certificate{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("listener-single-l7-and-tcp-l4", func(t *testing.T) {
+		got, err := builders.New().BuildListener(tenant.Default(),
+			[]*types.Certificate{
+				{
+					SNI:  "example.com",
+					Cert: []byte("cert"),
+					Key:  []byte("key"),
+				},
+			}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("listener-multiple-l7-and-tcp-l4", func(t *testing.T) {
+		got, err := builders.New().BuildListener(tenant.Default(),
+			[]*types.Certificate{
+				{
+					SNI:  "example.com",
+					Cert: []byte("cert"),
+					Key:  []byte("key"),
+				},
+				{
+					SNI:  "example2.com",
+					Cert: []byte("cert2"),
+					Key:  []byte("key2"),
+				},
+			}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("listener-wildcard-with-policy", func(t *testing.T) {
+		pol, err := policy.Parse([]byte(`
+rules:
+- exact: login.example.org
+  action: passthrough
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := builders.New().BuildListener(tenant.Default(),
+			[]*types.Certificate{
+				{
+					SNI:  "example.com",
+					Cert: []byte("cert"),
+					Key:  []byte("key"),
+				},
+				{
+					SNI:      "example.org",
+					Cert:     []byte("cert2"),
+					Key:      []byte("key2"),
+					Wildcard: true,
+					DNSNames: []string{"*.example.org", "example.org"},
+				},
+			}, pol)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("listener-dual-key-l7-and-tcp-l4", func(t *testing.T) {
+		got, err := builders.New().BuildListener(tenant.Default(),
+			[]*types.Certificate{
+				{
+					SNI:  "example.com",
+					Cert: []byte("cert"),
+					Key:  []byte("key"),
+					Alternates: []*types.KeyPair{
+						{Algorithm: types.RSA2048, Cert: []byte("rsa-cert"), Key: []byte("rsa-key")},
+					},
+				},
+			}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("listener-tenant-l7-and-tcp-l4", func(t *testing.T) {
+		got, err := builders.New().BuildListener(&tenant.Tenant{Name: "team-a", Port: 9443},
+			[]*types.Certificate{
+				{
+					SNI:  "example.com",
+					Cert: []byte("cert"),
+					Key:  []byte("key"),
+					Alternates: []*types.KeyPair{
+						{Algorithm: types.RSA2048, Cert: []byte("rsa-cert"), Key: []byte("rsa-key")},
+					},
+				},
+			}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("connect-listener", func(t *testing.T) {
+		got, err := builders.New().BuildConnectListener(&tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, ConnectPort: 3128})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("connect-loopback-cluster", func(t *testing.T) {
+		got, err := builders.New().BuildConnectLoopbackCluster(tenant.Default())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("http-listener", func(t *testing.T) {
+		got, err := builders.New().BuildHTTPListener(&tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, HTTPPort: 8000}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("http-listener-with-policy", func(t *testing.T) {
+		pol, err := policy.Parse([]byte(`
+default: passthrough
+rules:
+- exact: login.example.org
+  action: passthrough
+- suffix: example.org
+  action: intercept
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := builders.New().BuildHTTPListener(&tenant.Tenant{Name: "team-a", Port: 9443, HTTPPort: 8001}, pol)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("listener-original-dst", func(t *testing.T) {
+		got, err := builders.New(builders.WithOriginalDst(true)).BuildListener(tenant.Default(),
+			[]*types.Certificate{
+				{
+					SNI:  "example.com",
+					Cert: []byte("cert"),
+					Key:  []byte("key"),
+				},
+				{
+					SNI:      "example.org",
+					Cert:     []byte("cert2"),
+					Key:      []byte("key2"),
+					Wildcard: true,
+					DNSNames: []string{"*.example.org", "example.org"},
+				},
+			}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("http-listener-original-dst", func(t *testing.T) {
+		pol, err := policy.Parse([]byte(`
+rules:
+- suffix: example.org
+  action: passthrough
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := builders.New(builders.WithOriginalDst(true)).BuildHTTPListener(&tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, HTTPPort: 8000}, pol)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("connect-listener-original-dst", func(t *testing.T) {
+		got, err := builders.New(builders.WithOriginalDst(false)).BuildConnectListener(&tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, ConnectPort: 3128})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("original-dst-cluster", func(t *testing.T) {
+		got, err := builders.New(builders.WithOriginalDst(false)).BuildOriginalDstCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("original-dst-tls-cluster", func(t *testing.T) {
+		got, err := builders.New(builders.WithOriginalDst(false)).BuildOriginalDstTLSCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("als-cluster", func(t *testing.T) {
+		got, err := builders.New().BuildALSCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("dynamic-forward-proxy-cluster", func(t *testing.T) {
+		got, err := builders.New().BuildDynamicForwardProxyCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("dynamic-forward-proxy-tls-cluster", func(t *testing.T) {
+		got, err := builders.New().BuildDynamicForwardProxyTLSCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("secret", func(t *testing.T) {
+		got, err := builders.BuildSecret(tenant.Default(), &types.Certificate{
+			SNI:  "example.com",
+			Cert: []byte("cert"),
+			Key:  []byte("key"),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("manual-upstream-cluster", func(t *testing.T) {
+		got, err := builders.New().BuildManualUpstream(tenant.Default(), &types.Certificate{
+			SNI:  "example.com",
+			Cert: []byte("cert"),
+			Key:  []byte("key"),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+
+	t.Run("manual-upstream-cluster-original-dst", func(t *testing.T) {
+		got, err := builders.New(builders.WithOriginalDst(false)).BuildManualUpstream(tenant.Default(), &types.Certificate{
+			SNI:  "example.com",
+			Cert: []byte("cert"),
+			Key:  []byte("key"),
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertFixture(t, got)
+	})
+}
+
+func TestListenerAddHostKeepsFilterChains(t *testing.T) {
+	example := &types.Certificate{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}
+	example2 := &types.Certificate{SNI: "example2.com", Cert: []byte("cert2"), Key: []byte("key2")}
+
+	before, err := builders.New().BuildListener(tenant.Default(), []*types.Certificate{example}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Order of the certificates must not matter
+	after, err := builders.New().BuildListener(tenant.Default(), []*types.Certificate{example2, example}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !proto.Equal(filterChain(t, before, "l4_passthrough"), filterChain(t, after, "l4_passthrough")) {
+		t.Fatal("passthrough filter chain changed")
+	}
+
+	if len(after.GetFilterChains()) != 3 {
+		t.Fatalf("expected 3 filter chains, got %d", len(after.GetFilterChains()))
+	}
+
+	if !proto.Equal(before.GetFilterChains()[0], after.GetFilterChains()[0]) {
+		t.Fatal("filter chain for example.com changed")
+	}
+}
+
+func TestListenerTransportProtocol(t *testing.T) {
+	certs := []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}}
+
+	for _, originalDst := range []bool{false, true} {
+		var opts []builders.Option
+		if originalDst {
+			opts = append(opts, builders.WithOriginalDst(false))
+		}
+
+		lis, err := builders.New(opts...).BuildListener(tenant.Default(), certs, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lis.GetDefaultFilterChain() != nil {
+			t.Fatal("a default filter chain takes connections that aren't TLS")
+		}
+
+		tree := lis.GetFilterChainMatcher().GetMatcherTree()
+		if name := tree.GetInput().GetName(); name != "envoy.matching.inputs.transport_protocol" {
+			t.Fatalf("filter chain matcher dispatches on %s", name)
+		}
+		if _, ok := tree.GetExactMatchMap().GetMap()["tls"]; !ok {
+			t.Fatal("TLS isn't matched")
+		}
+
+		// Plaintext only goes to the original destination
+		onNoMatch := lis.GetFilterChainMatcher().GetOnNoMatch()
+		if originalDst && onNoMatch.GetAction().GetName() != "l4_passthrough" {
+			t.Fatalf("plaintext goes to %v in OriginalDst mode", onNoMatch)
+		}
+		if !originalDst && onNoMatch != nil {
+			t.Fatalf("plaintext goes to %v", onNoMatch)
+		}
+	}
+}
+
+func TestBuildSecrets(t *testing.T) {
+	cert := &types.Certificate{
+		SNI:  "example.com",
+		Cert: []byte("cert"),
+		Key:  []byte("key"),
+		Alternates: []*types.KeyPair{
+			{Algorithm: types.ECDSAP384, Cert: []byte("ecdsa-cert"), Key: []byte("ecdsa-key")},
+		},
+	}
+
+	secrets, err := builders.BuildSecrets(tenant.Default(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(secrets) != 2 || secrets[0].GetName() != "example.com" || secrets[1].GetName() != "example.com/ecdsa" {
+		t.Fatalf("unexpected secrets %v", secrets)
+	}
+
+	if got := string(secrets[1].GetTlsCertificate().GetCertificateChain().GetInlineBytes()); got != "ecdsa-cert" {
+		t.Fatalf("alternate secret serves %q", got)
+	}
+}
+
+func TestBuildSecretsSkipsEd25519(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"example.com"}}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &types.Certificate{
+		SNI:  "example.com",
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  []byte("ed25519-key"),
+		Alternates: []*types.KeyPair{
+			{Algorithm: types.RSA2048, Cert: []byte("rsa-cert"), Key: []byte("rsa-key")},
+		},
+	}
+
+	// Envoy can't load Ed25519 certificates, it only gets the RSA pair
+	secrets, err := builders.BuildSecrets(tenant.Default(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(secrets) != 1 || secrets[0].GetName() != "example.com/rsa" {
+		t.Fatalf("unexpected secrets %v", secrets)
+	}
+
+	if got := builders.SecretNames(tenant.Default(), cert); len(got) != 1 || got[0] != "example.com/rsa" {
+		t.Fatalf("unexpected secret names %v", got)
+	}
+
+	// Without another pair there's nothing to serve, the host stays on L4
+	cert.Alternates = []*types.KeyPair{{Algorithm: types.Ed25519, Cert: []byte("cert"), Key: []byte("key")}}
+	if _, err := builders.BuildSecrets(tenant.Default(), cert); err == nil {
+		t.Fatal("expected an error building secrets without a pair Envoy can serve")
+	}
+
+	lis, err := builders.New().BuildListener(tenant.Default(), []*types.Certificate{cert}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lis.GetFilterChains()) != 1 || lis.GetFilterChains()[0].GetName() != "l4_passthrough" {
+		t.Fatalf("expected only the passthrough filter chain, got %d", len(lis.GetFilterChains()))
+	}
+}
+
+func TestOptions(t *testing.T) {
+	b := builders.New(
+		builders.WithALS("als.internal", 9000),
+		builders.WithUpstreamPort(8443),
+		builders.WithTrustBundle("/etc/pki/tls/certs/ca-bundle.crt"),
+		builders.WithKeyLogDir(""),
+		builders.WithUpstreamTLSParams(&envoy_tls_v3.TlsParameters{
+			TlsMinimumProtocolVersion: envoy_tls_v3.TlsParameters_TLSv1_2,
+		}),
+		builders.WithClusterNames("als", "passthrough", "wildcard"),
+		builders.WithUpstreamClusterName(func(t *tenant.Tenant, cert *types.Certificate) string {
+			return "upstream_" + t.Qualify(cert.SNI)
+		}),
+		builders.WithListenerAddress("127.0.0.1"),
+		builders.WithListenerName("mitm"),
+	)
+	cert := &types.Certificate{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}
+
+	als, err := b.BuildALSCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := als.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()[0].GetEndpoint().GetAddress().GetSocketAddress(); als.GetName() != "als" || addr.GetAddress() != "als.internal" || addr.GetPortValue() != 9000 {
+		t.Fatalf("ALS cluster %s points at %v", als.GetName(), addr)
+	}
+
+	upstream, err := b.BuildManualUpstream(tenant.Default(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := upstream.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()[0].GetEndpoint().GetAddress().GetSocketAddress(); upstream.GetName() != "upstream_example.com" || addr.GetPortValue() != 8443 {
+		t.Fatalf("upstream cluster %s points at %v", upstream.GetName(), addr)
+	}
+
+	var tlsContext envoy_tls_v3.UpstreamTlsContext
+	if err := upstream.GetTransportSocket().GetTypedConfig().UnmarshalTo(&tlsContext); err != nil {
+		t.Fatal(err)
+	}
+	if tlsContext.GetCommonTlsContext().GetKeyLog() != nil {
+		t.Fatal("keys are logged without a key log directory")
+	}
+	if got := tlsContext.GetCommonTlsContext().GetValidationContext().GetTrustedCa().GetFilename(); got != "/etc/pki/tls/certs/ca-bundle.crt" {
+		t.Fatalf("upstream certificates are verified with %s", got)
+	}
+	if got := tlsContext.GetCommonTlsContext().GetTlsParams().GetTlsMinimumProtocolVersion(); got != envoy_tls_v3.TlsParameters_TLSv1_2 {
+		t.Fatalf("upstream minimum TLS version %s", got)
+	}
+
+	lis, err := b.BuildListener(tenant.Default(), []*types.Certificate{cert}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lis.GetName() != "mitm" || lis.GetAddress().GetSocketAddress().GetAddress() != "127.0.0.1" {
+		t.Fatalf("listener %s binds to %v", lis.GetName(), lis.GetAddress())
+	}
+
+	var tcpProxy envoy_tcp_proxy_v3.TcpProxy
+	if err := filterChain(t, lis, "l4_passthrough").GetFilters()[1].GetTypedConfig().UnmarshalTo(&tcpProxy); err != nil {
+		t.Fatal(err)
+	}
+	if tcpProxy.GetCluster() != "passthrough" {
+		t.Fatalf("passthrough goes through %s", tcpProxy.GetCluster())
+	}
+}
+
+func TestHooks(t *testing.T) {
+	extraLog := &envoy_accesslog_v3.AccessLog{Name: "envoy.access_loggers.stdout"}
+	b := builders.New(
+		builders.WithFileAccessLog(""),
+		builders.WithTCPAccessLogs(extraLog),
+		builders.WithHTTPAccessLogs(extraLog),
+		builders.WithHCMHook(func(_ *tenant.Tenant, cert *types.Certificate, hcm *envoy_http_connection_manager_v3.HttpConnectionManager) error {
+			hcm.ServerName = "mitm " + cert.SNI
+			return nil
+		}),
+	)
+
+	lis, err := b.BuildListener(tenant.Default(), []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tcpProxy envoy_tcp_proxy_v3.TcpProxy
+	if err := filterChain(t, lis, "l4_passthrough").GetFilters()[1].GetTypedConfig().UnmarshalTo(&tcpProxy); err != nil {
+		t.Fatal(err)
+	}
+	if logs := tcpProxy.GetAccessLog(); len(logs) != 2 || logs[0].GetName() != "envoy.access_loggers.tcp_grpc" || logs[1].GetName() != extraLog.GetName() {
+		t.Fatalf("unexpected passthrough access logs %v", logs)
+	}
+
+	var hcm envoy_http_connection_manager_v3.HttpConnectionManager
+	if err := lis.GetFilterChains()[0].GetFilters()[0].GetTypedConfig().UnmarshalTo(&hcm); err != nil {
+		t.Fatal(err)
+	}
+	if hcm.GetServerName() != "mitm example.com" {
+		t.Fatalf("hook did not run, server name %q", hcm.GetServerName())
+	}
+	if logs := hcm.GetAccessLog(); len(logs) != 2 || logs[1].GetName() != extraLog.GetName() {
+		t.Fatalf("unexpected intercepted access logs %v", logs)
+	}
+
+	// A failing hook leaves the host on L4 passthrough
+	b = builders.New(builders.WithHCMHook(func(*tenant.Tenant, *types.Certificate, *envoy_http_connection_manager_v3.HttpConnectionManager) error {
+		return errors.New("no")
+	}))
+	lis, err = b.BuildListener(tenant.Default(), []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lis.GetFilterChains()) != 1 || lis.GetFilterChains()[0].GetName() != "l4_passthrough" {
+		t.Fatal("host with a failing hook is intercepted")
+	}
+}
+
+func filterChain(t *testing.T, lis *envoy_listener_v3.Listener, name string) *envoy_listener_v3.FilterChain {
+	t.Helper()
+
+	for _, fc := range lis.GetFilterChains() {
+		if fc.GetName() == name {
+			return fc
+		}
+	}
+
+	t.Fatalf("no filter chain %s", name)
+	return nil
+}
+
+func assertFixture(t *testing.T, in proto.Message) {
+	t.Helper()
+
+	_, updateFixtures := os.LookupEnv("UPDATE_FIXTURES")
+	got := protoYaml(t, in)
+	fixturePath := filepath.Join("testdata", t.Name()+".yaml")
+
+	want, err := os.ReadFile(fixturePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			want = []byte{}
+		} else {
+			t.Fatal(err)
+		}
+	}
+
+	if !cmp.Equal(want, got) {
+		if updateFixtures {
+			err := os.WriteFile(fixturePath, got, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+		} else {
+			t.Fatalf(cmp.Diff(string(want), string(got)))
+		}
+	}
+}
+
+// protoYaml converts a protobuf message to YAML.
+// protobuf messages are not guaranteed to be marshalled to YAML in a deterministic way.
+// proto -> json blob -> interface{} -> yaml blob
+func protoYaml(t *testing.T, m proto.Message) []byte {
+	t.Helper()
+
+	bytes, err := protojson.MarshalOptions{
+		AllowPartial:  true,
+		UseProtoNames: true,
+	}.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var v interface{}
+	err = json.Unmarshal(bytes, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bytes, err = yaml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bytes
+}
@@ -0,0 +1,376 @@
+package builders
+
+import (
+	"fmt"
+
+	envoy_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_dynamic_forward_proxy_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/dynamic_forward_proxy/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	envoy_extensions_upstream_http_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+	"github.com/golang/protobuf/ptypes/any"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func (b *Builder) BuildALSCluster() (*envoy_cluster_v3.Cluster, error) {
+	httpsOpts := &envoy_extensions_upstream_http_v3.HttpProtocolOptions{
+		UpstreamProtocolOptions: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_ExplicitHttpConfig_{
+			ExplicitHttpConfig: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_ExplicitHttpConfig{
+				ProtocolConfig: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{},
+			},
+		},
+	}
+
+	if err := httpsOpts.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http protocol options config: %w", err)
+	}
+
+	httpsOptsAny, err := anypb.New(httpsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http protocol options to any: %w", err)
+	}
+
+	c := &envoy_cluster_v3.Cluster{
+		Name:                 b.opts.ALSClusterName,
+		LbPolicy:             envoy_cluster_v3.Cluster_ROUND_ROBIN,
+		ClusterDiscoveryType: &envoy_cluster_v3.Cluster_Type{Type: envoy_cluster_v3.Cluster_LOGICAL_DNS},
+		DnsLookupFamily:      envoy_cluster_v3.Cluster_V4_ONLY,
+		LoadAssignment: &envoy_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: b.opts.ALSClusterName,
+			Endpoints: []*envoy_endpoint_v3.LocalityLbEndpoints{
+				{
+					LbEndpoints: []*envoy_endpoint_v3.LbEndpoint{
+						{
+							HostIdentifier: &envoy_endpoint_v3.LbEndpoint_Endpoint{
+								Endpoint: &envoy_endpoint_v3.Endpoint{
+									Address: &envoy_core_v3.Address{
+										Address: &envoy_core_v3.Address_SocketAddress{
+											SocketAddress: &envoy_core_v3.SocketAddress{
+												Address: b.opts.ALSHost,
+												PortSpecifier: &envoy_core_v3.SocketAddress_PortValue{
+													PortValue: b.opts.ALSPort,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		TypedExtensionProtocolOptions: map[string]*any.Any{
+			"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": httpsOptsAny,
+		},
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+func (b *Builder) BuildDynamicForwardProxyCluster() (*envoy_cluster_v3.Cluster, error) {
+	dfpc := envoy_dynamic_forward_proxy_cluster_v3.ClusterConfig{
+		ClusterImplementationSpecifier: &envoy_dynamic_forward_proxy_cluster_v3.ClusterConfig_DnsCacheConfig{
+			DnsCacheConfig: defaultDNSCacheConfig(),
+		},
+		AllowCoalescedConnections: true,
+	}
+
+	if err := dfpc.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid dynamic forward proxy cluster config: %w", err)
+	}
+
+	dfpcAny, err := anypb.New(&dfpc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert dynamic forward proxy cluster to any: %w", err)
+	}
+
+	c := &envoy_cluster_v3.Cluster{
+		Name:            b.opts.DynamicForwardProxyClusterName,
+		LbPolicy:        envoy_cluster_v3.Cluster_CLUSTER_PROVIDED,
+		DnsLookupFamily: envoy_cluster_v3.Cluster_V4_ONLY,
+		ClusterDiscoveryType: &envoy_cluster_v3.Cluster_ClusterType{
+			ClusterType: &envoy_cluster_v3.Cluster_CustomClusterType{
+				Name:        "envoy.clusters.dynamic_forward_proxy",
+				TypedConfig: dfpcAny,
+			},
+		},
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+// BuildDynamicForwardProxyTLSCluster is the upstream of wildcard certificates, it connects to whichever host
+// the request is for and validates the upstream certificate against that host.
+func (b *Builder) BuildDynamicForwardProxyTLSCluster() (*envoy_cluster_v3.Cluster, error) {
+	dfpc := envoy_dynamic_forward_proxy_cluster_v3.ClusterConfig{
+		ClusterImplementationSpecifier: &envoy_dynamic_forward_proxy_cluster_v3.ClusterConfig_DnsCacheConfig{
+			DnsCacheConfig: defaultDNSCacheConfig(),
+		},
+	}
+
+	if err := dfpc.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid dynamic forward proxy cluster config: %w", err)
+	}
+
+	dfpcAny, err := anypb.New(&dfpc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert dynamic forward proxy cluster to any: %w", err)
+	}
+
+	protocolOptions, transportSocket, err := b.buildAutoSNIUpstream()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &envoy_cluster_v3.Cluster{
+		Name:            b.opts.DynamicForwardProxyTLSClusterName,
+		LbPolicy:        envoy_cluster_v3.Cluster_CLUSTER_PROVIDED,
+		DnsLookupFamily: envoy_cluster_v3.Cluster_V4_ONLY,
+		ClusterDiscoveryType: &envoy_cluster_v3.Cluster_ClusterType{
+			ClusterType: &envoy_cluster_v3.Cluster_CustomClusterType{
+				Name:        "envoy.clusters.dynamic_forward_proxy",
+				TypedConfig: dfpcAny,
+			},
+		},
+		TypedExtensionProtocolOptions: protocolOptions,
+		TransportSocket:               transportSocket,
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+// BuildOriginalDstCluster is the upstream of passed through connections in OriginalDst mode, it connects to
+// wherever the connection was going before it was redirected.
+func (b *Builder) BuildOriginalDstCluster() (*envoy_cluster_v3.Cluster, error) {
+	c := &envoy_cluster_v3.Cluster{
+		Name:                 b.opts.OriginalDstClusterName,
+		LbPolicy:             envoy_cluster_v3.Cluster_CLUSTER_PROVIDED,
+		ClusterDiscoveryType: &envoy_cluster_v3.Cluster_Type{Type: envoy_cluster_v3.Cluster_ORIGINAL_DST},
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+// BuildOriginalDstTLSCluster is the upstream of wildcard certificates in OriginalDst mode, it validates the
+// upstream certificate against the host of the request like BuildDynamicForwardProxyTLSCluster.
+func (b *Builder) BuildOriginalDstTLSCluster() (*envoy_cluster_v3.Cluster, error) {
+	protocolOptions, transportSocket, err := b.buildAutoSNIUpstream()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &envoy_cluster_v3.Cluster{
+		Name:                          b.opts.OriginalDstTLSClusterName,
+		LbPolicy:                      envoy_cluster_v3.Cluster_CLUSTER_PROVIDED,
+		ClusterDiscoveryType:          &envoy_cluster_v3.Cluster_Type{Type: envoy_cluster_v3.Cluster_ORIGINAL_DST},
+		TypedExtensionProtocolOptions: protocolOptions,
+		TransportSocket:               transportSocket,
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+// buildAutoSNIUpstream sets the SNI of upstream connections to the host of the request and validates the
+// upstream certificate against it.
+func (b *Builder) buildAutoSNIUpstream() (map[string]*any.Any, *envoy_core_v3.TransportSocket, error) {
+	httpsOpts := &envoy_extensions_upstream_http_v3.HttpProtocolOptions{
+		UpstreamHttpProtocolOptions: &envoy_core_v3.UpstreamHttpProtocolOptions{
+			AutoSni:           true,
+			AutoSanValidation: true,
+		},
+		UpstreamProtocolOptions: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_AutoConfig{
+			AutoConfig: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_AutoHttpConfig{
+				HttpProtocolOptions:  &envoy_core_v3.Http1ProtocolOptions{},
+				Http2ProtocolOptions: &envoy_core_v3.Http2ProtocolOptions{},
+			},
+		},
+	}
+
+	if err := httpsOpts.ValidateAll(); err != nil {
+		return nil, nil, fmt.Errorf("invalid http protocol options config: %w", err)
+	}
+
+	httpsOptsAny, err := anypb.New(httpsOpts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert http protocol options to any: %w", err)
+	}
+
+	tlsConfig := &envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+		CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+			TlsParams: b.opts.UpstreamTLSParams,
+			ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+				ValidationContext: &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{
+					TrustedCa: &envoy_core_v3.DataSource{
+						Specifier: &envoy_core_v3.DataSource_Filename{
+							Filename: b.opts.TrustBundle,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := tlsConfig.ValidateAll(); err != nil {
+		return nil, nil, fmt.Errorf("invalid tls config: %w", err)
+	}
+
+	tlsConfigAny, err := anypb.New(tlsConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to convert tls config to any: %w", err)
+	}
+
+	return map[string]*any.Any{
+		"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": httpsOptsAny,
+	}, &envoy_core_v3.TransportSocket{
+		Name: wellknown.TransportSocketTLS,
+		ConfigType: &envoy_core_v3.TransportSocket_TypedConfig{
+			TypedConfig: tlsConfigAny,
+		},
+	}, nil
+}
+
+// BuildManualUpstream builds the upstream cluster of an exact certificate, named like ClusterName.
+func (b *Builder) BuildManualUpstream(t *tenant.Tenant, cert *types.Certificate) (*envoy_cluster_v3.Cluster, error) {
+	name := b.ClusterName(t, cert)
+
+	httpsOpts := &envoy_extensions_upstream_http_v3.HttpProtocolOptions{
+		UpstreamProtocolOptions: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_AutoConfig{
+			AutoConfig: &envoy_extensions_upstream_http_v3.HttpProtocolOptions_AutoHttpConfig{
+				HttpProtocolOptions: &envoy_core_v3.Http1ProtocolOptions{},
+				Http2ProtocolOptions: &envoy_core_v3.Http2ProtocolOptions{
+					AllowConnect: true,
+					ConnectionKeepalive: &envoy_core_v3.KeepaliveSettings{
+						Interval:               durationpb.New(b.opts.UpstreamKeepalive.Interval),
+						Timeout:                durationpb.New(b.opts.UpstreamKeepalive.Timeout),
+						ConnectionIdleInterval: durationpb.New(b.opts.UpstreamKeepalive.IdleInterval),
+					},
+				},
+			},
+		},
+	}
+
+	if err := httpsOpts.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http protocol options config: %w", err)
+	}
+
+	httpsOptsAny, err := anypb.New(httpsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http protocol options to any: %w", err)
+	}
+
+	tlsConfig := &envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+		Sni: cert.SNI,
+		CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+			TlsParams: b.opts.UpstreamTLSParams,
+			ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+				ValidationContext: &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{
+					TrustedCa: &envoy_core_v3.DataSource{
+						Specifier: &envoy_core_v3.DataSource_Filename{
+							Filename: b.opts.TrustBundle,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if b.opts.KeyLogDir != "" {
+		tlsConfig.CommonTlsContext.KeyLog = &envoy_extensions_transport_sockets_tls_v3.TlsKeyLog{
+			Path: b.keyLogPath(t, cert),
+		}
+	}
+
+	if err := tlsConfig.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid tls config: %w", err)
+	}
+
+	tlsConfigAny, err := anypb.New(tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert tls config to any: %w", err)
+	}
+
+	c := &envoy_cluster_v3.Cluster{
+		Name:                 name,
+		LbPolicy:             envoy_cluster_v3.Cluster_ROUND_ROBIN,
+		ClusterDiscoveryType: &envoy_cluster_v3.Cluster_Type{Type: envoy_cluster_v3.Cluster_LOGICAL_DNS},
+		DnsLookupFamily:      envoy_cluster_v3.Cluster_V4_ONLY,
+		LoadAssignment: &envoy_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*envoy_endpoint_v3.LocalityLbEndpoints{
+				{
+					LbEndpoints: []*envoy_endpoint_v3.LbEndpoint{
+						{
+							HostIdentifier: &envoy_endpoint_v3.LbEndpoint_Endpoint{
+								Endpoint: &envoy_endpoint_v3.Endpoint{
+									Address: &envoy_core_v3.Address{
+										Address: &envoy_core_v3.Address_SocketAddress{
+											SocketAddress: &envoy_core_v3.SocketAddress{
+												Address: cert.SNI,
+												PortSpecifier: &envoy_core_v3.SocketAddress_PortValue{
+													PortValue: b.opts.UpstreamPort,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		TypedExtensionProtocolOptions: map[string]*any.Any{
+			"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": httpsOptsAny,
+		},
+		TransportSocket: &envoy_core_v3.TransportSocket{
+			Name: wellknown.TransportSocketTLS,
+			ConfigType: &envoy_core_v3.TransportSocket_TypedConfig{
+				TypedConfig: tlsConfigAny,
+			},
+		},
+	}
+
+	// The original destination already is the address the client resolved the host to, on the port it dialed
+	if b.opts.OriginalDst {
+		c.LbPolicy = envoy_cluster_v3.Cluster_CLUSTER_PROVIDED
+		c.ClusterDiscoveryType = &envoy_cluster_v3.Cluster_Type{Type: envoy_cluster_v3.Cluster_ORIGINAL_DST}
+		c.LoadAssignment = nil
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+// ClusterName returns the name of the upstream cluster of an exact certificate.
+func (b *Builder) ClusterName(t *tenant.Tenant, cert *types.Certificate) string {
+	return b.opts.UpstreamClusterName(t, cert)
+}
@@ -5,6 +5,14 @@ import (
 	envoy_dynamic_forward_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/dynamic_forward_proxy/v3"
 )
 
+const (
+	passthroughFilterChainName = "l4_passthrough"
+
+	// Routes of the plaintext HTTP listener are named after the policy's decision, the access logs filter on them
+	interceptRouteName   = "intercept"
+	passthroughRouteName = "passthrough"
+)
+
 func defaultDNSCacheConfig() *envoy_dynamic_forward_proxy_v3.DnsCacheConfig {
 	return &envoy_dynamic_forward_proxy_v3.DnsCacheConfig{
 		Name:            "dynamic_forward_proxy_cache_config",
@@ -0,0 +1,265 @@
+package builders
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	envoy_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	envoy_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoy_matcher_v3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// BuildConnectListener builds the explicit forward proxy listener of tenant t on t.ConnectPort, named like
+// ConnectListenerName. CONNECT requests to the upstream port are tunneled back into the tenant's listener,
+// so that TLS to hosts with certificates is intercepted exactly like on the SNI path. Tunnels to any other
+// port go straight through the dynamic forward proxy, like every tunnel in OriginalDst mode: the original
+// destination of a tunnel fed back into the listener is the listener itself.
+func (b *Builder) BuildConnectListener(t *tenant.Tenant) (*envoy_listener_v3.Listener, error) {
+	hcm, err := b.buildConnectHCM(t)
+	if err != nil {
+		return nil, err
+	}
+
+	lis := &envoy_listener_v3.Listener{
+		Name: b.ConnectListenerName(t),
+		Address: &envoy_core_v3.Address{
+			Address: &envoy_core_v3.Address_SocketAddress{
+				SocketAddress: &envoy_core_v3.SocketAddress{
+					Address: b.opts.ListenerAddress,
+					PortSpecifier: &envoy_core_v3.SocketAddress_PortValue{
+						PortValue: t.ConnectPort,
+					},
+					Protocol: envoy_core_v3.SocketAddress_TCP,
+				},
+			},
+		},
+		FilterChains: []*envoy_listener_v3.FilterChain{
+			{
+				Name: "connect",
+				Filters: []*envoy_listener_v3.Filter{
+					{
+						Name: wellknown.HTTPConnectionManager,
+						ConfigType: &envoy_listener_v3.Filter_TypedConfig{
+							TypedConfig: hcm,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := lis.ValidateAll(); err != nil {
+		return nil, err
+	}
+	return lis, nil
+}
+
+// ConnectListenerName returns the name of the explicit forward proxy listener of tenant t.
+func (b *Builder) ConnectListenerName(t *tenant.Tenant) string {
+	return t.Qualify(b.opts.ConnectListenerName)
+}
+
+// BuildConnectLoopbackCluster builds the cluster CONNECT tunnels to the upstream port go through, it points
+// back at the listener of tenant t.
+func (b *Builder) BuildConnectLoopbackCluster(t *tenant.Tenant) (*envoy_cluster_v3.Cluster, error) {
+	name := b.ConnectLoopbackClusterName(t)
+
+	// A listener bound to every address is reachable on loopback
+	address := b.opts.ListenerAddress
+	if ip := net.ParseIP(address); ip != nil && ip.IsUnspecified() {
+		address = "127.0.0.1"
+		if ip.To4() == nil {
+			address = "::1"
+		}
+	}
+
+	c := &envoy_cluster_v3.Cluster{
+		Name:                 name,
+		LbPolicy:             envoy_cluster_v3.Cluster_ROUND_ROBIN,
+		ClusterDiscoveryType: &envoy_cluster_v3.Cluster_Type{Type: envoy_cluster_v3.Cluster_STATIC},
+		LoadAssignment: &envoy_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*envoy_endpoint_v3.LocalityLbEndpoints{
+				{
+					LbEndpoints: []*envoy_endpoint_v3.LbEndpoint{
+						{
+							HostIdentifier: &envoy_endpoint_v3.LbEndpoint_Endpoint{
+								Endpoint: &envoy_endpoint_v3.Endpoint{
+									Address: &envoy_core_v3.Address{
+										Address: &envoy_core_v3.Address_SocketAddress{
+											SocketAddress: &envoy_core_v3.SocketAddress{
+												Address: address,
+												PortSpecifier: &envoy_core_v3.SocketAddress_PortValue{
+													PortValue: t.Port,
+												},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if err := c.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+
+	return c, nil
+}
+
+// ConnectLoopbackClusterName returns the name of the loopback cluster of tenant t.
+func (b *Builder) ConnectLoopbackClusterName(t *tenant.Tenant) string {
+	return t.Qualify(b.opts.ConnectLoopbackClusterName)
+}
+
+// buildConnectHCM terminates HTTP/1.1 and HTTP/2 CONNECT and tunnels the payload. Plain requests are refused.
+func (b *Builder) buildConnectHCM(t *tenant.Tenant) (*anypb.Any, error) {
+	dfp, err := buildHTTPDynamicForwardProxy()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dynamic forward proxy filter: %w", err)
+	}
+
+	httpRouter, err := buildHTTPRouter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build http router: %w", err)
+	}
+
+	accessLogs, err := b.buildFileAccessLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build access log: %w", err)
+	}
+
+	grpcAccessLog, err := b.buildHTTPGRPCAccessLog(t.Qualify(types.ConnectLogName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build grpc access log: %w", err)
+	}
+
+	hcm := envoy_http_connection_manager_v3.HttpConnectionManager{
+		StatPrefix: "connect",
+		CodecType:  envoy_http_connection_manager_v3.HttpConnectionManager_AUTO,
+		Http2ProtocolOptions: &envoy_core_v3.Http2ProtocolOptions{
+			AllowConnect: true,
+		},
+		UpgradeConfigs: []*envoy_http_connection_manager_v3.HttpConnectionManager_UpgradeConfig{
+			{
+				UpgradeType: "CONNECT",
+			},
+		},
+		// Lets ALS mint certificates for the hosts clients tunnel to
+		AccessLog: append(append(accessLogs, &envoy_accesslog_v3.AccessLog{
+			Name: "envoy.access_loggers.http_grpc",
+			ConfigType: &envoy_accesslog_v3.AccessLog_TypedConfig{
+				TypedConfig: grpcAccessLog,
+			},
+		}), b.opts.HTTPAccessLogs...),
+		HttpFilters: []*envoy_http_connection_manager_v3.HttpFilter{
+			{
+				Name: "envoy.filters.http.dynamic_forward_proxy",
+				ConfigType: &envoy_http_connection_manager_v3.HttpFilter_TypedConfig{
+					TypedConfig: dfp,
+				},
+			},
+			{
+				Name: wellknown.Router,
+				ConfigType: &envoy_http_connection_manager_v3.HttpFilter_TypedConfig{
+					TypedConfig: httpRouter,
+				},
+			},
+		},
+		RouteSpecifier: &envoy_http_connection_manager_v3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &envoy_route_v3.RouteConfiguration{
+				Name: "connect",
+				VirtualHosts: []*envoy_route_v3.VirtualHost{
+					{
+						Name:    "connect",
+						Domains: []string{"*"},
+						Routes:  b.buildConnectRoutes(t),
+					},
+				},
+			},
+		},
+	}
+
+	if err := hcm.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http connection manager config: %w", err)
+	}
+
+	hcmAny, err := anypb.New(&hcm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http connection manager to any: %w", err)
+	}
+
+	return hcmAny, nil
+}
+
+// buildConnectRoutes sends tunnels to the upstream port back into the listener of t, unless in OriginalDst mode.
+func (b *Builder) buildConnectRoutes(t *tenant.Tenant) []*envoy_route_v3.Route {
+	forward := &envoy_route_v3.Route{
+		Match: &envoy_route_v3.RouteMatch{
+			PathSpecifier: &envoy_route_v3.RouteMatch_ConnectMatcher_{
+				ConnectMatcher: &envoy_route_v3.RouteMatch_ConnectMatcher{},
+			},
+		},
+		Action: tunnel(b.opts.DynamicForwardProxyClusterName),
+	}
+	if b.opts.OriginalDst {
+		return []*envoy_route_v3.Route{forward}
+	}
+
+	return []*envoy_route_v3.Route{
+		// TLS goes through the tenant's listener, which intercepts or passes it through by SNI
+		{
+			Match: &envoy_route_v3.RouteMatch{
+				PathSpecifier: &envoy_route_v3.RouteMatch_ConnectMatcher_{
+					ConnectMatcher: &envoy_route_v3.RouteMatch_ConnectMatcher{},
+				},
+				Headers: []*envoy_route_v3.HeaderMatcher{
+					{
+						Name: ":authority",
+						HeaderMatchSpecifier: &envoy_route_v3.HeaderMatcher_StringMatch{
+							StringMatch: &envoy_matcher_v3.StringMatcher{
+								MatchPattern: &envoy_matcher_v3.StringMatcher_Suffix{
+									Suffix: ":" + strconv.FormatUint(uint64(b.opts.UpstreamPort), 10),
+								},
+							},
+						},
+					},
+				},
+			},
+			Action: tunnel(b.ConnectLoopbackClusterName(t)),
+		},
+		forward,
+	}
+}
+
+// tunnel terminates CONNECT and sends the payload to cluster.
+func tunnel(cluster string) *envoy_route_v3.Route_Route {
+	return &envoy_route_v3.Route_Route{
+		Route: &envoy_route_v3.RouteAction{
+			ClusterSpecifier: &envoy_route_v3.RouteAction_Cluster{
+				Cluster: cluster,
+			},
+			UpgradeConfigs: []*envoy_route_v3.RouteAction_UpgradeConfig{
+				{
+					UpgradeType:   "CONNECT",
+					ConnectConfig: &envoy_route_v3.RouteAction_UpgradeConfig_ConnectConfig{},
+				},
+			},
+		},
+	}
+}
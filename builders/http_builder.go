@@ -0,0 +1,274 @@
+package builders
+
+import (
+	"fmt"
+	"strings"
+
+	envoy_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_cel_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/filters/cel/v3"
+	envoy_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoy_matcher_v3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// BuildHTTPListener builds the plaintext HTTP listener of tenant t on t.HTTPPort, named like HTTPListenerName.
+// Requests are forwarded to their host by the dynamic forward proxy, both in origin form and in the absolute
+// form HTTP_PROXY clients send, or to their original destination in OriginalDst mode. pol is evaluated on the
+// host of every request: intercepted hosts are logged in full, passthrough hosts are only forwarded like on the
+// L4 path. A nil pol intercepts everything.
+func (b *Builder) BuildHTTPListener(t *tenant.Tenant, pol *policy.Policy) (*envoy_listener_v3.Listener, error) {
+	hcm, err := b.buildPlaintextHCM(t, pol)
+	if err != nil {
+		return nil, err
+	}
+
+	listenerFilters, err := b.buildListenerFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	lis := &envoy_listener_v3.Listener{
+		Name: b.HTTPListenerName(t),
+		Address: &envoy_core_v3.Address{
+			Address: &envoy_core_v3.Address_SocketAddress{
+				SocketAddress: &envoy_core_v3.SocketAddress{
+					Address: b.opts.ListenerAddress,
+					PortSpecifier: &envoy_core_v3.SocketAddress_PortValue{
+						PortValue: t.HTTPPort,
+					},
+					Protocol: envoy_core_v3.SocketAddress_TCP,
+				},
+			},
+		},
+		ListenerFilters: listenerFilters,
+		FilterChains: []*envoy_listener_v3.FilterChain{
+			{
+				Name: "http",
+				Filters: []*envoy_listener_v3.Filter{
+					{
+						Name: wellknown.HTTPConnectionManager,
+						ConfigType: &envoy_listener_v3.Filter_TypedConfig{
+							TypedConfig: hcm,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Redirecting port 80 here with TPROXY needs the same socket option as the TLS listener
+	if b.opts.Transparent {
+		lis.Transparent = wrapperspb.Bool(true)
+	}
+
+	if err := lis.ValidateAll(); err != nil {
+		return nil, err
+	}
+	return lis, nil
+}
+
+// HTTPListenerName returns the name of the plaintext HTTP listener of tenant t.
+func (b *Builder) HTTPListenerName(t *tenant.Tenant) string {
+	return t.Qualify(b.opts.HTTPListenerName)
+}
+
+func (b *Builder) buildPlaintextHCM(t *tenant.Tenant, pol *policy.Policy) (*anypb.Any, error) {
+	httpRouter, err := buildHTTPRouter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build http router: %w", err)
+	}
+
+	httpFilters := []*envoy_http_connection_manager_v3.HttpFilter{
+		{
+			Name: wellknown.Router,
+			ConfigType: &envoy_http_connection_manager_v3.HttpFilter_TypedConfig{
+				TypedConfig: httpRouter,
+			},
+		},
+	}
+
+	// The original destination is already resolved, there's nothing to look up
+	if !b.opts.OriginalDst {
+		dfp, err := buildHTTPDynamicForwardProxy()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build dynamic forward proxy filter: %w", err)
+		}
+
+		httpFilters = append([]*envoy_http_connection_manager_v3.HttpFilter{
+			{
+				Name: "envoy.filters.http.dynamic_forward_proxy",
+				ConfigType: &envoy_http_connection_manager_v3.HttpFilter_TypedConfig{
+					TypedConfig: dfp,
+				},
+			},
+		}, httpFilters...)
+	}
+
+	accessLogs, err := b.buildFileAccessLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build access log: %w", err)
+	}
+
+	grpcAccessLog, err := b.buildHTTPGRPCAccessLog(t.Qualify(types.HTTPLogName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build grpc access log: %w", err)
+	}
+
+	accessLogs = append(accessLogs, &envoy_accesslog_v3.AccessLog{
+		Name: "envoy.access_loggers.http_grpc",
+		ConfigType: &envoy_accesslog_v3.AccessLog_TypedConfig{
+			TypedConfig: grpcAccessLog,
+		},
+	})
+
+	// Requests the policy passes through don't show up in the logs, like passthrough hosts on the TLS path
+	// only show up as connections
+	if pol != nil {
+		filter, err := buildRouteAccessLogFilter(interceptRouteName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build access log filter: %w", err)
+		}
+
+		for _, accessLog := range accessLogs {
+			accessLog.Filter = filter
+		}
+	}
+
+	hcm := envoy_http_connection_manager_v3.HttpConnectionManager{
+		StatPrefix: "http_ingress",
+		CodecType:  envoy_http_connection_manager_v3.HttpConnectionManager_AUTO,
+		HttpProtocolOptions: &envoy_core_v3.Http1ProtocolOptions{
+			AllowAbsoluteUrl: wrapperspb.Bool(true),
+		},
+		UpgradeConfigs: []*envoy_http_connection_manager_v3.HttpConnectionManager_UpgradeConfig{
+			{
+				Enabled:     wrapperspb.Bool(true),
+				UpgradeType: "websocket",
+			},
+		},
+		AccessLog:   append(accessLogs, b.opts.HTTPAccessLogs...),
+		HttpFilters: httpFilters,
+		RouteSpecifier: &envoy_http_connection_manager_v3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &envoy_route_v3.RouteConfiguration{
+				Name: "http",
+				VirtualHosts: []*envoy_route_v3.VirtualHost{
+					{
+						Name:    "http",
+						Domains: []string{"*"},
+						Routes:  b.buildPolicyRoutes(pol),
+					},
+				},
+			},
+		},
+	}
+
+	if err := hcm.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http connection manager config: %w", err)
+	}
+
+	hcmAny, err := anypb.New(&hcm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http connection manager to any: %w", err)
+	}
+
+	return hcmAny, nil
+}
+
+// buildPolicyRoutes renders pol as routes on the request's host in the same order, first match wins like
+// policy.Decide. Every route goes to the dynamic forward proxy, or the original destination in OriginalDst mode,
+// they are named after the action.
+func (b *Builder) buildPolicyRoutes(pol *policy.Policy) []*envoy_route_v3.Route {
+	cluster := b.opts.DynamicForwardProxyClusterName
+	if b.opts.OriginalDst {
+		cluster = b.opts.OriginalDstClusterName
+	}
+
+	route := func(action policy.Action, headers []*envoy_route_v3.HeaderMatcher) *envoy_route_v3.Route {
+		name := interceptRouteName
+		if action != policy.Intercept {
+			name = passthroughRouteName
+		}
+
+		return &envoy_route_v3.Route{
+			Name: name,
+			Match: &envoy_route_v3.RouteMatch{
+				PathSpecifier: &envoy_route_v3.RouteMatch_Prefix{
+					Prefix: "/",
+				},
+				Headers: headers,
+			},
+			Action: &envoy_route_v3.Route_Route{
+				Route: &envoy_route_v3.RouteAction{
+					ClusterSpecifier: &envoy_route_v3.RouteAction_Cluster{
+						Cluster: cluster,
+					},
+				},
+			},
+		}
+	}
+
+	if pol == nil {
+		return []*envoy_route_v3.Route{route(policy.Intercept, nil)}
+	}
+
+	routes := make([]*envoy_route_v3.Route, 0, len(pol.Rules)+1)
+	for _, rule := range pol.Rules {
+		routes = append(routes, route(rule.Action, []*envoy_route_v3.HeaderMatcher{
+			{
+				Name: ":authority",
+				HeaderMatchSpecifier: &envoy_route_v3.HeaderMatcher_StringMatch{
+					StringMatch: &envoy_matcher_v3.StringMatcher{
+						MatchPattern: &envoy_matcher_v3.StringMatcher_SafeRegex{
+							SafeRegex: &envoy_matcher_v3.RegexMatcher{
+								Regex: authorityRegex(rule.Regex()),
+							},
+						},
+					},
+				},
+			},
+		}))
+	}
+
+	return append(routes, route(pol.Default, nil))
+}
+
+// authorityRegex extends a regex anchored on a host to the authority, which may carry a port and any case.
+func authorityRegex(hostRegex string) string {
+	return "(?i)" + strings.TrimSuffix(hostRegex, "$") + `(?::[0-9]+)?$`
+}
+
+// buildRouteAccessLogFilter only logs requests that were routed by the route called name.
+func buildRouteAccessLogFilter(name string) (*envoy_accesslog_v3.AccessLogFilter, error) {
+	expression := envoy_cel_v3.ExpressionFilter{
+		Expression: fmt.Sprintf("xds.route_name == %q", name),
+	}
+
+	if err := expression.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid cel filter config: %w", err)
+	}
+
+	expressionAny, err := anypb.New(&expression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert cel filter to any: %w", err)
+	}
+
+	return &envoy_accesslog_v3.AccessLogFilter{
+		FilterSpecifier: &envoy_accesslog_v3.AccessLogFilter_ExtensionFilter{
+			ExtensionFilter: &envoy_accesslog_v3.ExtensionFilter{
+				Name: "envoy.access_loggers.extension_filters.cel",
+				ConfigType: &envoy_accesslog_v3.ExtensionFilter_TypedConfig{
+					TypedConfig: expressionAny,
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,788 @@
+package builders
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	xds_core_v3 "github.com/cncf/xds/go/xds/core/v3"
+	xds_matcher_v3 "github.com/cncf/xds/go/xds/type/matcher/v3"
+
+	envoy_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_file_access_log_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
+	envoy_grpc_access_log_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/grpc/v3"
+	envoy_http_dynamic_forward_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/dynamic_forward_proxy/v3"
+	envoy_http_router_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	envoy_original_dst_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/original_dst/v3"
+	envoy_extensions_filters_listener_tls_inspector_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	envoy_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoy_sni_dynamic_forward_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/sni_dynamic_forward_proxy/v3"
+	envoy_tcp_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	envoy_matching_network_inputs_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/matching/common_inputs/network/v3"
+	envoy_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// BuildListener builds the listener of tenant t, named like ListenerName. Exact certificates are dispatched on
+// the server name, wildcard certificates on their DNS names but only for the hosts pol intercepts.
+// A nil pol intercepts everything. Connections that aren't TLS are closed, unless in OriginalDst mode
+// where they are passed through to the original destination.
+func (b *Builder) BuildListener(t *tenant.Tenant, certs []*types.Certificate, pol *policy.Policy) (*envoy_listener_v3.Listener, error) {
+	passthrough, err := b.buildPassthroughFilterChain(t, passthroughFilterChainName)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsInspector, err := buildTLSInspector()
+	if err != nil {
+		return nil, err
+	}
+
+	listenerFilters, err := b.buildListenerFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	lis := &envoy_listener_v3.Listener{
+		Name: b.ListenerName(t),
+		Address: &envoy_core_v3.Address{
+			Address: &envoy_core_v3.Address_SocketAddress{
+				SocketAddress: &envoy_core_v3.SocketAddress{
+					Address: b.opts.ListenerAddress,
+					PortSpecifier: &envoy_core_v3.SocketAddress_PortValue{
+						PortValue: t.Port,
+					},
+					Protocol: envoy_core_v3.SocketAddress_TCP,
+				},
+			},
+		},
+		ListenerFilters: append(listenerFilters, &envoy_listener_v3.ListenerFilter{
+			Name: "envoy.filters.listener.tls_inspector",
+			ConfigType: &envoy_listener_v3.ListenerFilter_TypedConfig{
+				TypedConfig: tlsInspector,
+			},
+		}),
+		FilterChains: []*envoy_listener_v3.FilterChain{},
+	}
+	if b.opts.Transparent {
+		lis.Transparent = wrapperspb.Bool(true)
+	}
+
+	// Sort so that the listener is identical for an identical set of certificates
+	sorted := make([]*types.Certificate, len(certs))
+	copy(sorted, certs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].SNI < sorted[j].SNI
+	})
+
+	// Add L7 Filters if we have certs
+	// Be really defensive here, if we have certs, but can't build the filter chains, we should not fail
+	// the whole listener as we can still proxy the traffic on L4
+	var exact []string
+	var wildcards []*types.Certificate
+	for _, cert := range sorted {
+		// Wildcard chains are unreachable when the policy passes everything through
+		if cert.Wildcard && pol != nil && len(pol.Rules) == 0 && pol.Default == policy.Passthrough {
+			continue
+		}
+
+		downstreamTLSContext, err := buildDownstreamTLSContext(t, cert)
+		if err != nil {
+			log.Println("failed to build downstream TLS context", err)
+			continue
+		}
+
+		hcm, err := b.buildHCM(t, cert)
+		if err != nil {
+			log.Println("failed to build HCM", err)
+			continue
+		}
+
+		// Filter chains are named after the host, the filter chain matcher refers to them by name
+		lis.FilterChains = append(lis.FilterChains, &envoy_listener_v3.FilterChain{
+			Name: cert.SNI,
+			TransportSocket: &envoy_core_v3.TransportSocket{
+				Name: wellknown.TransportSocketTLS,
+				ConfigType: &envoy_core_v3.TransportSocket_TypedConfig{
+					TypedConfig: downstreamTLSContext,
+				},
+			},
+			Filters: []*envoy_listener_v3.Filter{
+				{
+					Name: wellknown.HTTPConnectionManager,
+					ConfigType: &envoy_listener_v3.Filter_TypedConfig{
+						TypedConfig: hcm,
+					},
+				},
+			},
+		})
+
+		if cert.Wildcard {
+			wildcards = append(wildcards, cert)
+		} else {
+			exact = append(exact, cert.SNI)
+		}
+	}
+
+	// Anything the filter chain matcher doesn't intercept goes through sni_dynamic_forward_proxy + tcp_proxy,
+	// or straight to the original destination in OriginalDst mode. Not a default filter chain, those
+	// would also take the connections that aren't TLS.
+	lis.FilterChains = append(lis.FilterChains, passthrough)
+
+	matcher, err := b.buildFilterChainMatcher(exact, wildcards, pol)
+	if err != nil {
+		return nil, err
+	}
+
+	lis.FilterChainMatcher = matcher
+
+	if err := lis.ValidateAll(); err != nil {
+		return nil, err
+	}
+	return lis, nil
+}
+
+// ListenerName returns the name of the listener of tenant t.
+func (b *Builder) ListenerName(t *tenant.Tenant) string {
+	return t.Qualify(b.opts.ListenerName)
+}
+
+// buildListenerFilters restores the original destination of redirected connections in OriginalDst mode.
+func (b *Builder) buildListenerFilters() ([]*envoy_listener_v3.ListenerFilter, error) {
+	if !b.opts.OriginalDst {
+		return nil, nil
+	}
+
+	originalDst, err := anypb.New(&envoy_original_dst_v3.OriginalDst{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert original dst to any: %w", err)
+	}
+
+	return []*envoy_listener_v3.ListenerFilter{
+		{
+			Name: "envoy.filters.listener.original_dst",
+			ConfigType: &envoy_listener_v3.ListenerFilter_TypedConfig{
+				TypedConfig: originalDst,
+			},
+		},
+	}, nil
+}
+
+func (b *Builder) buildPassthroughFilterChain(t *tenant.Tenant, name string) (*envoy_listener_v3.FilterChain, error) {
+	accessLog, err := b.buildCombinedAccessLog(t)
+	if err != nil {
+		return nil, err
+	}
+
+	// The original destination has the port and, without a server name, the only hint where to go
+	if b.opts.OriginalDst {
+		tcpProxy, err := b.buildTCPProxy(b.opts.OriginalDstClusterName, accessLog...)
+		if err != nil {
+			return nil, err
+		}
+
+		return &envoy_listener_v3.FilterChain{
+			Name: name,
+			Filters: []*envoy_listener_v3.Filter{
+				{
+					Name: wellknown.TCPProxy,
+					ConfigType: &envoy_listener_v3.Filter_TypedConfig{
+						TypedConfig: tcpProxy,
+					},
+				},
+			},
+		}, nil
+	}
+
+	tcpProxy, err := b.buildTCPProxy(b.opts.DynamicForwardProxyClusterName, accessLog...)
+	if err != nil {
+		return nil, err
+	}
+
+	sniProxy, err := b.buildSNIProxy()
+	if err != nil {
+		return nil, err
+	}
+
+	return &envoy_listener_v3.FilterChain{
+		Name: name,
+		Filters: []*envoy_listener_v3.Filter{
+			{
+				Name: "envoy.filters.network.sni_dynamic_forward_proxy",
+				ConfigType: &envoy_listener_v3.Filter_TypedConfig{
+					TypedConfig: sniProxy,
+				},
+			},
+			{
+				Name: wellknown.TCPProxy,
+				ConfigType: &envoy_listener_v3.Filter_TypedConfig{
+					TypedConfig: tcpProxy,
+				},
+			},
+		},
+	}, nil
+}
+
+// buildFilterChainMatcher dispatches TLS connections on the server name to the filter chain of the same name.
+// Unlike FilterChainMatch, adding a host only adds an entry to the map so Envoy leaves the other chains alone.
+//
+// Server names without an exact certificate fall through to the policy, rendered as regexes in the same order,
+// and whatever it intercepts to the wildcard certificates covering the name. Everything else is passed through.
+func (b *Builder) buildFilterChainMatcher(exact []string, wildcards []*types.Certificate, pol *policy.Policy) (*xds_matcher_v3.Matcher, error) {
+	transportProtocolInput, err := anypb.New(&envoy_matching_network_inputs_v3.TransportProtocolInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert transport protocol input to any: %w", err)
+	}
+
+	serverNameInput, err := anypb.New(&envoy_matching_network_inputs_v3.ServerNameInput{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert server name input to any: %w", err)
+	}
+
+	input := &xds_core_v3.TypedExtensionConfig{
+		Name:        "envoy.matching.inputs.server_name",
+		TypedConfig: serverNameInput,
+	}
+
+	passthrough, err := filterChainAction(passthroughFilterChainName)
+	if err != nil {
+		return nil, err
+	}
+
+	tls := passthrough
+	if len(wildcards) > 0 {
+		tls, err = buildWildcardOnMatch(input, wildcards, pol, passthrough)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(exact) > 0 {
+		exactMatchMap := make(map[string]*xds_matcher_v3.Matcher_OnMatch, len(exact))
+		for _, name := range exact {
+			action, err := filterChainAction(name)
+			if err != nil {
+				return nil, err
+			}
+
+			exactMatchMap[name] = action
+		}
+
+		tls = &xds_matcher_v3.Matcher_OnMatch{
+			OnMatch: &xds_matcher_v3.Matcher_OnMatch_Matcher{
+				Matcher: &xds_matcher_v3.Matcher{
+					MatcherType: &xds_matcher_v3.Matcher_MatcherTree_{
+						MatcherTree: &xds_matcher_v3.Matcher_MatcherTree{
+							Input: input,
+							TreeType: &xds_matcher_v3.Matcher_MatcherTree_ExactMatchMap{
+								ExactMatchMap: &xds_matcher_v3.Matcher_MatcherTree_MatchMap{
+									Map: exactMatchMap,
+								},
+							},
+						},
+					},
+					OnNoMatch: tls,
+				},
+			},
+		}
+	}
+
+	// The tls_inspector sets the transport protocol to "tls", everything else is "raw_buffer"
+	matcher := &xds_matcher_v3.Matcher{
+		MatcherType: &xds_matcher_v3.Matcher_MatcherTree_{
+			MatcherTree: &xds_matcher_v3.Matcher_MatcherTree{
+				Input: &xds_core_v3.TypedExtensionConfig{
+					Name:        "envoy.matching.inputs.transport_protocol",
+					TypedConfig: transportProtocolInput,
+				},
+				TreeType: &xds_matcher_v3.Matcher_MatcherTree_ExactMatchMap{
+					ExactMatchMap: &xds_matcher_v3.Matcher_MatcherTree_MatchMap{
+						Map: map[string]*xds_matcher_v3.Matcher_OnMatch{
+							"tls": tls,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Without a server name only the original destination says where to go, nothing matches and
+	// Envoy closes the connection otherwise
+	if b.opts.OriginalDst {
+		matcher.OnNoMatch = passthrough
+	}
+
+	if err := matcher.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid filter chain matcher config: %w", err)
+	}
+
+	return matcher, nil
+}
+
+// buildWildcardOnMatch evaluates pol and sends intercepted server names to the wildcard certificate covering them,
+// the rest to passthrough.
+func buildWildcardOnMatch(input *xds_core_v3.TypedExtensionConfig, wildcards []*types.Certificate, pol *policy.Policy, passthrough *xds_matcher_v3.Matcher_OnMatch) (*xds_matcher_v3.Matcher_OnMatch, error) {
+	wildcardMatcher := &xds_matcher_v3.Matcher{
+		MatcherType: &xds_matcher_v3.Matcher_MatcherList_{
+			MatcherList: &xds_matcher_v3.Matcher_MatcherList{},
+		},
+		OnNoMatch: passthrough,
+	}
+
+	for _, cert := range wildcards {
+		action, err := filterChainAction(cert.SNI)
+		if err != nil {
+			return nil, err
+		}
+
+		wildcardMatcher.GetMatcherList().Matchers = append(wildcardMatcher.GetMatcherList().Matchers, &xds_matcher_v3.Matcher_MatcherList_FieldMatcher{
+			Predicate: regexPredicate(input, namesRegex(cert.DNSNames)),
+			OnMatch:   action,
+		})
+	}
+
+	intercept := &xds_matcher_v3.Matcher_OnMatch{
+		OnMatch: &xds_matcher_v3.Matcher_OnMatch_Matcher{Matcher: wildcardMatcher},
+	}
+	if pol == nil {
+		return intercept, nil
+	}
+
+	decide := func(action policy.Action) *xds_matcher_v3.Matcher_OnMatch {
+		if action == policy.Intercept {
+			return intercept
+		}
+		return passthrough
+	}
+
+	if len(pol.Rules) == 0 {
+		return decide(pol.Default), nil
+	}
+
+	// First match wins, like policy.Decide
+	policyMatcher := &xds_matcher_v3.Matcher{
+		MatcherType: &xds_matcher_v3.Matcher_MatcherList_{
+			MatcherList: &xds_matcher_v3.Matcher_MatcherList{},
+		},
+		OnNoMatch: decide(pol.Default),
+	}
+
+	for _, rule := range pol.Rules {
+		policyMatcher.GetMatcherList().Matchers = append(policyMatcher.GetMatcherList().Matchers, &xds_matcher_v3.Matcher_MatcherList_FieldMatcher{
+			Predicate: regexPredicate(input, rule.Regex()),
+			OnMatch:   decide(rule.Action),
+		})
+	}
+
+	return &xds_matcher_v3.Matcher_OnMatch{
+		OnMatch: &xds_matcher_v3.Matcher_OnMatch_Matcher{Matcher: policyMatcher},
+	}, nil
+}
+
+func filterChainAction(name string) (*xds_matcher_v3.Matcher_OnMatch, error) {
+	action, err := anypb.New(wrapperspb.String(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert filter chain name to any: %w", err)
+	}
+
+	return &xds_matcher_v3.Matcher_OnMatch{
+		OnMatch: &xds_matcher_v3.Matcher_OnMatch_Action{
+			Action: &xds_core_v3.TypedExtensionConfig{
+				Name:        name,
+				TypedConfig: action,
+			},
+		},
+	}, nil
+}
+
+func regexPredicate(input *xds_core_v3.TypedExtensionConfig, regex string) *xds_matcher_v3.Matcher_MatcherList_Predicate {
+	return &xds_matcher_v3.Matcher_MatcherList_Predicate{
+		MatchType: &xds_matcher_v3.Matcher_MatcherList_Predicate_SinglePredicate_{
+			SinglePredicate: &xds_matcher_v3.Matcher_MatcherList_Predicate_SinglePredicate{
+				Input: input,
+				Matcher: &xds_matcher_v3.Matcher_MatcherList_Predicate_SinglePredicate_ValueMatch{
+					ValueMatch: &xds_matcher_v3.StringMatcher{
+						MatchPattern: &xds_matcher_v3.StringMatcher_SafeRegex{
+							SafeRegex: &xds_matcher_v3.RegexMatcher{
+								EngineType: &xds_matcher_v3.RegexMatcher_GoogleRe2{
+									GoogleRe2: &xds_matcher_v3.RegexMatcher_GoogleRE2{},
+								},
+								Regex: regex,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// namesRegex matches the same server names a certificate for names is valid for.
+func namesRegex(names []string) string {
+	patterns := make([]string, 0, len(names))
+	for _, name := range names {
+		if parent := strings.TrimPrefix(name, "*."); parent != name {
+			patterns = append(patterns, `[^.]+\.`+regexp.QuoteMeta(parent))
+		} else {
+			patterns = append(patterns, regexp.QuoteMeta(name))
+		}
+	}
+
+	return "^(?:" + strings.Join(patterns, "|") + ")$"
+}
+
+func (b *Builder) buildSNIProxy() (*anypb.Any, error) {
+	sniProxy := envoy_sni_dynamic_forward_proxy_v3.FilterConfig{
+		DnsCacheConfig: defaultDNSCacheConfig(),
+		PortSpecifier: &envoy_sni_dynamic_forward_proxy_v3.FilterConfig_PortValue{
+			PortValue: b.opts.UpstreamPort,
+		},
+	}
+
+	if err := sniProxy.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid sni proxy config: %w", err)
+	}
+
+	sniProxyAny, err := anypb.New(&sniProxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert sni proxy to any: %w", err)
+	}
+
+	return sniProxyAny, nil
+}
+
+func (b *Builder) buildTCPProxy(cluster string, logSinks ...*envoy_accesslog_v3.AccessLog) (*anypb.Any, error) {
+	tcpProxy := envoy_tcp_proxy_v3.TcpProxy{
+		StatPrefix: "tcp_ingress",
+		ClusterSpecifier: &envoy_tcp_proxy_v3.TcpProxy_Cluster{
+			Cluster: cluster,
+		},
+		AccessLog: logSinks,
+	}
+
+	if err := tcpProxy.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid tcp proxy config: %w", err)
+	}
+
+	tcpProxyAny, err := anypb.New(&tcpProxy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert tcp proxy to any: %w", err)
+	}
+
+	return tcpProxyAny, nil
+}
+
+func (b *Builder) buildCombinedAccessLog(t *tenant.Tenant) ([]*envoy_accesslog_v3.AccessLog, error) {
+	fileAccessLog, err := b.buildFileAccessLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build file access log: %w", err)
+	}
+
+	grpcAccessLog, err := b.buildGRPCAccessLog(t.Qualify(types.PassthroughLogName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build grpc access log: %w", err)
+	}
+
+	accessLogs := append(fileAccessLog, &envoy_accesslog_v3.AccessLog{
+		Name: "envoy.access_loggers.tcp_grpc",
+		ConfigType: &envoy_accesslog_v3.AccessLog_TypedConfig{
+			TypedConfig: grpcAccessLog,
+		},
+	})
+
+	return append(accessLogs, b.opts.TCPAccessLogs...), nil
+}
+
+func (b *Builder) buildGRPCAccessLog(logName string) (*anypb.Any, error) {
+	grpcAccessLog := envoy_grpc_access_log_v3.TcpGrpcAccessLogConfig{
+		CommonConfig: b.buildCommonGRPCAccessLogConfig(logName),
+	}
+
+	if err := grpcAccessLog.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid grpc access log config: %w", err)
+	}
+
+	grpcAccessLogAny, err := anypb.New(&grpcAccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert grpc access log to any: %w", err)
+	}
+
+	return grpcAccessLogAny, nil
+}
+
+func (b *Builder) buildHTTPGRPCAccessLog(logName string) (*anypb.Any, error) {
+	grpcAccessLog := envoy_grpc_access_log_v3.HttpGrpcAccessLogConfig{
+		CommonConfig: b.buildCommonGRPCAccessLogConfig(logName),
+	}
+
+	if err := grpcAccessLog.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http grpc access log config: %w", err)
+	}
+
+	grpcAccessLogAny, err := anypb.New(&grpcAccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http grpc access log to any: %w", err)
+	}
+
+	return grpcAccessLogAny, nil
+}
+
+func (b *Builder) buildCommonGRPCAccessLogConfig(logName string) *envoy_grpc_access_log_v3.CommonGrpcAccessLogConfig {
+	return &envoy_grpc_access_log_v3.CommonGrpcAccessLogConfig{
+		LogName:             logName,
+		TransportApiVersion: envoy_core_v3.ApiVersion_V3,
+		GrpcService: &envoy_core_v3.GrpcService{
+			TargetSpecifier: &envoy_core_v3.GrpcService_EnvoyGrpc_{
+				EnvoyGrpc: &envoy_core_v3.GrpcService_EnvoyGrpc{
+					ClusterName: b.opts.ALSClusterName,
+				},
+			},
+		},
+	}
+}
+
+// buildFileAccessLog returns the file access log, none when it is off.
+func (b *Builder) buildFileAccessLog() ([]*envoy_accesslog_v3.AccessLog, error) {
+	if b.opts.FileAccessLogPath == "" {
+		return nil, nil
+	}
+
+	fileAccessLog := envoy_file_access_log_v3.FileAccessLog{
+		Path: b.opts.FileAccessLogPath,
+	}
+
+	if err := fileAccessLog.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid file access log config: %w", err)
+	}
+
+	fileAccessLogAny, err := anypb.New(&fileAccessLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert file access log to any: %w", err)
+	}
+
+	return []*envoy_accesslog_v3.AccessLog{
+		{
+			Name: wellknown.FileAccessLog,
+			ConfigType: &envoy_accesslog_v3.AccessLog_TypedConfig{
+				TypedConfig: fileAccessLogAny,
+			},
+		},
+	}, nil
+}
+
+// buildDownstreamTLSContext serves every key pair of cert, Envoy picks the one the client supports.
+func buildDownstreamTLSContext(t *tenant.Tenant, cert *types.Certificate) (*anypb.Any, error) {
+	var sdsConfigs []*envoy_transport_sockets_tls_v3.SdsSecretConfig
+	for _, name := range SecretNames(t, cert) {
+		sdsConfigs = append(sdsConfigs, &envoy_transport_sockets_tls_v3.SdsSecretConfig{
+			Name: name,
+			SdsConfig: &envoy_core_v3.ConfigSource{
+				ResourceApiVersion: envoy_core_v3.ApiVersion_V3,
+				ConfigSourceSpecifier: &envoy_core_v3.ConfigSource_Ads{
+					Ads: &envoy_core_v3.AggregatedConfigSource{},
+				},
+			},
+		})
+	}
+
+	if len(sdsConfigs) == 0 {
+		return nil, fmt.Errorf("no key pair of %s can be served", cert.SNI)
+	}
+
+	cfg := &envoy_transport_sockets_tls_v3.DownstreamTlsContext{
+		CommonTlsContext: &envoy_transport_sockets_tls_v3.CommonTlsContext{
+			AlpnProtocols:                  []string{"h2,http/1.1"},
+			TlsCertificateSdsSecretConfigs: sdsConfigs,
+		},
+	}
+
+	if err := cfg.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid tls context config: %w", err)
+	}
+
+	cfgAny, err := anypb.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert tls context to any: %w", err)
+	}
+
+	return cfgAny, nil
+}
+
+// buildHCM routes exact certificates to their upstream cluster. Wildcard certificates cover
+// many hosts, each request is forwarded to its own host by the dynamic forward proxy filter instead,
+// or to the original destination in OriginalDst mode.
+func (b *Builder) buildHCM(t *tenant.Tenant, cert *types.Certificate) (*anypb.Any, error) {
+	domain := cert.SNI
+	domains := []string{domain}
+	cluster := b.ClusterName(t, cert)
+
+	var httpFilters []*envoy_http_connection_manager_v3.HttpFilter
+	switch {
+	case cert.Wildcard && b.opts.OriginalDst:
+		domains = cert.DNSNames
+		cluster = b.opts.OriginalDstTLSClusterName
+	case cert.Wildcard:
+		domains = cert.DNSNames
+		cluster = b.opts.DynamicForwardProxyTLSClusterName
+
+		dfp, err := buildHTTPDynamicForwardProxy()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build dynamic forward proxy filter: %w", err)
+		}
+
+		httpFilters = append(httpFilters, &envoy_http_connection_manager_v3.HttpFilter{
+			Name: "envoy.filters.http.dynamic_forward_proxy",
+			ConfigType: &envoy_http_connection_manager_v3.HttpFilter_TypedConfig{
+				TypedConfig: dfp,
+			},
+		})
+	}
+
+	httpRouter, err := buildHTTPRouter()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build http router: %w", err)
+	}
+
+	accessLogs, err := b.buildFileAccessLog()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build access log: %w", err)
+	}
+
+	grpcAccessLog, err := b.buildHTTPGRPCAccessLog(t.Qualify(types.InterceptLogName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build grpc access log: %w", err)
+	}
+
+	hcm := envoy_http_connection_manager_v3.HttpConnectionManager{
+		StatPrefix: domain,
+		CodecType:  envoy_http_connection_manager_v3.HttpConnectionManager_AUTO,
+		UpgradeConfigs: []*envoy_http_connection_manager_v3.HttpConnectionManager_UpgradeConfig{
+			{
+				Enabled:     wrapperspb.Bool(true),
+				UpgradeType: "websocket",
+			},
+		},
+		// Lets ALS demote hosts that keep failing once intercepted
+		AccessLog: append(append(accessLogs, &envoy_accesslog_v3.AccessLog{
+			Name: "envoy.access_loggers.http_grpc",
+			ConfigType: &envoy_accesslog_v3.AccessLog_TypedConfig{
+				TypedConfig: grpcAccessLog,
+			},
+		}), b.opts.HTTPAccessLogs...),
+		HttpFilters: append(httpFilters, &envoy_http_connection_manager_v3.HttpFilter{
+			Name: wellknown.Router,
+			ConfigType: &envoy_http_connection_manager_v3.HttpFilter_TypedConfig{
+				TypedConfig: httpRouter,
+			},
+		}),
+		RouteSpecifier: &envoy_http_connection_manager_v3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &envoy_route_v3.RouteConfiguration{
+				Name: domain,
+				VirtualHosts: []*envoy_route_v3.VirtualHost{
+					{
+						Name:    domain,
+						Domains: domains,
+						Routes: []*envoy_route_v3.Route{
+							{
+								Match: &envoy_route_v3.RouteMatch{
+									PathSpecifier: &envoy_route_v3.RouteMatch_Prefix{
+										Prefix: "/",
+									},
+								},
+								Action: &envoy_route_v3.Route_Route{
+									Route: &envoy_route_v3.RouteAction{
+										RetryPolicy: &envoy_route_v3.RetryPolicy{
+											RetryOn: "reset",
+										},
+										ClusterSpecifier: &envoy_route_v3.RouteAction_Cluster{
+											Cluster: cluster,
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for _, hook := range b.opts.HCMHooks {
+		if err := hook(t, cert, &hcm); err != nil {
+			return nil, fmt.Errorf("http connection manager hook failed: %w", err)
+		}
+	}
+
+	if err := hcm.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http connection manager config: %w", err)
+	}
+
+	hcmAny, err := anypb.New(&hcm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http connection manager to any: %w", err)
+	}
+
+	return hcmAny, nil
+}
+
+func buildHTTPDynamicForwardProxy() (*anypb.Any, error) {
+	dfp := envoy_http_dynamic_forward_proxy_v3.FilterConfig{
+		ImplementationSpecifier: &envoy_http_dynamic_forward_proxy_v3.FilterConfig_DnsCacheConfig{
+			DnsCacheConfig: defaultDNSCacheConfig(),
+		},
+	}
+
+	if err := dfp.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid dynamic forward proxy filter config: %w", err)
+	}
+
+	dfpAny, err := anypb.New(&dfp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert dynamic forward proxy filter to any: %w", err)
+	}
+
+	return dfpAny, nil
+}
+
+func buildHTTPRouter() (*anypb.Any, error) {
+	router := envoy_http_router_v3.Router{
+		StartChildSpan: true,
+	}
+
+	if err := router.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid http router config: %w", err)
+	}
+
+	routerAny, err := anypb.New(&router)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert http router to any: %w", err)
+	}
+
+	return routerAny, nil
+}
+
+func buildTLSInspector() (*anypb.Any, error) {
+	cfg := &envoy_extensions_filters_listener_tls_inspector_v3.TlsInspector{}
+
+	if err := cfg.ValidateAll(); err != nil {
+		return nil, fmt.Errorf("invalid tls inspector config: %w", err)
+	}
+
+	cfgAny, err := anypb.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert tls inspector to any: %w", err)
+	}
+
+	return cfgAny, nil
+}
@@ -0,0 +1,266 @@
+// Package builders builds the Envoy resources of the MITM proxy: the listener that intercepts the hosts it has
+// certificates for and passes everything else through, the upstream clusters and the secrets. Control planes
+// embedding it adjust the environment dependent parts with Options, the defaults match the docker compose setup.
+package builders
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	envoy_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	envoy_http_connection_manager_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoy_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// Builder builds resources according to its BuilderOptions. It is safe for concurrent use.
+type Builder struct {
+	opts BuilderOptions
+}
+
+// BuilderOptions are the parts of the config that depend on the environment Envoy runs in.
+type BuilderOptions struct {
+	// ListenerAddress is the address every tenant's listener binds to, on the tenant's port
+	ListenerAddress string
+	// ListenerName is the name of the default tenant's listener, other tenants qualify it
+	ListenerName string
+	// ConnectListenerName and ConnectLoopbackClusterName name the default tenant's explicit forward proxy
+	// listener and the cluster it tunnels TLS back into the tenant's listener with
+	ConnectListenerName        string
+	ConnectLoopbackClusterName string
+	// HTTPListenerName is the name of the default tenant's plaintext HTTP listener
+	HTTPListenerName string
+
+	// ALSClusterName, ALSHost and ALSPort is where Envoy sends access logs
+	ALSClusterName string
+	ALSHost        string
+	ALSPort        uint32
+	// FileAccessLogPath is the file every connection and request is logged to, off when empty
+	FileAccessLogPath string
+	// TCPAccessLogs are added to the access logs of passthrough connections
+	TCPAccessLogs []*envoy_accesslog_v3.AccessLog
+	// HTTPAccessLogs are added to the access logs of intercepted requests, CONNECT tunnels and plaintext requests
+	HTTPAccessLogs []*envoy_accesslog_v3.AccessLog
+
+	// DynamicForwardProxyClusterName and DynamicForwardProxyTLSClusterName are the clusters passthrough
+	// connections and requests to wildcard hosts go through
+	DynamicForwardProxyClusterName    string
+	DynamicForwardProxyTLSClusterName string
+	// UpstreamClusterName names the upstream cluster of an exact certificate
+	UpstreamClusterName func(t *tenant.Tenant, cert *types.Certificate) string
+
+	// UpstreamPort is the port intercepted and passed through hosts are reached on
+	UpstreamPort uint32
+	// OriginalDst sends connections redirected to the listeners to their original destination, keeping the port,
+	// instead of resolving the server name on UpstreamPort. TLS without a server name goes there too.
+	OriginalDst bool
+	// Transparent lets the listeners accept connections to foreign addresses, for TPROXY
+	Transparent bool
+	// OriginalDstClusterName and OriginalDstTLSClusterName replace the dynamic forward proxy clusters of the
+	// listener in OriginalDst mode
+	OriginalDstClusterName    string
+	OriginalDstTLSClusterName string
+	// TrustBundle is the CA bundle upstream certificates are verified with
+	TrustBundle string
+	// KeyLogDir is where the TLS keys of upstream connections are logged, key logging is off when empty
+	KeyLogDir string
+	// UpstreamTLSParams restricts the TLS versions and ciphers of upstream connections, Envoy's defaults when nil
+	UpstreamTLSParams *envoy_tls_v3.TlsParameters
+	// UpstreamKeepalive is the HTTP/2 keepalive of upstream clusters
+	UpstreamKeepalive Keepalive
+
+	// HCMHooks adjust the HTTP connection manager of every intercepted host, in order
+	HCMHooks []HCMHook
+}
+
+// Keepalive configures HTTP/2 PINGs on connections.
+type Keepalive struct {
+	Interval     time.Duration
+	Timeout      time.Duration
+	IdleInterval time.Duration
+}
+
+// HCMHook adjusts the HTTP connection manager of the filter chain of cert before it is validated.
+type HCMHook func(t *tenant.Tenant, cert *types.Certificate, hcm *envoy_http_connection_manager_v3.HttpConnectionManager) error
+
+// Option sets BuilderOptions.
+type Option func(*BuilderOptions)
+
+// DefaultOptions returns the options of the docker compose setup.
+func DefaultOptions() BuilderOptions {
+	return BuilderOptions{
+		ListenerAddress:                   "0.0.0.0",
+		ListenerName:                      "listener_0",
+		ConnectListenerName:               "listener_connect",
+		ConnectLoopbackClusterName:        "connect_loopback",
+		HTTPListenerName:                  "listener_http",
+		ALSClusterName:                    "envoy_access_log_service",
+		ALSHost:                           "als_service",
+		ALSPort:                           50051,
+		FileAccessLogPath:                 "/dev/stdout",
+		DynamicForwardProxyClusterName:    "dynamic_forward_proxy_cluster",
+		DynamicForwardProxyTLSClusterName: "dynamic_forward_proxy_tls_cluster",
+		UpstreamClusterName: func(t *tenant.Tenant, cert *types.Certificate) string {
+			return t.Qualify(cert.SNI)
+		},
+		UpstreamPort:              443,
+		OriginalDstClusterName:    "original_dst_cluster",
+		OriginalDstTLSClusterName: "original_dst_tls_cluster",
+		TrustBundle:               "/etc/ssl/certs/ca-certificates.crt",
+		KeyLogDir:                 "/tmp",
+		UpstreamKeepalive:         Keepalive{Interval: 30 * time.Second, Timeout: 5 * time.Second, IdleInterval: 15 * time.Second},
+	}
+}
+
+// New returns a Builder with DefaultOptions adjusted by opts.
+func New(opts ...Option) *Builder {
+	b := &Builder{opts: DefaultOptions()}
+	for _, opt := range opts {
+		opt(&b.opts)
+	}
+
+	return b
+}
+
+// Options returns the options b builds with.
+func (b *Builder) Options() BuilderOptions {
+	return b.opts
+}
+
+// WithListenerAddress binds listeners to address instead of 0.0.0.0.
+func WithListenerAddress(address string) Option {
+	return func(o *BuilderOptions) {
+		o.ListenerAddress = address
+	}
+}
+
+// WithListenerName names the default tenant's listener.
+func WithListenerName(name string) Option {
+	return func(o *BuilderOptions) {
+		o.ListenerName = name
+	}
+}
+
+// WithConnectNames names the default tenant's explicit forward proxy listener and its loopback cluster.
+func WithConnectNames(listener, loopbackCluster string) Option {
+	return func(o *BuilderOptions) {
+		o.ConnectListenerName = listener
+		o.ConnectLoopbackClusterName = loopbackCluster
+	}
+}
+
+// WithHTTPListenerName names the default tenant's plaintext HTTP listener.
+func WithHTTPListenerName(name string) Option {
+	return func(o *BuilderOptions) {
+		o.HTTPListenerName = name
+	}
+}
+
+// WithALS sends access logs to the access log service at host and port.
+func WithALS(host string, port uint32) Option {
+	return func(o *BuilderOptions) {
+		o.ALSHost = host
+		o.ALSPort = port
+	}
+}
+
+// WithClusterNames names the access log service and dynamic forward proxy clusters.
+func WithClusterNames(als, dynamicForwardProxy, dynamicForwardProxyTLS string) Option {
+	return func(o *BuilderOptions) {
+		o.ALSClusterName = als
+		o.DynamicForwardProxyClusterName = dynamicForwardProxy
+		o.DynamicForwardProxyTLSClusterName = dynamicForwardProxyTLS
+	}
+}
+
+// WithUpstreamClusterName names the upstream clusters of exact certificates, names must be unique per tenant and host.
+func WithUpstreamClusterName(name func(t *tenant.Tenant, cert *types.Certificate) string) Option {
+	return func(o *BuilderOptions) {
+		o.UpstreamClusterName = name
+	}
+}
+
+// WithFileAccessLog logs to path instead of /dev/stdout, an empty path turns the file access log off.
+func WithFileAccessLog(path string) Option {
+	return func(o *BuilderOptions) {
+		o.FileAccessLogPath = path
+	}
+}
+
+// WithTCPAccessLogs adds sinks to the access logs of passthrough connections.
+func WithTCPAccessLogs(sinks ...*envoy_accesslog_v3.AccessLog) Option {
+	return func(o *BuilderOptions) {
+		o.TCPAccessLogs = append(o.TCPAccessLogs, sinks...)
+	}
+}
+
+// WithHTTPAccessLogs adds sinks to the access logs of intercepted requests, CONNECT tunnels and plaintext requests.
+func WithHTTPAccessLogs(sinks ...*envoy_accesslog_v3.AccessLog) Option {
+	return func(o *BuilderOptions) {
+		o.HTTPAccessLogs = append(o.HTTPAccessLogs, sinks...)
+	}
+}
+
+// WithUpstreamPort reaches upstreams on port instead of 443.
+func WithUpstreamPort(port uint32) Option {
+	return func(o *BuilderOptions) {
+		o.UpstreamPort = port
+	}
+}
+
+// WithOriginalDst turns on transparent mode: upstreams are reached on the original destination of redirected
+// connections. transparent binds the listeners for TPROXY instead of REDIRECT.
+func WithOriginalDst(transparent bool) Option {
+	return func(o *BuilderOptions) {
+		o.OriginalDst = true
+		o.Transparent = transparent
+	}
+}
+
+// WithTrustBundle verifies upstream certificates with the CA bundle at path.
+func WithTrustBundle(path string) Option {
+	return func(o *BuilderOptions) {
+		o.TrustBundle = path
+	}
+}
+
+// WithKeyLogDir logs the TLS keys of upstream connections to dir, an empty dir turns key logging off.
+func WithKeyLogDir(dir string) Option {
+	return func(o *BuilderOptions) {
+		o.KeyLogDir = dir
+	}
+}
+
+// WithUpstreamTLSParams restricts the TLS versions and ciphers of upstream connections.
+func WithUpstreamTLSParams(params *envoy_tls_v3.TlsParameters) Option {
+	return func(o *BuilderOptions) {
+		o.UpstreamTLSParams = params
+	}
+}
+
+// WithUpstreamKeepalive sets the HTTP/2 keepalive of upstream clusters.
+func WithUpstreamKeepalive(keepalive Keepalive) Option {
+	return func(o *BuilderOptions) {
+		o.UpstreamKeepalive = keepalive
+	}
+}
+
+// WithHCMHook adds a hook adjusting the HTTP connection manager of every intercepted host.
+func WithHCMHook(hook HCMHook) Option {
+	return func(o *BuilderOptions) {
+		o.HCMHooks = append(o.HCMHooks, hook)
+	}
+}
+
+// keyLogPath is where the TLS keys of the upstream connections of cert are logged. Envoy doesn't create
+// directories, tenants share KeyLogDir.
+func (b *Builder) keyLogPath(t *tenant.Tenant, cert *types.Certificate) string {
+	if t.IsDefault() {
+		return filepath.Join(b.opts.KeyLogDir, fmt.Sprintf("%s.tls.log", cert.SNI))
+	}
+
+	return filepath.Join(b.opts.KeyLogDir, fmt.Sprintf("%s.%s.tls.log", t.Name, cert.SNI))
+}
@@ -0,0 +1,105 @@
+package builders
+
+import (
+	"fmt"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// BuildSecret builds the secret of the first key pair of cert Envoy can serve.
+func BuildSecret(t *tenant.Tenant, cert *types.Certificate) (*envoy_extensions_transport_sockets_tls_v3.Secret, error) {
+	pairs := servedKeyPairs(t, cert)
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no key pair of %s can be served", cert.SNI)
+	}
+
+	return buildSecret(pairs[0].name, pairs[0].cert, pairs[0].key)
+}
+
+// BuildSecrets builds a secret for the certificate and one for each of its alternates, named like SecretNames.
+// Key pairs Envoy can't serve are left out.
+func BuildSecrets(t *tenant.Tenant, cert *types.Certificate) ([]*envoy_extensions_transport_sockets_tls_v3.Secret, error) {
+	pairs := servedKeyPairs(t, cert)
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("no key pair of %s can be served", cert.SNI)
+	}
+
+	secrets := make([]*envoy_extensions_transport_sockets_tls_v3.Secret, 0, len(pairs))
+	for _, pair := range pairs {
+		secret, err := buildSecret(pair.name, pair.cert, pair.key)
+		if err != nil {
+			return nil, err
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	return secrets, nil
+}
+
+// SecretNames returns the name of the secret of every key pair of cert Envoy can serve, alternates are suffixed
+// with their key family. It is empty when Envoy can't serve cert at all.
+func SecretNames(t *tenant.Tenant, cert *types.Certificate) []string {
+	pairs := servedKeyPairs(t, cert)
+
+	names := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		names = append(names, pair.name)
+	}
+
+	return names
+}
+
+type keyPair struct {
+	name      string
+	cert, key []byte
+}
+
+// servedKeyPairs returns the key pairs of cert minus the Ed25519 ones, Envoy can't load those.
+func servedKeyPairs(t *tenant.Tenant, cert *types.Certificate) []keyPair {
+	name := t.Qualify(cert.SNI)
+
+	var pairs []keyPair
+	// A primary certificate that doesn't parse is left for Envoy to judge
+	if leaf, err := cert.Leaf(); err != nil || types.KeyAlgorithmOf(leaf.PublicKey).Servable() {
+		pairs = append(pairs, keyPair{name: name, cert: cert.Cert, key: cert.Key})
+	}
+
+	for _, alternate := range cert.Alternates {
+		if alternate.Algorithm.Servable() {
+			pairs = append(pairs, keyPair{name: name + "/" + alternate.Algorithm.Family(), cert: alternate.Cert, key: alternate.Key})
+		}
+	}
+
+	return pairs
+}
+
+func buildSecret(name string, certPEM, keyPEM []byte) (*envoy_extensions_transport_sockets_tls_v3.Secret, error) {
+	c := &envoy_extensions_transport_sockets_tls_v3.Secret{
+		Name: name,
+		Type: &envoy_extensions_transport_sockets_tls_v3.Secret_TlsCertificate{
+			TlsCertificate: &envoy_extensions_transport_sockets_tls_v3.TlsCertificate{
+				CertificateChain: &envoy_core_v3.DataSource{
+					Specifier: &envoy_core_v3.DataSource_InlineBytes{
+						InlineBytes: certPEM,
+					},
+				},
+				PrivateKey: &envoy_core_v3.DataSource{
+					Specifier: &envoy_core_v3.DataSource_InlineBytes{
+						InlineBytes: keyPEM,
+					},
+				},
+			},
+		},
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
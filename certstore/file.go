@@ -0,0 +1,345 @@
+package certstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/types"
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var _ Store = &FileStore{}
+
+// tempSuffix marks the files Put writes before renaming them into place
+const tempSuffix = ".tmp"
+
+// NewFileStore returns a Store that keeps every certificate as <sni>.json in path.
+func NewFileStore(path string, resyncInterval time.Duration) *FileStore {
+	store := &FileStore{
+		watchPath:      path,
+		resyncInterval: resyncInterval,
+	}
+
+	return store
+}
+
+type FileStore struct {
+	rw sync.RWMutex
+
+	watchPath      string
+	resyncInterval time.Duration
+
+	watcher  *fsnotify.Watcher
+	updateCh chan struct{}
+
+	certificates map[string]*types.Certificate
+
+	// sealer encrypts keys on disk, nil stores them in plaintext
+	sealer *Sealer
+}
+
+// SetSealer encrypts the keys of every certificate written from now on. Plaintext keys are still read.
+func (c *FileStore) SetSealer(sealer *Sealer) {
+	c.sealer = sealer
+}
+
+func (c *FileStore) Put(_ context.Context, cert *types.Certificate) error {
+	if err := validate(cert); err != nil {
+		return err
+	}
+
+	if c.sealer != nil {
+		sealed, err := c.sealer.seal(cert)
+		if err != nil {
+			return err
+		}
+		cert = sealed
+	}
+
+	raw, err := json.Marshal(cert)
+	if err != nil {
+		return fmt.Errorf("error marshalling json: %w", err)
+	}
+
+	// Write next to the certificate and rename over it, so that readers never see a partial file.
+	// CreateTemp makes the file private, a file written before keys were kept private is replaced.
+	f, err := os.CreateTemp(c.watchPath, "."+cert.SNI+".*"+tempSuffix)
+	if err != nil {
+		return fmt.Errorf("error writing json to file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing json to file: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing json to file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing json to file: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), c.pathFor(cert.SNI)); err != nil {
+		return fmt.Errorf("error writing json to file: %w", err)
+	}
+
+	return nil
+}
+
+func (c *FileStore) Get(_ context.Context, sni string) (*types.Certificate, error) {
+	if !hostname.IsCanonical(sni) {
+		return nil, fmt.Errorf("invalid SNI %q", sni)
+	}
+
+	cert, err := c.readCerficateFromDisk(c.pathFor(sni))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return cert, err
+}
+
+// List returns the certificates known to the watcher, or reads them from disk when nothing is watching.
+func (c *FileStore) List(_ context.Context) ([]*types.Certificate, error) {
+	c.rw.RLock()
+	watching := c.watcher != nil
+	c.rw.RUnlock()
+
+	if !watching {
+		if _, err := c.Resync(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+
+	var certs []*types.Certificate
+	for _, cert := range c.certificates {
+		certs = append(certs, cert)
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].SNI < certs[j].SNI
+	})
+
+	return certs, nil
+}
+
+func (c *FileStore) Delete(_ context.Context, sni string) error {
+	if !hostname.IsCanonical(sni) {
+		return fmt.Errorf("invalid SNI %q", sni)
+	}
+
+	err := os.Remove(c.pathFor(sni))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// Resync rebuilds the in-memory certificates from every file in the watch path.
+// It reports whether the set of certificates changed.
+func (c *FileStore) Resync() (bool, error) {
+	paths, err := filepath.Glob(filepath.Join(c.watchPath, "*.json"))
+	if err != nil {
+		return false, err
+	}
+
+	certificates := make(map[string]*types.Certificate, len(paths))
+	for _, path := range paths {
+		cert, err := c.readCerficateFromDisk(path)
+		if err != nil {
+			log.Println("[resync] skipping certificate:", err, path)
+			continue
+		}
+
+		certificates[path] = cert
+	}
+
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	changed := !reflect.DeepEqual(c.certificates, certificates)
+	c.certificates = certificates
+
+	return changed, nil
+}
+
+// Watch loads every certificate on disk, then watches the watch path for changes and performs a full
+// Resync every resyncInterval. A value is sent on the returned channel whenever the certificates change.
+func (c *FileStore) Watch(ctx context.Context) (<-chan struct{}, error) {
+	if _, err := c.Resync(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := watcher.Add(c.watchPath); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	c.rw.Lock()
+	c.watcher = watcher
+	c.rw.Unlock()
+
+	ch := make(chan struct{}, 1)
+	c.updateCh = ch
+
+	ticker := time.NewTicker(c.resyncInterval)
+
+	go func() {
+		defer close(c.updateCh)
+		defer ticker.Stop()
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// Put renames its temporary files into place, only the result matters
+				if filepath.Ext(event.Name) != ".json" {
+					continue
+				}
+
+				switch event.Op {
+				case fsnotify.Create, fsnotify.Write:
+					err := wait.ExponentialBackoff(wait.Backoff{
+						Duration: 100 * time.Millisecond,
+						Factor:   1.5,
+						Steps:    5,
+					}, func() (bool, error) {
+						cert, err := c.readCerficateFromDisk(event.Name)
+						if err != nil {
+							return false, nil
+						}
+
+						c.updateCertificate(event.Name, cert)
+						c.notify()
+						return true, nil
+					})
+
+					if err != nil {
+						log.Println("[backoff] error reading certificate from disk:", err, event.Name)
+					}
+				case fsnotify.Remove, fsnotify.Rename:
+					c.deleteCertificate(event.Name)
+					c.notify()
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("error watching config file:", err)
+
+			case <-ticker.C:
+				changed, err := c.Resync()
+				if err != nil {
+					log.Println("[resync] error reading certificates from disk:", err)
+					continue
+				}
+
+				if changed {
+					c.notify()
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (c *FileStore) Close() error {
+	c.rw.Lock()
+	watcher := c.watcher
+	c.watcher = nil
+	c.rw.Unlock()
+
+	if watcher != nil {
+		return watcher.Close()
+	}
+	return nil
+}
+
+func (c *FileStore) pathFor(sni string) string {
+	return filepath.Join(c.watchPath, sni+".json")
+}
+
+func (c *FileStore) deleteCertificate(path string) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	delete(c.certificates, path)
+}
+
+func (c *FileStore) readCerficateFromDisk(path string) (*types.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &types.Certificate{}
+
+	if err := json.Unmarshal(data, cert); err != nil {
+		return nil, err
+	}
+
+	if err := c.sealer.open(cert); err != nil {
+		return nil, err
+	}
+
+	if err := validate(cert); err != nil {
+		return nil, err
+	}
+
+	if filepath.Base(path) != cert.SNI+".json" {
+		return nil, fmt.Errorf("SNI %q does not match file name", cert.SNI)
+	}
+
+	return cert, nil
+}
+
+func (c *FileStore) updateCertificate(path string, cert *types.Certificate) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	if c.certificates == nil {
+		c.certificates = make(map[string]*types.Certificate)
+	}
+
+	c.certificates[path] = cert
+}
+
+// notify signals a pending update without blocking, one queued update is enough to trigger a reconcile.
+func (c *FileStore) notify() {
+	select {
+	case c.updateCh <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,125 @@
+package certstore_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestResync(t *testing.T) {
+	dir := t.TempDir()
+
+	writeCertificate(t, dir, newCertificate(t, "example.com"))
+	writeCertificate(t, dir, newCertificate(t, "example2.com"))
+
+	// Unreadable certificates are skipped
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeCertificate(t, dir, &types.Certificate{SNI: "bad.example.com", Cert: []byte("cert"), Key: []byte("key")})
+
+	store := certstore.NewFileStore(dir, time.Minute)
+
+	changed, err := store.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected first resync to report a change")
+	}
+
+	certs, err := store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || certs[0].SNI != "example.com" || certs[1].SNI != "example2.com" {
+		t.Fatalf("unexpected certificates: %v", certs)
+	}
+
+	changed, err = store.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Fatal("expected resync without changes on disk to report no change")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "example2.com.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err = store.Resync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected resync to report a removed certificate")
+	}
+
+	certs, err = store.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].SNI != "example.com" {
+		t.Fatalf("unexpected certificates: %v", certs)
+	}
+}
+
+func writeCertificate(t *testing.T, dir string, cert *types.Certificate) {
+	t.Helper()
+
+	raw, err := json.Marshal(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, cert.SNI+".json"), raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newCertificate(t *testing.T, sni string) *types.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: sni},
+		DNSNames:     []string{sni},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &types.Certificate{
+		SNI:  sni,
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
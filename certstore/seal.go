@@ -0,0 +1,245 @@
+package certstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+const (
+	// KEKEnv holds the base64 encoded key-encryption key when no KEK file is given
+	KEKEnv = "CERTSTORE_KEK"
+
+	kekSize = 32
+
+	sealedKeyBlockType = "ENVELOPE ENCRYPTED PRIVATE KEY"
+	kekIDHeader        = "Kek-Id"
+	wrappedKeyHeader   = "Wrapped-Key"
+)
+
+// ErrSealed is returned when a stored key is encrypted but the store has no Sealer to decrypt it with.
+var ErrSealed = errors.New("private key is encrypted but no key-encryption key is configured")
+
+// Sealer envelope encrypts private keys before they are stored: every key is encrypted with its own
+// AES-256-GCM data key, which is in turn encrypted with the key-encryption key (KEK).
+// The SNI is authenticated along with the key so that sealed keys can't be swapped between hosts.
+type Sealer struct {
+	kek cipher.AEAD
+	// id identifies the KEK a key was sealed with, so that a wrong KEK is reported as such
+	id string
+}
+
+// NewSealer returns a Sealer for a 32 byte KEK.
+func NewSealer(kek []byte) (*Sealer, error) {
+	if len(kek) != kekSize {
+		return nil, fmt.Errorf("key-encryption key must be %d bytes, got %d", kekSize, len(kek))
+	}
+
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(kek)
+
+	return &Sealer{
+		kek: aead,
+		id:  hex.EncodeToString(sum[:4]),
+	}, nil
+}
+
+// LoadSealer reads the base64 encoded KEK from kekFile, or from $CERTSTORE_KEK when kekFile is empty.
+// It returns nil if neither is set, keys are stored in plaintext then.
+func LoadSealer(kekFile string) (*Sealer, error) {
+	encoded := os.Getenv(KEKEnv)
+
+	if kekFile != "" {
+		info, err := os.Stat(kekFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key-encryption key: %w", err)
+		}
+
+		if info.Mode().Perm()&0077 != 0 {
+			log.Printf("Key-encryption key %s is accessible by other users (mode %s)", kekFile, info.Mode().Perm())
+		}
+
+		data, err := os.ReadFile(kekFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key-encryption key: %w", err)
+		}
+		encoded = string(data)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	kek, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding key-encryption key: %w", err)
+	}
+
+	return NewSealer(kek)
+}
+
+// IsSealed reports whether key was encrypted by a Sealer.
+func IsSealed(key []byte) bool {
+	block, _ := pem.Decode(key)
+	return block != nil && block.Type == sealedKeyBlockType
+}
+
+// seal returns a copy of cert with every private key encrypted. Keys that already are stay as they are.
+func (s *Sealer) seal(cert *types.Certificate) (*types.Certificate, error) {
+	out := *cert
+
+	key, err := s.sealKey(cert.SNI, cert.Key)
+	if err != nil {
+		return nil, err
+	}
+	out.Key = key
+
+	out.Alternates = make([]*types.KeyPair, 0, len(cert.Alternates))
+	for _, alternate := range cert.Alternates {
+		key, err := s.sealKey(cert.SNI, alternate.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed := *alternate
+		sealed.Key = key
+		out.Alternates = append(out.Alternates, &sealed)
+	}
+
+	if len(out.Alternates) == 0 {
+		out.Alternates = nil
+	}
+
+	return &out, nil
+}
+
+// open decrypts every private key of cert in place, plaintext keys are left alone.
+// A nil Sealer can only open certificates with plaintext keys.
+func (s *Sealer) open(cert *types.Certificate) error {
+	key, err := s.openKey(cert.SNI, cert.Key)
+	if err != nil {
+		return fmt.Errorf("error decrypting key of %s: %w", cert.SNI, err)
+	}
+	cert.Key = key
+
+	for _, alternate := range cert.Alternates {
+		key, err := s.openKey(cert.SNI, alternate.Key)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s key of %s: %w", alternate.Algorithm, cert.SNI, err)
+		}
+		alternate.Key = key
+	}
+
+	return nil
+}
+
+func (s *Sealer) sealKey(sni string, key []byte) ([]byte, error) {
+	if IsSealed(key) {
+		return key, nil
+	}
+
+	dek := make([]byte, kekSize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, fmt.Errorf("error generating data key: %w", err)
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := encrypt(aead, key, []byte(sni))
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := encrypt(s.kek, dek, []byte(sni))
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type: sealedKeyBlockType,
+		Headers: map[string]string{
+			kekIDHeader:      s.id,
+			wrappedKeyHeader: base64.StdEncoding.EncodeToString(wrapped),
+		},
+		Bytes: ciphertext,
+	}), nil
+}
+
+func (s *Sealer) openKey(sni string, key []byte) ([]byte, error) {
+	block, _ := pem.Decode(key)
+	if block == nil || block.Type != sealedKeyBlockType {
+		return key, nil
+	}
+
+	if s == nil {
+		return nil, ErrSealed
+	}
+
+	if id := block.Headers[kekIDHeader]; id != s.id {
+		return nil, fmt.Errorf("sealed with key-encryption key %q, configured is %q", id, s.id)
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(block.Headers[wrappedKeyHeader])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+
+	dek, err := decrypt(s.kek, wrapped, []byte(sni))
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(aead, block.Bytes, []byte(sni))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns the nonce followed by the ciphertext.
+func encrypt(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
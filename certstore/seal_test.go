@@ -0,0 +1,177 @@
+package certstore_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestSealedStores(t *testing.T) {
+	backends := map[string]func(t *testing.T, path string, sealer *certstore.Sealer) certstore.Store{
+		"file": func(t *testing.T, path string, sealer *certstore.Sealer) certstore.Store {
+			store := certstore.NewFileStore(path, time.Minute)
+			store.SetSealer(sealer)
+			return store
+		},
+		"sqlite": func(t *testing.T, path string, sealer *certstore.Sealer) certstore.Store {
+			store, err := certstore.NewSQLiteStore(filepath.Join(path, "certs.db"), 10*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.SetSealer(sealer)
+			return store
+		},
+	}
+
+	for name, newStore := range backends {
+		newStore := newStore
+
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			sealer := newSealer(t)
+
+			// Written before encryption was turned on
+			plaintext := newStore(t, dir, nil)
+			defer plaintext.Close()
+
+			legacy := newCertificate(t, "legacy.example.com")
+			if err := plaintext.Put(ctx, legacy); err != nil {
+				t.Fatal(err)
+			}
+
+			sealed := newStore(t, dir, sealer)
+			defer sealed.Close()
+
+			cert := newCertificate(t, "example.com")
+			alternate := newCertificate(t, "example.com")
+			cert.Alternates = []*types.KeyPair{{Algorithm: types.ECDSAP256, Cert: alternate.Cert, Key: alternate.Key}}
+			if err := sealed.Put(ctx, cert); err != nil {
+				t.Fatal(err)
+			}
+
+			if certstore.IsSealed(cert.Key) {
+				t.Fatal("Put encrypted the caller's certificate")
+			}
+
+			got, err := sealed.Get(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Key, cert.Key) || !bytes.Equal(got.Alternates[0].Key, alternate.Key) {
+				t.Fatal("keys do not round trip")
+			}
+
+			if got, err := sealed.Get(ctx, "legacy.example.com"); err != nil || !bytes.Equal(got.Key, legacy.Key) {
+				t.Fatalf("plaintext key is not readable: %v", err)
+			}
+
+			if _, err := plaintext.Get(ctx, "example.com"); !errors.Is(err, certstore.ErrSealed) {
+				t.Fatalf("expected ErrSealed, got %v", err)
+			}
+
+			other := newStore(t, dir, newSealer(t))
+			defer other.Close()
+			if _, err := other.Get(ctx, "example.com"); err == nil {
+				t.Fatal("expected a different key-encryption key to fail")
+			}
+
+			waitForCertificates(t, sealed, "example.com", "legacy.example.com")
+			// Stores without the key skip what they can't decrypt
+			waitForCertificates(t, plaintext, "legacy.example.com")
+		})
+	}
+}
+
+func TestFileStoreSealsOnDisk(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// A certificate written before keys were private
+	cert := newCertificate(t, "example.com")
+	writeCertificate(t, dir, cert)
+
+	store := certstore.NewFileStore(dir, time.Minute)
+	store.SetSealer(newSealer(t))
+
+	existing, err := store.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put(ctx, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "example.com.json")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("unexpected mode %s", mode)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is base64 encoded in the JSON
+	if bytes.Contains(data, []byte(base64.StdEncoding.EncodeToString(cert.Key)[:64])) {
+		t.Fatal("plaintext key written to disk")
+	}
+}
+
+func TestLoadSealer(t *testing.T) {
+	t.Setenv(certstore.KEKEnv, "")
+
+	if sealer, err := certstore.LoadSealer(""); err != nil || sealer != nil {
+		t.Fatalf("expected no sealer, got %v, %v", sealer, err)
+	}
+
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(certstore.KEKEnv, base64.StdEncoding.EncodeToString(kek))
+	if sealer, err := certstore.LoadSealer(""); err != nil || sealer == nil {
+		t.Fatalf("expected a sealer from the environment, got %v, %v", sealer, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "kek")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(kek[:16])+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file wins over the environment
+	if _, err := certstore.LoadSealer(path); err == nil {
+		t.Fatal("expected a short key-encryption key to be rejected")
+	}
+}
+
+func newSealer(t *testing.T) *certstore.Sealer {
+	t.Helper()
+
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+
+	sealer, err := certstore.NewSealer(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sealer
+}
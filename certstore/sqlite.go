@@ -0,0 +1,395 @@
+package certstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// Timestamps are stored in the format SQLite's date and time functions use, so that
+// queries like `WHERE not_after < datetime('now')` work as expected.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// migrations are applied in order, PRAGMA user_version records how many have run.
+var migrations = []string{
+	`CREATE TABLE certificates (
+		sni        TEXT PRIMARY KEY,
+		cert       BLOB NOT NULL,
+		key        BLOB NOT NULL,
+		serial     TEXT,
+		issuer     TEXT,
+		not_before TEXT,
+		not_after  TEXT,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);
+
+	CREATE TABLE generation (
+		id    INTEGER PRIMARY KEY CHECK (id = 0),
+		value INTEGER NOT NULL
+	);
+	INSERT INTO generation (id, value) VALUES (0, 0);
+
+	CREATE TRIGGER certificates_insert AFTER INSERT ON certificates BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER certificates_update AFTER UPDATE ON certificates BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER certificates_delete AFTER DELETE ON certificates BEGIN UPDATE generation SET value = value + 1; END;`,
+
+	`ALTER TABLE certificates ADD COLUMN demoted_until TEXT;`,
+	`ALTER TABLE certificates ADD COLUMN wildcard INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE certificates ADD COLUMN dns_names TEXT;`,
+	// JSON encoded []*types.KeyPair
+	`ALTER TABLE certificates ADD COLUMN alternates BLOB;`,
+	// Name of the signer.Issuer, issuer holds the distinguished name of the leaf's issuer
+	`ALTER TABLE certificates ADD COLUMN issuer_name TEXT;`,
+	// The same SNI can be stored once per namespace, SQLite can't change a primary key in place
+	`CREATE TABLE certificates_namespaced (
+		namespace     TEXT NOT NULL DEFAULT '',
+		sni           TEXT NOT NULL,
+		cert          BLOB NOT NULL,
+		key           BLOB NOT NULL,
+		serial        TEXT,
+		issuer        TEXT,
+		not_before    TEXT,
+		not_after     TEXT,
+		created_at    TEXT NOT NULL,
+		updated_at    TEXT NOT NULL,
+		demoted_until TEXT,
+		wildcard      INTEGER NOT NULL DEFAULT 0,
+		dns_names     TEXT,
+		alternates    BLOB,
+		issuer_name   TEXT,
+		PRIMARY KEY (namespace, sni)
+	);
+
+	INSERT INTO certificates_namespaced (sni, cert, key, serial, issuer, not_before, not_after, created_at, updated_at, demoted_until, wildcard, dns_names, alternates, issuer_name)
+	SELECT sni, cert, key, serial, issuer, not_before, not_after, created_at, updated_at, demoted_until, wildcard, dns_names, alternates, issuer_name FROM certificates;
+
+	DROP TABLE certificates;
+	ALTER TABLE certificates_namespaced RENAME TO certificates;
+
+	CREATE TRIGGER certificates_insert AFTER INSERT ON certificates BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER certificates_update AFTER UPDATE ON certificates BEGIN UPDATE generation SET value = value + 1; END;
+	CREATE TRIGGER certificates_delete AFTER DELETE ON certificates BEGIN UPDATE generation SET value = value + 1; END;`,
+}
+
+var _ Store = &SQLiteStore{}
+
+// SQLiteStore keeps certificates and their metadata in a SQLite database.
+// Every write bumps a generation counter, which is how Watch notices changes made by other processes.
+// The counter is shared by every namespace, a write to one wakes up the watchers of all of them.
+type SQLiteStore struct {
+	db *sql.DB
+
+	// namespace the store reads and writes, see OpenNamespace
+	namespace string
+
+	pollInterval time.Duration
+
+	// sealer encrypts keys in the database, nil stores them in plaintext
+	sealer *Sealer
+}
+
+// SetSealer encrypts the keys of every certificate written from now on. Plaintext keys are still read.
+func (s *SQLiteStore) SetSealer(sealer *Sealer) {
+	s.sealer = sealer
+}
+
+// NewSQLiteStore opens or creates the database at path and brings its schema up to date.
+func NewSQLiteStore(path string, pollInterval time.Duration) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+
+	// The database holds private keys, SQLite creates its journal files with the same mode
+	if err := os.Chmod(path, 0600); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error restricting database permissions: %w", err)
+	}
+
+	return &SQLiteStore{
+		db:           db,
+		pollInterval: pollInterval,
+	}, nil
+}
+
+func (s *SQLiteStore) Put(ctx context.Context, cert *types.Certificate) error {
+	if err := validate(cert); err != nil {
+		return err
+	}
+
+	if s.sealer != nil {
+		sealed, err := s.sealer.seal(cert)
+		if err != nil {
+			return err
+		}
+		cert = sealed
+	}
+
+	var serial, issuer, notBefore, notAfter sql.NullString
+	if leaf, err := cert.Leaf(); err == nil {
+		serial = sql.NullString{String: leaf.SerialNumber.Text(16), Valid: true}
+		issuer = sql.NullString{String: leaf.Issuer.String(), Valid: true}
+		notBefore = sql.NullString{String: leaf.NotBefore.UTC().Format(sqliteTimeFormat), Valid: true}
+		notAfter = sql.NullString{String: leaf.NotAfter.UTC().Format(sqliteTimeFormat), Valid: true}
+	}
+
+	var demotedUntil sql.NullString
+	if cert.DemotedUntil != nil {
+		demotedUntil = sql.NullString{String: cert.DemotedUntil.UTC().Format(sqliteTimeFormat), Valid: true}
+	}
+
+	var dnsNames sql.NullString
+	if len(cert.DNSNames) > 0 {
+		dnsNames = sql.NullString{String: strings.Join(cert.DNSNames, ","), Valid: true}
+	}
+
+	var issuerName sql.NullString
+	if cert.Issuer != "" {
+		issuerName = sql.NullString{String: cert.Issuer, Valid: true}
+	}
+
+	var alternates []byte
+	if len(cert.Alternates) > 0 {
+		var err error
+		alternates, err = json.Marshal(cert.Alternates)
+		if err != nil {
+			return fmt.Errorf("error encoding alternates of %s: %w", cert.SNI, err)
+		}
+	}
+
+	now := time.Now().UTC().Format(sqliteTimeFormat)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO certificates (namespace, sni, cert, key, serial, issuer, issuer_name, not_before, not_after, demoted_until, wildcard, dns_names, alternates, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (namespace, sni) DO UPDATE SET
+			cert          = excluded.cert,
+			key           = excluded.key,
+			serial        = excluded.serial,
+			issuer        = excluded.issuer,
+			issuer_name   = excluded.issuer_name,
+			not_before    = excluded.not_before,
+			not_after     = excluded.not_after,
+			demoted_until = excluded.demoted_until,
+			wildcard      = excluded.wildcard,
+			dns_names     = excluded.dns_names,
+			alternates    = excluded.alternates,
+			updated_at    = excluded.updated_at`,
+		s.namespace, cert.SNI, cert.Cert, cert.Key, serial, issuer, issuerName, notBefore, notAfter, demotedUntil, cert.Wildcard, dnsNames, alternates, now, now)
+	if err != nil {
+		return fmt.Errorf("error writing certificate %s: %w", cert.SNI, err)
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) Get(ctx context.Context, sni string) (*types.Certificate, error) {
+	if !hostname.IsCanonical(sni) {
+		return nil, fmt.Errorf("invalid SNI %q", sni)
+	}
+
+	cert, err := scanCertificate(s.db.QueryRowContext(ctx, `SELECT `+certificateColumns+` FROM certificates WHERE namespace = ? AND sni = ?`, s.namespace, sni))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading certificate %s: %w", sni, err)
+	}
+
+	if err := s.sealer.open(cert); err != nil {
+		return nil, err
+	}
+
+	if err := validate(cert); err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+func (s *SQLiteStore) List(ctx context.Context) ([]*types.Certificate, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+certificateColumns+` FROM certificates WHERE namespace = ? ORDER BY sni`, s.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error listing certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var certs []*types.Certificate
+	for rows.Next() {
+		cert, err := scanCertificate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading certificate: %w", err)
+		}
+
+		if err := s.sealer.open(cert); err != nil {
+			log.Println("[sqlite] skipping certificate:", err)
+			continue
+		}
+
+		// Rows may have been written by hand, only hand out what we would have written ourselves
+		if err := validate(cert); err != nil {
+			log.Println("[sqlite] skipping certificate:", err)
+			continue
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, rows.Err()
+}
+
+func (s *SQLiteStore) Delete(ctx context.Context, sni string) error {
+	if !hostname.IsCanonical(sni) {
+		return fmt.Errorf("invalid SNI %q", sni)
+	}
+
+	res, err := s.db.ExecContext(ctx, `DELETE FROM certificates WHERE namespace = ? AND sni = ?`, s.namespace, sni)
+	if err != nil {
+		return fmt.Errorf("error deleting certificate %s: %w", sni, err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Watch polls the generation counter every pollInterval.
+func (s *SQLiteStore) Watch(ctx context.Context) (<-chan struct{}, error) {
+	last, err := s.generation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan struct{}, 1)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				current, err := s.generation(ctx)
+				if err != nil {
+					log.Println("[sqlite] error polling for changes:", err)
+					continue
+				}
+
+				if current == last {
+					continue
+				}
+				last = current
+
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) generation(ctx context.Context) (int64, error) {
+	var value int64
+	err := s.db.QueryRowContext(ctx, `SELECT value FROM generation WHERE id = 0`).Scan(&value)
+	return value, err
+}
+
+// certificateColumns are the columns scanCertificate expects, in order.
+const certificateColumns = `sni, cert, key, issuer_name, demoted_until, wildcard, dns_names, alternates`
+
+func scanCertificate(row interface{ Scan(...any) error }) (*types.Certificate, error) {
+	cert := &types.Certificate{}
+
+	var issuerName, demotedUntil, dnsNames sql.NullString
+	var alternates []byte
+	if err := row.Scan(&cert.SNI, &cert.Cert, &cert.Key, &issuerName, &demotedUntil, &cert.Wildcard, &dnsNames, &alternates); err != nil {
+		return nil, err
+	}
+	cert.Issuer = issuerName.String
+
+	if len(alternates) > 0 {
+		if err := json.Unmarshal(alternates, &cert.Alternates); err != nil {
+			return nil, fmt.Errorf("invalid alternates for %s: %w", cert.SNI, err)
+		}
+	}
+
+	if dnsNames.Valid && dnsNames.String != "" {
+		cert.DNSNames = strings.Split(dnsNames.String, ",")
+	}
+
+	if demotedUntil.Valid {
+		t, err := time.Parse(sqliteTimeFormat, demotedUntil.String)
+		if err != nil {
+			return nil, fmt.Errorf("invalid demoted_until for %s: %w", cert.SNI, err)
+		}
+		cert.DemotedUntil = &t
+	}
+
+	return cert, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		// PRAGMA does not support placeholders
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package certstore persists minted certificates so that als can write them and xds can serve them.
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+const (
+	// How often the file backend rescans its directory in case an fsnotify event was missed
+	defaultResyncInterval = 5 * time.Minute
+	// How often the SQLite backend polls for changes made by other processes
+	defaultPollInterval = time.Second
+)
+
+var ErrNotFound = errors.New("certificate not found")
+
+// Store is implemented by every certificate backend.
+type Store interface {
+	Put(ctx context.Context, cert *types.Certificate) error
+	// Get returns ErrNotFound if there is no certificate for sni.
+	Get(ctx context.Context, sni string) (*types.Certificate, error)
+	// List returns every certificate sorted by SNI.
+	List(ctx context.Context) ([]*types.Certificate, error)
+	// Delete returns ErrNotFound if there is no certificate for sni.
+	Delete(ctx context.Context, sni string) error
+	// Watch sends a value on the returned channel whenever the stored certificates change.
+	// The channel is closed once ctx is done.
+	Watch(ctx context.Context) (<-chan struct{}, error)
+	Close() error
+}
+
+// Open returns the Store described by uri:
+//
+//	file:///app/certs          one JSON file per certificate in /app/certs
+//	sqlite:///app/certs.db     a SQLite database at /app/certs.db
+//
+// Keys are encrypted with sealer unless it is nil.
+func Open(uri string, sealer *Sealer) (Store, error) {
+	return OpenNamespace(uri, "", sealer)
+}
+
+// OpenNamespace is like Open, but only sees the certificates in namespace. The same SNI can be stored
+// in several namespaces. Namespaces are subdirectories of the file backend, the empty namespace is
+// the directory itself.
+func OpenNamespace(uri, namespace string, sealer *Sealer) (Store, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid store %q: %w", uri, err)
+	}
+
+	switch u.Scheme {
+	case "file", "":
+		path := u.Path
+		if namespace != "" {
+			path = filepath.Join(path, namespace)
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return nil, fmt.Errorf("error creating namespace %s: %w", namespace, err)
+			}
+		}
+
+		store := NewFileStore(path, defaultResyncInterval)
+		store.SetSealer(sealer)
+		return store, nil
+	case "sqlite":
+		store, err := NewSQLiteStore(u.Path, defaultPollInterval)
+		if err != nil {
+			return nil, err
+		}
+		store.SetSealer(sealer)
+		store.namespace = namespace
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unsupported store %q", u.Scheme)
+	}
+}
+
+// validate rejects certificates Envoy would not be able to load.
+func validate(cert *types.Certificate) error {
+	if !hostname.IsCanonical(cert.SNI) {
+		return fmt.Errorf("invalid SNI %q", cert.SNI)
+	}
+
+	if _, err := tls.X509KeyPair(cert.Cert, cert.Key); err != nil {
+		return fmt.Errorf("invalid key pair for %s: %w", cert.SNI, err)
+	}
+
+	for _, alternate := range cert.Alternates {
+		if _, err := tls.X509KeyPair(alternate.Cert, alternate.Key); err != nil {
+			return fmt.Errorf("invalid %s key pair for %s: %w", alternate.Algorithm, cert.SNI, err)
+		}
+	}
+
+	return nil
+}
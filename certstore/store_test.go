@@ -0,0 +1,221 @@
+package certstore_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestStores(t *testing.T) {
+	backends := map[string]func(t *testing.T) certstore.Store{
+		"file": func(t *testing.T) certstore.Store {
+			return certstore.NewFileStore(t.TempDir(), time.Minute)
+		},
+		"sqlite": func(t *testing.T) certstore.Store {
+			store, err := certstore.NewSQLiteStore(filepath.Join(t.TempDir(), "certs.db"), 10*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	}
+
+	for name, newStore := range backends {
+		newStore := newStore
+
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			store := newStore(t)
+			defer store.Close()
+
+			updateCh, err := store.Watch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.Get(ctx, "example.com"); !errors.Is(err, certstore.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+
+			cert := newCertificate(t, "example.com")
+			if err := store.Put(ctx, cert); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-updateCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for update")
+			}
+
+			got, err := store.Get(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Cert) != string(cert.Cert) || string(got.Key) != string(cert.Key) {
+				t.Fatal("certificate does not round trip")
+			}
+
+			until := time.Now().Add(time.Hour).Truncate(time.Second)
+			got.DemotedUntil = &until
+			if err := store.Put(ctx, got); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err = store.Get(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.DemotedUntil == nil || !got.DemotedUntil.Equal(until) {
+				t.Fatalf("demotion does not round trip: %v", got.DemotedUntil)
+			}
+
+			got.Wildcard = true
+			got.DNSNames = []string{"*.example.com", "example.com"}
+			if err := store.Put(ctx, got); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err = store.Get(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Wildcard || strings.Join(got.DNSNames, ",") != "*.example.com,example.com" {
+				t.Fatalf("wildcard names do not round trip: %v %v", got.Wildcard, got.DNSNames)
+			}
+
+			alternate := newCertificate(t, "example.com")
+			got.Alternates = []*types.KeyPair{{Algorithm: types.ECDSAP256, Cert: alternate.Cert, Key: alternate.Key}}
+			got.Issuer = "intermediate-ca-2"
+			if err := store.Put(ctx, got); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err = store.Get(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Alternates) != 1 || got.Alternates[0].Algorithm != types.ECDSAP256 || string(got.Alternates[0].Cert) != string(alternate.Cert) {
+				t.Fatalf("alternates do not round trip: %v", got.Alternates)
+			}
+			if got.Issuer != "intermediate-ca-2" {
+				t.Fatalf("issuer does not round trip: %q", got.Issuer)
+			}
+
+			if err := store.Put(ctx, newCertificate(t, "a.example.com")); err != nil {
+				t.Fatal(err)
+			}
+			waitForCertificates(t, store, "a.example.com", "example.com")
+
+			if err := store.Put(ctx, &types.Certificate{SNI: "../example.com", Cert: cert.Cert, Key: cert.Key}); err == nil {
+				t.Fatal("expected invalid SNI to be rejected")
+			}
+			if _, err := store.Get(ctx, "../example.com"); err == nil || errors.Is(err, certstore.ErrNotFound) {
+				t.Fatalf("expected invalid SNI to be rejected, got %v", err)
+			}
+			if err := store.Delete(ctx, "../example.com"); err == nil || errors.Is(err, certstore.ErrNotFound) {
+				t.Fatalf("expected invalid SNI to be rejected, got %v", err)
+			}
+
+			if err := store.Delete(ctx, "example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := store.Delete(ctx, "example.com"); !errors.Is(err, certstore.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+			waitForCertificates(t, store, "a.example.com")
+		})
+	}
+}
+
+// waitForCertificates waits for the watcher to catch up with writes, List must eventually return want.
+func waitForCertificates(t *testing.T, store certstore.Store, want ...string) {
+	t.Helper()
+
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		certs, err := store.List(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got = got[:0]
+		for _, cert := range certs {
+			got = append(got, cert.SNI)
+		}
+
+		if strings.Join(got, ",") == strings.Join(want, ",") {
+			return
+		}
+	}
+
+	t.Fatalf("got certificates %v, want %v", got, want)
+}
+
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+
+	for name, uri := range map[string]func(dir string) string{
+		"file":   func(dir string) string { return "file://" + dir },
+		"sqlite": func(dir string) string { return "sqlite://" + filepath.Join(dir, "certs.db") },
+	} {
+		uri := uri(t.TempDir())
+
+		t.Run(name, func(t *testing.T) {
+			root, err := certstore.Open(uri, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer root.Close()
+
+			teamA, err := certstore.OpenNamespace(uri, "team-a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer teamA.Close()
+
+			// Watching loads the file backend
+			for _, store := range []certstore.Store{root, teamA} {
+				if _, err := store.Watch(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rootCert := newCertificate(t, "example.com")
+			teamACert := newCertificate(t, "example.com")
+			if err := root.Put(ctx, rootCert); err != nil {
+				t.Fatal(err)
+			}
+			if err := teamA.Put(ctx, teamACert); err != nil {
+				t.Fatal(err)
+			}
+			if err := teamA.Put(ctx, newCertificate(t, "a.example.com")); err != nil {
+				t.Fatal(err)
+			}
+
+			waitForCertificates(t, root, "example.com")
+			waitForCertificates(t, teamA, "a.example.com", "example.com")
+
+			got, err := teamA.Get(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Cert) != string(teamACert.Cert) {
+				t.Fatal("namespaces share the certificate of example.com")
+			}
+
+			if err := root.Delete(ctx, "a.example.com"); !errors.Is(err, certstore.ErrNotFound) {
+				t.Fatalf("expected ErrNotFound, got %v", err)
+			}
+		})
+	}
+}
@@ -3,8 +3,14 @@ package cfssl
 import (
 	"crypto/x509"
 	_ "embed"
+	"errors"
+	"fmt"
+	"os"
 )
 
+// combined.crt holds every root and intermediate clients should trust. While the CA is rotated
+// it holds both the old and the new ones.
+//
 //go:embed combined.crt
 var ca []byte
 
@@ -13,3 +19,19 @@ func CertPool() *x509.CertPool {
 	certPool.AppendCertsFromPEM(ca)
 	return certPool
 }
+
+// LoadCertPool reads a PEM trust bundle with any number of certificates, e.g. a combined.crt published
+// after the binary was built.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading trust bundle: %w", err)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in trust bundle")
+	}
+
+	return certPool, nil
+}
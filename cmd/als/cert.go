@@ -1,138 +1,141 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"time"
 
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/signer"
 	"github.com/epk/envoy-egress-mitm/types"
 )
 
-const (
-	certsDir       = "/app/certs"
-	cfsslConfigDir = "/app/cfssl"
-	binDir         = "/app/bin"
-)
+func (a *als) createCert(ctx context.Context, sni string) error {
+	var err error
+	if a.wildcard {
+		err = a.createWildcardCert(ctx, sni)
+	} else {
+		err = a.createExactCert(ctx, sni)
+	}
 
-type certConfig struct {
-	CN   string         `json:"CN"`
-	Key  *certConfigkey `json:"key"`
-	Host []string       `json:"hosts"`
-}
+	// The policy changed since the intermediate was bootstrapped, point at the rule that wants sni intercepted
+	var constraintErr *signer.ConstraintError
+	if errors.As(err, &constraintErr) {
+		return fmt.Errorf("%w, the policy decided %s", err, a.policy.Policy().Decide(sni))
+	}
 
-type certConfigkey struct {
-	Algo string `json:"algo"`
-	Size int    `json:"size"`
+	return err
 }
 
-func createCert(sni string) error {
-	outFile := filepath.Join(certsDir, sni+".json")
-
+func (a *als) createExactCert(ctx context.Context, sni string) error {
 	// check if a cert already exists
-	if _, err := os.Stat(outFile); err == nil {
-		return nil
+	existing, err := a.store.Get(ctx, sni)
+	if err == nil {
+		return a.renewAndPromote(ctx, existing)
+	}
+
+	if !errors.Is(err, certstore.ErrNotFound) {
+		return fmt.Errorf("error reading certificate: %w", err)
 	}
 
 	// create the cert
-	log.Println("Creating cert for", sni, "at", outFile)
+	log.Println("Creating cert for", sni)
 
-	tmpDir, err := os.MkdirTemp("", sni)
+	out, err := a.mint(ctx, sni)
 	if err != nil {
-		return fmt.Errorf("error creating temp dir: %w", err)
+		return fmt.Errorf("error signing certificate: %w", err)
 	}
 
-	certConfigbytes, err := json.Marshal(certConfigFor(sni))
-	if err != nil {
-		return fmt.Errorf("error marshalling cert config: %w", err)
+	if err := a.store.Put(ctx, out); err != nil {
+		return fmt.Errorf("error storing certificate: %w", err)
 	}
 
-	certConfigFile := filepath.Join(tmpDir, "cert.json")
-	if err := os.WriteFile(certConfigFile, certConfigbytes, 0644); err != nil {
-		return fmt.Errorf("error writing cert config: %w", err)
-	}
+	return nil
+}
 
-	cfsslOut := bytes.NewBuffer(nil)
-
-	cfsslCmd := &exec.Cmd{
-		Dir:  tmpDir,
-		Path: filepath.Join(binDir, "cfssl"),
-		Args: []string{
-			"cfssl",
-			"gencert",
-			"-ca", filepath.Join(cfsslConfigDir, "intermediate-ca.crt"),
-			"-ca-key", filepath.Join(cfsslConfigDir, "intermediate-ca.key"),
-			"-config", filepath.Join(cfsslConfigDir, "cfssl.json"),
-			"-profile", "certificate",
-			certConfigFile,
-		},
-		Stdout: cfsslOut,
-		Stderr: io.Discard,
-	}
+// mint issues a certificate for sni, modelled after the one the upstream presents in mimic mode.
+func (a *als) mint(ctx context.Context, sni string) (*types.Certificate, error) {
+	if a.prober != nil {
+		upstreamCert, err := a.prober.Certificate(ctx, sni)
+		if err == nil {
+			return a.signer.Mimic(sni, upstreamCert)
+		}
 
-	cfssljsonCmd := &exec.Cmd{
-		Dir:  tmpDir,
-		Path: filepath.Join(binDir, "cfssljson"),
-		Args: []string{
-			"cfssljson",
-			"-bare",
-			"cert",
-		},
-		Stdin:  cfsslOut,
-		Stderr: io.Discard,
+		log.Printf("Not mimicking upstream certificate for %s: %v", sni, err)
 	}
 
-	if err := cfsslCmd.Run(); err != nil {
-		return fmt.Errorf("cfssl failed: %w", err)
-	}
+	return a.signer.Issue(a.keysFor(sni), sni)
+}
 
-	if err := cfssljsonCmd.Run(); err != nil {
-		return fmt.Errorf("cfssljson failed: %w", err)
+// keysFor returns the key algorithms the policy wants sni minted with.
+func (a *als) keysFor(sni string) []types.KeyAlgorithm {
+	keys := a.policy.Policy().Decide(sni).Keys
+	if len(keys) == 0 {
+		return []types.KeyAlgorithm{types.DefaultKeyAlgorithm}
 	}
 
-	cert := filepath.Join(tmpDir, "cert.pem")
-	certKey := filepath.Join(tmpDir, "cert-key.pem")
+	return keys
+}
 
-	certBytes, err := os.ReadFile(cert)
-	if err != nil {
-		return fmt.Errorf("error reading certificate file: %w", err)
+// keysChanged reports whether cert has to be re-issued to match the key algorithms of the policy.
+// Mimicked certificates take their key type from the upstream instead.
+func (a *als) keysChanged(cert *types.Certificate) bool {
+	if a.prober != nil && !cert.Wildcard {
+		return false
 	}
 
-	keyBytes, err := os.ReadFile(certKey)
+	current, err := cert.KeyAlgorithms()
 	if err != nil {
-		return fmt.Errorf("error reading certificate key file: %w", err)
+		return true
 	}
 
-	out := &types.Certificate{
-		Cert: certBytes,
-		Key:  keyBytes,
-		SNI:  sni,
+	want := a.keysFor(cert.SNI)
+	if len(current) != len(want) {
+		return true
 	}
 
-	raw, err := json.Marshal(out)
-	if err != nil {
-		return fmt.Errorf("error marshalling json  : %w", err)
+	for i := range want {
+		if current[i] != want[i] {
+			return true
+		}
 	}
 
-	if err := os.WriteFile(outFile, raw, 0644); err != nil {
-		return fmt.Errorf("error writing json to file: %w", err)
+	return false
+}
+
+// issuerChanged reports whether cert was signed by another issuer than the active one and has to be re-minted.
+func (a *als) issuerChanged(cert *types.Certificate) bool {
+	return a.signer.IssuerOf(cert) != a.signer.Active()
+}
+
+// renewAndPromote renews cert if it is about to expire, the policy wants other keys or the issuer was rotated,
+// and promotes it if its cooldown is over.
+func (a *als) renewAndPromote(ctx context.Context, cert *types.Certificate) error {
+	if cert.NeedsRenewal(time.Now(), *renewBefore) || a.keysChanged(cert) || a.issuerChanged(cert) {
+		renewed, err := a.renew(ctx, cert)
+		if err != nil {
+			return err
+		}
+		cert = renewed
 	}
 
-	defer os.RemoveAll(tmpDir)
-	return nil
+	return a.promote(ctx, cert)
 }
 
-func certConfigFor(sni string) *certConfig {
-	return &certConfig{
-		CN: sni,
-		Key: &certConfigkey{
-			Algo: "rsa",
-			Size: 2048,
-		},
-		Host: []string{sni},
+// promote moves a demoted host back to L7 once its cooldown is over.
+func (a *als) promote(ctx context.Context, cert *types.Certificate) error {
+	if cert.DemotedUntil == nil || cert.Demoted(time.Now()) {
+		return nil
 	}
+
+	log.Println("Cooldown over, intercepting", cert.SNI, "again")
+
+	cert.DemotedUntil = nil
+	if err := a.store.Put(ctx, cert); err != nil {
+		return fmt.Errorf("error storing certificate: %w", err)
+	}
+
+	return nil
 }
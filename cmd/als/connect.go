@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_data_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+)
+
+// connectHost returns the host a CONNECT tunnel logged by the explicit forward proxy went to. Only tunnels
+// to upstreamPort go through the tenant's listener, certificates for any other port would never be served.
+func connectHost(entry *envoy_data_accesslog_v3.HTTPAccessLogEntry, upstreamPort uint32) (string, bool) {
+	if entry.GetRequest().GetRequestMethod() != envoy_core_v3.RequestMethod_CONNECT {
+		return "", false
+	}
+
+	host, port, err := net.SplitHostPort(entry.GetRequest().GetAuthority())
+	if err != nil || port != strconv.FormatUint(uint64(upstreamPort), 10) {
+		return "", false
+	}
+
+	return host, true
+}
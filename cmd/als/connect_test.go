@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_data_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+)
+
+func TestConnectHost(t *testing.T) {
+	tests := map[string]struct {
+		method    envoy_core_v3.RequestMethod
+		authority string
+		want      string
+	}{
+		"tls":         {method: envoy_core_v3.RequestMethod_CONNECT, authority: "example.com:443", want: "example.com"},
+		"other port":  {method: envoy_core_v3.RequestMethod_CONNECT, authority: "example.com:22"},
+		"no port":     {method: envoy_core_v3.RequestMethod_CONNECT, authority: "example.com"},
+		"not connect": {method: envoy_core_v3.RequestMethod_GET, authority: "example.com:443"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			host, ok := connectHost(&envoy_data_accesslog_v3.HTTPAccessLogEntry{
+				Request: &envoy_data_accesslog_v3.HTTPRequestProperties{
+					RequestMethod: tt.method,
+					Authority:     tt.authority,
+				},
+			}, 443)
+			if host != tt.want || ok != (tt.want != "") {
+				t.Fatalf("got %q, %v, want %q", host, ok, tt.want)
+			}
+		})
+	}
+}
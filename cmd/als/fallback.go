@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	envoy_data_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+)
+
+// failureTracker counts failures per intercepted host within a sliding window.
+type failureTracker struct {
+	mu sync.Mutex
+
+	threshold int
+	window    time.Duration
+
+	failures map[string][]time.Time
+}
+
+func newFailureTracker(threshold int, window time.Duration) *failureTracker {
+	return &failureTracker{
+		threshold: threshold,
+		window:    window,
+		failures:  map[string][]time.Time{},
+	}
+}
+
+// record adds a failure for host and reports whether the host crossed the threshold.
+// The count starts over once the threshold is crossed.
+func (f *failureTracker) record(host string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	recent := f.failures[host][:0]
+	for _, t := range f.failures[host] {
+		if now.Sub(t) < f.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) >= f.threshold {
+		delete(f.failures, host)
+		return true
+	}
+
+	f.failures[host] = recent
+	return false
+}
+
+// interceptionFailure returns why an entry logged by an intercepted host failed, if it did. Only the upstream
+// handshake or its certificate verification failing says something about interception, e.g. the upstream wants
+// a client certificate, an unreachable or misbehaving upstream fails on L4 too.
+//
+// Clients that pin certificates or don't trust our CA go unnoticed: they abort the handshake before there is
+// a request, and only requests are logged.
+func interceptionFailure(common *envoy_data_accesslog_v3.AccessLogCommon) (string, bool) {
+	reason := common.GetUpstreamTransportFailureReason()
+	if reason == "" {
+		return "", false
+	}
+
+	return "upstream TLS failure: " + reason, true
+}
+
+// recordFailure demotes sni back to L4 once it fails too often on L7.
+func (a *als) recordFailure(ctx context.Context, sni, reason string) error {
+	now := time.Now()
+	log.Printf("Interception failure for %s: %s", sni, reason)
+
+	if !a.failures.record(sni, now) {
+		return nil
+	}
+
+	// Demoting a wildcard certificate moves the whole domain back to L4
+	cert, err := a.lookup(ctx, sni)
+	if err != nil {
+		return fmt.Errorf("error reading certificate: %w", err)
+	}
+
+	if cert.Demoted(now) {
+		return nil
+	}
+
+	until := now.Add(*fallbackCooldown)
+	cert.DemotedUntil = &until
+
+	log.Printf("Demoting %s to L4 passthrough until %s after %d failures", cert.SNI, until.Format(time.RFC3339), *fallbackThreshold)
+	if err := a.store.Put(ctx, cert); err != nil {
+		return fmt.Errorf("error storing demotion: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	envoy_data_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
+)
+
+func TestFailureTracker(t *testing.T) {
+	f := newFailureTracker(3, time.Minute)
+	now := time.Now()
+
+	if f.record("example.com", now) || f.record("example.com", now.Add(time.Second)) {
+		t.Fatal("threshold crossed too early")
+	}
+
+	// Failures outside the window don't count
+	if f.record("example.com", now.Add(2*time.Minute)) {
+		t.Fatal("expired failures were counted")
+	}
+
+	if f.record("example2.com", now.Add(2*time.Minute)) {
+		t.Fatal("failures of another host were counted")
+	}
+
+	if f.record("example.com", now.Add(2*time.Minute+time.Second)) {
+		t.Fatal("threshold crossed too early")
+	}
+
+	if !f.record("example.com", now.Add(2*time.Minute+2*time.Second)) {
+		t.Fatal("expected threshold to be crossed")
+	}
+
+	// The count starts over
+	if f.record("example.com", now.Add(2*time.Minute+3*time.Second)) {
+		t.Fatal("threshold crossed right after a reset")
+	}
+}
+
+func TestInterceptionFailure(t *testing.T) {
+	tests := map[string]struct {
+		common *envoy_data_accesslog_v3.AccessLogCommon
+		failed bool
+	}{
+		"success": {
+			common: &envoy_data_accesslog_v3.AccessLogCommon{},
+		},
+		"upstream verification": {
+			common: &envoy_data_accesslog_v3.AccessLogCommon{
+				ResponseFlags:                  &envoy_data_accesslog_v3.ResponseFlags{UpstreamConnectionFailure: true},
+				UpstreamTransportFailureReason: "TLS_error:|268435581:SSL routines:OPENSSL_internal:CERTIFICATE_VERIFY_FAILED:TLS_error_end",
+			},
+			failed: true,
+		},
+		"upstream connection": {
+			common: &envoy_data_accesslog_v3.AccessLogCommon{
+				ResponseFlags: &envoy_data_accesslog_v3.ResponseFlags{UpstreamConnectionFailure: true},
+			},
+		},
+		"upstream protocol": {
+			common: &envoy_data_accesslog_v3.AccessLogCommon{
+				ResponseFlags: &envoy_data_accesslog_v3.ResponseFlags{UpstreamProtocolError: true},
+			},
+		},
+		"downstream reset": {
+			common: &envoy_data_accesslog_v3.AccessLogCommon{
+				ResponseFlags: &envoy_data_accesslog_v3.ResponseFlags{DownstreamConnectionTermination: true},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		if _, failed := interceptionFailure(tt.common); failed != tt.failed {
+			t.Errorf("%s: got failed=%v, want %v", name, failed, tt.failed)
+		}
+	}
+}
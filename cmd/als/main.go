@@ -1,18 +1,87 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"time"
 
+	"github.com/spf13/pflag"
 	"google.golang.org/grpc"
 
+	envoy_data_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v3"
 	envoy_service_accesslog_v3 "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v3"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/config"
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/signer"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+	"github.com/epk/envoy-egress-mitm/upstream"
+)
+
+var (
+	cfg = config.Default()
+
+	kekFile     = pflag.String("kek-file", "", "Base64 encoded 32 byte key to encrypt private keys in the store with, $CERTSTORE_KEK when unset")
+	policyFile  = pflag.String("policy", "", "Interception policy file of the default tenant, every host is intercepted when unset")
+	tenantsFile = pflag.String("tenants", "", "Tenants to mint certificates for besides the default one, each with its own CA, policy and store namespace")
+
+	wildcardCerts = pflag.Bool("wildcard-certs", false, "Mint *.domain certificates keyed by the registrable domain instead of one certificate per host")
+	mimicUpstream = pflag.Bool("mimic-upstream", false, "Copy the subject, SANs, key type and lifetime of the upstream certificate into minted certificates")
+
+	issuer      = pflag.String("issuer", signer.DefaultIssuer, "Intermediate CA in --ca-dir the default tenant issues new certificates with, certificates of other issuers are re-minted")
+	rotateBatch = pflag.Int("rotate-batch", 50, "Certificates of a previous issuer to re-mint per renewal pass, 0 re-mints them all at once")
+
+	renewBefore   = pflag.Duration("renew-before", 72*time.Hour, "Renew certificates that expire within this window")
+	renewInterval = pflag.Duration("renew-interval", time.Hour, "How often to look for certificates to renew")
+
+	revocationListen = pflag.String("revocation-listen", ":8080", "Address to serve OCSP and the CRL on, disabled when empty")
+	revocationURL    = pflag.String("revocation-url", "", "Base URL clients reach the revocation endpoints at, minted certificates only carry AIA and CDP extensions when set")
+	revocationFile   = pflag.String("revocations", "/app/revocations/revoked.json", "Revocation list written by the revoke command")
+	crlRefresh       = pflag.Duration("crl-refresh", time.Hour, "How long OCSP responses and the CRL stay valid, the CRL is regenerated at least this often")
+
+	fallbackThreshold = pflag.Int("fallback-threshold", 3, "Failures on L7 after which a host is demoted back to L4 passthrough")
+	fallbackWindow    = pflag.Duration("fallback-window", 10*time.Minute, "Window in which failures count towards the fallback threshold")
+	fallbackCooldown  = pflag.Duration("fallback-cooldown", 24*time.Hour, "How long a demoted host stays on L4 before it is intercepted again")
 )
 
-type als struct{}
+// als mints the certificates of a single tenant.
+type als struct {
+	tenant   *tenant.Tenant
+	signer   *signer.Signer
+	store    certstore.Store
+	policy   *policy.File
+	failures *failureTracker
+
+	// wildcard keys certificates by registrable domain
+	wildcard bool
+	// prober is set in mimic mode
+	prober *upstream.Prober
+}
+
+// server hands every access log to the tenant whose listener logged it.
+type server struct {
+	tenants map[string]*als
+}
+
+// tenantFor returns the tenant that logged logName, and the unqualified log name.
+func (s *server) tenantFor(logName string) (*als, string) {
+	name, logName := tenant.ParseLogName(logName)
+	return s.tenants[name], logName
+}
+
+func (s *server) StreamAccessLogs(stream envoy_service_accesslog_v3.AccessLogService_StreamAccessLogsServer) error {
+	var a *als
+	var logName string
+	// warned is set once an unknown log name has been reported, so a stream only reports it once
+	var warned bool
 
-func (a *als) StreamAccessLogs(stream envoy_service_accesslog_v3.AccessLogService_StreamAccessLogsServer) error {
 	for {
 		req, err := stream.Recv()
 		if err == io.EOF {
@@ -22,26 +91,212 @@ func (a *als) StreamAccessLogs(stream envoy_service_accesslog_v3.AccessLogServic
 			return err
 		}
 
-		for _, entry := range req.GetTcpLogs().GetLogEntry() {
-			sni := entry.GetCommonProperties().GetTlsProperties().GetTlsSniHostname()
-			if err := createCert(sni); err != nil {
-				log.Println("Error creating cert:", err)
+		// Envoy only identifies the log on the first message of a stream
+		if id := req.GetIdentifier(); id != nil {
+			a, logName = s.tenantFor(id.GetLogName())
+			if a == nil {
+				return fmt.Errorf("access log %q of an unknown tenant", id.GetLogName())
+			}
+		}
+
+		if a == nil {
+			return errors.New("access log stream without identifier")
+		}
+
+		switch logName {
+		case types.PassthroughLogName:
+			for _, entry := range req.GetTcpLogs().GetLogEntry() {
+				a.handlePassthrough(stream.Context(), entry.GetCommonProperties())
+			}
+
+		case types.ConnectLogName:
+			// Tunnels bypass the TLS listener in OriginalDst mode, a certificate would never be served
+			if cfg.OriginalDst {
+				break
+			}
+
+			for _, entry := range req.GetHttpLogs().GetLogEntry() {
+				if host, ok := connectHost(entry, cfg.UpstreamPort); ok {
+					a.mintRequested(stream.Context(), host)
+				}
+			}
+
+		case types.InterceptLogName:
+			for _, entry := range req.GetTcpLogs().GetLogEntry() {
+				a.handleIntercepted(stream.Context(), entry.GetCommonProperties())
+			}
+
+			for _, entry := range req.GetHttpLogs().GetLogEntry() {
+				a.handleIntercepted(stream.Context(), entry.GetCommonProperties())
+			}
+
+		case types.HTTPLogName:
+			// Plaintext requests need no certificate and there is no interception to fall back from,
+			// the log is only there to be read
+
+		default:
+			if !warned {
+				log.Printf("Ignoring access log %q of tenant %s, nothing handles it", logName, a.tenant.Name)
+				warned = true
 			}
 		}
 	}
 }
 
+// handlePassthrough mints a certificate for hosts seen on the L4 path.
+func (a *als) handlePassthrough(ctx context.Context, common *envoy_data_accesslog_v3.AccessLogCommon) {
+	// Plaintext connections passed through in OriginalDst mode, and TLS without SNI, name no host
+	sni := common.GetTlsProperties().GetTlsSniHostname()
+	if sni == "" {
+		return
+	}
+
+	a.mintRequested(ctx, sni)
+}
+
+// mintRequested creates a certificate for requested if the policy intercepts it.
+func (a *als) mintRequested(ctx context.Context, requested string) {
+	sni, err := hostname.Normalize(requested)
+	if err != nil {
+		log.Printf("Not creating cert for %q: %v", requested, err)
+		return
+	}
+
+	if decision := a.policy.Policy().Decide(sni); decision.Action != policy.Intercept {
+		return
+	}
+
+	if err := a.createCert(ctx, sni); err != nil {
+		log.Println("Error creating cert:", err)
+	}
+}
+
+// handleIntercepted watches hosts on the L7 path for failures.
+func (a *als) handleIntercepted(ctx context.Context, common *envoy_data_accesslog_v3.AccessLogCommon) {
+	reason, failed := interceptionFailure(common)
+	if !failed {
+		return
+	}
+
+	sni, err := hostname.Normalize(common.GetTlsProperties().GetTlsSniHostname())
+	if err != nil {
+		return
+	}
+
+	if err := a.recordFailure(ctx, sni, reason); err != nil {
+		log.Println("Error recording failure:", err)
+	}
+}
+
 func main() {
-	srv := grpc.NewServer()
-	envoy_service_accesslog_v3.RegisterAccessLogServiceServer(srv, &als{})
+	cfg.Flags(pflag.CommandLine)
+	pflag.Parse()
+
+	if err := cfg.Load(pflag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
+	sealer, err := certstore.LoadSealer(*kekFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	def := tenant.Default()
+	def.Port = cfg.ListenerPort
+	def.ConnectPort = cfg.ConnectPort
+	def.HTTPPort = cfg.HTTPPort
+	def.Policy = *policyFile
+	def.CA = cfg.CADir
+	def.Issuer = *issuer
 
-	lis, err := net.Listen("tcp", ":50051")
+	extra, err := tenant.Load(*tenantsFile, def)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &server{tenants: map[string]*als{}}
+	var minters []*als
+	for _, t := range append([]*tenant.Tenant{def}, extra...) {
+		a, err := newALS(t, sealer)
+		if err != nil {
+			log.Fatalf("Tenant %s: %v", t.Name, err)
+		}
+		defer a.store.Close()
+
+		srv.tenants[t.Name] = a
+		minters = append(minters, a)
+
+		if cfg.OriginalDst && t.ConnectPort != 0 {
+			log.Printf("Warning: tenant %s: CONNECT tunnels on port %d aren't intercepted with original_dst, not minting for them", t.Name, t.ConnectPort)
+		}
+	}
+
+	if *revocationListen != "" {
+		if err := serveRevocation(minters, *revocationListen, *revocationURL, *revocationFile, *crlRefresh); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, a := range minters {
+		go a.renewLoop(context.Background(), *renewInterval)
+	}
+
+	grpcServer := grpc.NewServer()
+	envoy_service_accesslog_v3.RegisterAccessLogServiceServer(grpcServer, srv)
+
+	lis, err := net.Listen("tcp", cfg.GRPCListen)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Println("Starting server")
-	if err := srv.Serve(lis); err != nil {
+	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// newALS loads the CA, store namespace and policy of t.
+func newALS(t *tenant.Tenant, sealer *certstore.Sealer) (*als, error) {
+	issuer := t.Issuer
+	if issuer == "" {
+		issuer = signer.DefaultIssuer
+	}
+
+	s, err := signer.Load(t.CA, issuer)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Tenant %s issues certificates with %s, %d issuers known", t.Name, s.Active().Name, len(s.Issuers()))
+
+	store, err := certstore.OpenNamespace(cfg.Store, t.Namespace(), sealer)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := policy.Load(t.Policy)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	// Reloads happen in the background, every lookup reads the latest policy
+	if _, err := policies.Watch(context.Background()); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	a := &als{
+		tenant:   t,
+		signer:   s,
+		store:    store,
+		policy:   policies,
+		failures: newFailureTracker(*fallbackThreshold, *fallbackWindow),
+		wildcard: *wildcardCerts,
+	}
+	if *mimicUpstream {
+		a.prober = upstream.NewProber()
+		a.prober.Port = int(cfg.UpstreamPort)
+	}
+
+	return a, nil
+}
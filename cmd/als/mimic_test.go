@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/upstream"
+)
+
+func TestCreateCertMimicsUpstream(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prober := upstream.NewProber()
+	prober.Port, _ = strconv.Atoi(port)
+	prober.LookupIP = func(context.Context, string, string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1")}, nil
+	}
+
+	ctx := context.Background()
+	a := &als{
+		signer: newTestSigner(t),
+		store:  certstore.NewFileStore(t.TempDir(), time.Minute),
+		prober: prober,
+	}
+
+	if err := a.createCert(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := a.store.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := srv.Certificate()
+	if leaf.Subject.String() != want.Subject.String() {
+		t.Errorf("subject = %s, want %s", leaf.Subject, want.Subject)
+	}
+	if strings.Join(leaf.DNSNames, ",") != strings.Join(want.DNSNames, ",") {
+		t.Errorf("DNS names = %v, want %v", leaf.DNSNames, want.DNSNames)
+	}
+	if len(leaf.IPAddresses) != len(want.IPAddresses) {
+		t.Errorf("IP addresses = %v, want %v", leaf.IPAddresses, want.IPAddresses)
+	}
+	if leaf.PublicKeyAlgorithm != want.PublicKeyAlgorithm {
+		t.Errorf("key algorithm = %s, want %s", leaf.PublicKeyAlgorithm, want.PublicKeyAlgorithm)
+	}
+}
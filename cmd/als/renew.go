@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// renewLoop re-issues every certificate that expires within renewBefore or whose key algorithms
+// no longer match the policy, every interval. Certificates of a previous issuer are re-minted
+// rotateBatch at a time.
+// xDS only pushes the changed secrets, so renewing doesn't touch the listener.
+func (a *als) renewLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.renewExpiring(ctx, time.Now()); err != nil {
+			log.Println("Error renewing certificates:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *als) renewExpiring(ctx context.Context, now time.Time) error {
+	certs, err := a.store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing certificates: %w", err)
+	}
+
+	rotated, pending := 0, 0
+	for _, cert := range certs {
+		switch {
+		case cert.NeedsRenewal(now, *renewBefore) || a.keysChanged(cert):
+		case a.issuerChanged(cert):
+			// Spread re-minting under a new issuer over several passes
+			if *rotateBatch > 0 && rotated >= *rotateBatch {
+				pending++
+				continue
+			}
+			rotated++
+		default:
+			continue
+		}
+
+		if _, err := a.renew(ctx, cert); err != nil {
+			log.Println("Error renewing cert:", err)
+		}
+	}
+
+	if pending > 0 {
+		log.Printf("%d certificates left to re-mint under %s", pending, a.signer.Active().Name)
+	}
+
+	return nil
+}
+
+// renew re-issues cert for the same names, keeping everything else we know about the host.
+func (a *als) renew(ctx context.Context, cert *types.Certificate) (*types.Certificate, error) {
+	_, notAfter, err := cert.Validity()
+	if err != nil {
+		log.Printf("Renewing cert for %s: %v", cert.SNI, err)
+	} else {
+		log.Printf("Renewing cert for %s, expires %s", cert.SNI, notAfter.Format(time.RFC3339))
+	}
+
+	var out *types.Certificate
+	if cert.Wildcard {
+		out, err = a.signer.Issue(a.keysFor(cert.SNI), cert.DNSNames...)
+	} else {
+		out, err = a.mint(ctx, cert.SNI)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing certificate: %w", err)
+	}
+
+	out.SNI = cert.SNI
+	out.Wildcard = cert.Wildcard
+	out.DNSNames = cert.DNSNames
+	out.DemotedUntil = cert.DemotedUntil
+
+	if err := a.store.Put(ctx, out); err != nil {
+		return nil, fmt.Errorf("error storing certificate: %w", err)
+	}
+
+	return out, nil
+}
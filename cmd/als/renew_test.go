@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestRenewExpiring(t *testing.T) {
+	ctx := context.Background()
+	a := &als{
+		signer:   newTestSigner(t),
+		store:    certstore.NewFileStore(t.TempDir(), time.Minute),
+		wildcard: true,
+	}
+
+	if err := a.createCert(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := a.store.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fresh certificates are left alone
+	if err := a.renewExpiring(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.store.Get(ctx, "example.com"); !bytes.Equal(got.Cert, before.Cert) {
+		t.Fatal("fresh certificate was renewed")
+	}
+
+	_, notAfter, err := before.Validity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.renewExpiring(ctx, notAfter.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := a.store.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(after.Cert, before.Cert) {
+		t.Fatal("expiring certificate was not renewed")
+	}
+
+	if !after.Wildcard || len(after.DNSNames) != len(before.DNSNames) {
+		t.Fatalf("renewal lost the wildcard names: %v", after.DNSNames)
+	}
+}
+
+func TestRenewKeysChanged(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("keys: [ecdsa-p256]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &als{
+		signer: newTestSigner(t),
+		store:  certstore.NewFileStore(t.TempDir(), time.Minute),
+		policy: policies,
+	}
+
+	if err := a.createCert(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := a.store.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.keysChanged(cert) {
+		t.Fatal("fresh certificate does not match the policy")
+	}
+
+	// Asking for an RSA alternate re-issues the certificate
+	if err := os.WriteFile(path, []byte("keys: [ecdsa-p256, rsa-2048]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if policies, err = policy.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	a.policy = policies
+
+	if err := a.renewExpiring(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = a.store.Get(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := cert.KeyAlgorithms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != types.ECDSAP256 || got[1] != types.RSA2048 {
+		t.Fatalf("unexpected key algorithms %v", got)
+	}
+}
+
+func TestRenewRotatedIssuer(t *testing.T) {
+	ctx := context.Background()
+	a := &als{
+		signer: newTestSigner(t),
+		store:  certstore.NewFileStore(t.TempDir(), time.Minute),
+	}
+
+	hosts := []string{"a.example.com", "b.example.com", "c.example.com"}
+	for _, host := range hosts {
+		if err := a.createCert(ctx, host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certPEM, keyPEM := newTestCA(t)
+	if err := a.signer.AddIssuer("intermediate-ca-2", certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.signer.Activate("intermediate-ca-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(batch int) { *rotateBatch = batch }(*rotateBatch)
+	*rotateBatch = 2
+
+	for pass, want := range []int{2, 3} {
+		if err := a.renewExpiring(ctx, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+
+		rotated := 0
+		for _, host := range hosts {
+			cert, err := a.store.Get(ctx, host)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if a.signer.IssuerOf(cert) == a.signer.Active() {
+				if cert.Issuer != "intermediate-ca-2" {
+					t.Fatalf("unexpected issuer %q", cert.Issuer)
+				}
+				rotated++
+			}
+		}
+
+		if rotated != want {
+			t.Fatalf("pass %d: %d certificates re-minted, want %d", pass, rotated, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/revocation"
+	"github.com/epk/envoy-egress-mitm/tenant"
+)
+
+// tenantsPath is where the revocation endpoints of tenants other than the default one are served below
+const tenantsPath = "/tenants/"
+
+// serveRevocation starts the OCSP responder and CRL endpoint for the certificates of every tenant,
+// and points the tenants' signers at them when baseURL is set.
+func serveRevocation(minters []*als, addr, baseURL, path string, refresh time.Duration) error {
+	list, err := revocation.Open(path)
+	if err != nil {
+		return err
+	}
+
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	handlers := map[string]http.Handler{}
+	for _, a := range minters {
+		responder := revocation.NewResponder(a.signer.Issuers(), list, refresh)
+
+		prefix := ""
+		if !a.tenant.IsDefault() {
+			prefix = tenantsPath + a.tenant.Name
+		}
+
+		if baseURL != "" {
+			a.signer.SetRevocationURLs(baseURL+prefix+revocation.OCSPPath, baseURL+prefix+revocation.CRLPath)
+		}
+
+		if prefix == "" {
+			handlers[a.tenant.Name] = responder.Handler()
+		} else {
+			handlers[a.tenant.Name] = http.StripPrefix(prefix, responder.Handler())
+		}
+	}
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for revocation requests: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           tenantHandler(handlers),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Println("Serving OCSP and CRL on", lis.Addr())
+		if err := srv.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return nil
+}
+
+// tenantHandler serves /tenants/<name>/... from the handler of the tenant and everything else from the
+// default tenant's. Like the responder it does not use a ServeMux, which would clean the slashes out of
+// OCSP GET requests.
+func tenantHandler(handlers map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if rest := strings.TrimPrefix(req.URL.Path, tenantsPath); rest != req.URL.Path {
+			name, _, _ := strings.Cut(rest, "/")
+			if h, ok := handlers[name]; ok && name != tenant.DefaultName {
+				h.ServeHTTP(w, req)
+				return
+			}
+
+			http.NotFound(w, req)
+			return
+		}
+
+		handlers[tenant.DefaultName].ServeHTTP(w, req)
+	})
+}
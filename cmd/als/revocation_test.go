@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/epk/envoy-egress-mitm/tenant"
+)
+
+func TestTenantHandler(t *testing.T) {
+	echo := func(name string) http.Handler {
+		return http.StripPrefix("/tenants/"+name, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, req.URL.Path)
+		}))
+	}
+
+	h := tenantHandler(map[string]http.Handler{
+		tenant.DefaultName: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "default %s", req.URL.Path)
+		}),
+		"team-a": echo("team-a"),
+	})
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{path: "/crl", status: http.StatusOK, body: "default /crl"},
+		{path: "/ocsp//MEow", status: http.StatusOK, body: "default /ocsp//MEow"},
+		{path: "/tenants/team-a/crl/intermediate-ca-2", status: http.StatusOK, body: "team-a /crl/intermediate-ca-2"},
+		{path: "/tenants/team-a/ocsp//MEow", status: http.StatusOK, body: "team-a /ocsp//MEow"},
+		{path: "/tenants/team-b/crl", status: http.StatusNotFound},
+		{path: "/tenants/default/crl", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.path, rec.Code, tt.status)
+			continue
+		}
+
+		if tt.body != "" && rec.Body.String() != tt.body {
+			t.Errorf("%s: got %q, want %q", tt.path, rec.Body.String(), tt.body)
+		}
+	}
+}
+
+func TestServerTenantFor(t *testing.T) {
+	def := &als{tenant: tenant.Default()}
+	teamA := &als{tenant: &tenant.Tenant{Name: "team-a", Port: 9443}}
+	s := &server{tenants: map[string]*als{tenant.DefaultName: def, "team-a": teamA}}
+
+	if a, logName := s.tenantFor("tcp_ingress"); a != def || logName != "tcp_ingress" {
+		t.Errorf("tcp_ingress went to %p as %q", a, logName)
+	}
+
+	if a, logName := s.tenantFor("team-a/l7_ingress"); a != teamA || logName != "l7_ingress" {
+		t.Errorf("team-a/l7_ingress went to %p as %q", a, logName)
+	}
+
+	if a, _ := s.tenantFor("team-b/tcp_ingress"); a != nil {
+		t.Errorf("unknown tenant went to %p", a)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// createWildcardCert makes sure the wildcard certificate of the registrable domain of sni covers sni.
+// The certificate is re-issued with one more name whenever a host shows up at a new depth.
+func (a *als) createWildcardCert(ctx context.Context, sni string) error {
+	domain, err := hostname.Registrable(sni)
+	if err != nil {
+		log.Printf("No registrable domain for %s, creating an exact cert: %v", sni, err)
+		return a.createExactCert(ctx, sni)
+	}
+
+	name := wildcardName(sni, domain)
+	names := []string{domain, "*." + domain}
+
+	existing, err := a.store.Get(ctx, domain)
+	switch {
+	case err == nil && existing.Wildcard:
+		if containsName(existing.DNSNames, name) {
+			return a.renewAndPromote(ctx, existing)
+		}
+		names = existing.DNSNames
+	case err != nil && !errors.Is(err, certstore.ErrNotFound):
+		return fmt.Errorf("error reading certificate: %w", err)
+	}
+
+	names = wildcardNames(domain, append(names, name))
+
+	// A name constrained intermediate may only sign for sni itself
+	if !a.signer.Permits(names...) {
+		log.Printf("Wildcard cert for %s is outside the name constraints, creating an exact cert", domain)
+		return a.createExactCert(ctx, sni)
+	}
+
+	log.Printf("Creating wildcard cert for %s covering %s", domain, strings.Join(names, ", "))
+
+	out, err := a.signer.Issue(a.keysFor(domain), names...)
+	if err != nil {
+		return fmt.Errorf("error signing certificate: %w", err)
+	}
+
+	out.Wildcard = true
+	out.DNSNames = names
+	if existing != nil {
+		out.DemotedUntil = existing.DemotedUntil
+	}
+
+	if err := a.store.Put(ctx, out); err != nil {
+		return fmt.Errorf("error storing certificate: %w", err)
+	}
+
+	return nil
+}
+
+// lookup returns the certificate serving sni, which is keyed by its registrable domain when it is a wildcard.
+func (a *als) lookup(ctx context.Context, sni string) (*types.Certificate, error) {
+	if a.wildcard {
+		if domain, err := hostname.Registrable(sni); err == nil {
+			cert, err := a.store.Get(ctx, domain)
+			if err == nil && cert.Wildcard {
+				return cert, nil
+			}
+			if err != nil && !errors.Is(err, certstore.ErrNotFound) {
+				return nil, err
+			}
+		}
+	}
+
+	return a.store.Get(ctx, sni)
+}
+
+// wildcardName is the name a certificate for domain needs to cover sni, wildcards only span a single label.
+func wildcardName(sni, domain string) string {
+	if sni == domain {
+		return domain
+	}
+
+	return "*." + sni[strings.Index(sni, ".")+1:]
+}
+
+// wildcardNames dedupes and sorts names, keeping domain first as the common name.
+func wildcardNames(domain string, names []string) []string {
+	seen := map[string]bool{domain: true}
+	var wildcards []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			wildcards = append(wildcards, name)
+		}
+	}
+
+	sort.Strings(wildcards)
+	return append([]string{domain}, wildcards...)
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/signer"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestWildcardName(t *testing.T) {
+	tests := map[string]string{
+		"example.com":       "example.com",
+		"www.example.com":   "*.example.com",
+		"a.cdn.example.com": "*.cdn.example.com",
+	}
+
+	for sni, want := range tests {
+		if got := wildcardName(sni, "example.com"); got != want {
+			t.Errorf("wildcardName(%q) = %q, want %q", sni, got, want)
+		}
+	}
+}
+
+func TestCreateWildcardCert(t *testing.T) {
+	ctx := context.Background()
+	a := &als{
+		signer:   newTestSigner(t),
+		store:    certstore.NewFileStore(t.TempDir(), time.Minute),
+		wildcard: true,
+	}
+
+	for _, sni := range []string{"www.example.com", "api.example.com", "a.cdn.example.com", "foo.github.io"} {
+		if err := a.createCert(ctx, sni); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certs, err := a.store.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(certs) != 2 || certs[0].SNI != "example.com" || certs[1].SNI != "foo.github.io" {
+		t.Fatalf("unexpected certificates %v", certs)
+	}
+
+	if got := strings.Join(certs[0].DNSNames, ","); !certs[0].Wildcard || got != "example.com,*.cdn.example.com,*.example.com" {
+		t.Fatalf("unexpected names %q", got)
+	}
+
+	// Failures are attributed to the wildcard certificate
+	cert, err := a.lookup(ctx, "api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.SNI != "example.com" {
+		t.Fatalf("looked up %q", cert.SNI)
+	}
+}
+
+func TestCreateCertNameConstraints(t *testing.T) {
+	ctx := context.Background()
+
+	rootPEM, rootKeyPEM := newTestCA(t)
+	certPEM, keyPEM, err := signer.NewIntermediate(rootPEM, rootKeyPEM, signer.Intermediate{
+		CommonName:          "Constrained intermediate CA",
+		Algorithm:           types.ECDSAP256,
+		Lifetime:            time.Hour,
+		PermittedDNSDomains: []string{"www.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := signer.New(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("default: passthrough\nrules:\n- exact: www.example.com\n  action: intercept\n- suffix: example.org\n  action: intercept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &als{
+		signer:   s,
+		store:    certstore.NewFileStore(t.TempDir(), time.Minute),
+		policy:   policies,
+		wildcard: true,
+	}
+
+	// The wildcard certificate would be outside the constraints, an exact one is not
+	if err := a.createCert(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err := a.store.Get(ctx, "www.example.com"); err != nil || cert.Wildcard {
+		t.Fatalf("expected an exact certificate: %v", err)
+	}
+
+	// A rule added after the intermediate was bootstrapped is reported
+	err = a.createCert(ctx, "www.example.org")
+	var constraintErr *signer.ConstraintError
+	if !errors.As(err, &constraintErr) || !strings.Contains(err.Error(), "rule 1, suffix: example.org") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func newTestSigner(t *testing.T) *signer.Signer {
+	t.Helper()
+
+	s, err := signer.New(newTestCA(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// newTestCA returns a PEM encoded CA certificate and key.
+func newTestCA(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,107 @@
+// Command bootstrap creates an intermediate CA signed by cfssl/ca.crt that may only sign for the hosts the
+// interception policy intercepts, so that a leaked intermediate can't be used for anything else.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/signer"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+var (
+	policyFile = pflag.String("policy", "policies/policy.yaml", "Interception policy to derive the name constraints from")
+	dir        = pflag.String("dir", "cfssl", "Directory with ca.crt and ca.key, the intermediate is written there too")
+	name       = pflag.String("name", signer.DefaultIssuer, "Name of the intermediate, it is written to <name>.crt and <name>.key")
+	commonName = pflag.String("common-name", "Test intermediate CA", "Common name of the intermediate")
+	key        = pflag.String("key", string(types.RSA2048), "Key algorithm of the intermediate")
+	expiry     = pflag.Duration("expiry", 240*time.Hour, "Lifetime of the intermediate")
+	force      = pflag.Bool("force", false, "Overwrite an existing intermediate")
+)
+
+func main() {
+	pflag.Parse()
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	if *policyFile == "" {
+		return errors.New("--policy is required")
+	}
+
+	policies, err := policy.Load(*policyFile)
+	if err != nil {
+		return err
+	}
+
+	permitted, err := policies.Policy().PermittedDomains()
+	if errors.Is(err, policy.ErrUnconstrained) {
+		return fmt.Errorf("%w, set default: passthrough and list the hosts to intercept", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	algorithm := types.KeyAlgorithm(*key)
+	if err := algorithm.Valid(); err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(*dir, *name+".crt")
+	keyPath := filepath.Join(*dir, *name+".key")
+	if !*force {
+		for _, path := range []string{certPath, keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists, pass --force to overwrite it", path)
+			}
+		}
+	}
+
+	rootCertPEM, err := os.ReadFile(filepath.Join(*dir, "ca.crt"))
+	if err != nil {
+		return fmt.Errorf("error reading root CA certificate: %w", err)
+	}
+
+	rootKeyPEM, err := os.ReadFile(filepath.Join(*dir, "ca.key"))
+	if err != nil {
+		return fmt.Errorf("error reading root CA key: %w", err)
+	}
+
+	certPEM, keyPEM, err := signer.NewIntermediate(rootCertPEM, rootKeyPEM, signer.Intermediate{
+		CommonName:          *commonName,
+		Algorithm:           algorithm,
+		Lifetime:            *expiry,
+		PermittedDNSDomains: permitted,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return fmt.Errorf("error writing intermediate CA key: %w", err)
+	}
+
+	// WriteFile keeps the mode of a key we overwrite
+	if err := os.Chmod(keyPath, 0600); err != nil {
+		return fmt.Errorf("error writing intermediate CA key: %w", err)
+	}
+
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		return fmt.Errorf("error writing intermediate CA certificate: %w", err)
+	}
+
+	log.Printf("Wrote %s, permitted to sign for %s", certPath, strings.Join(permitted, ", "))
+	return nil
+}
@@ -0,0 +1,119 @@
+// Command revoke revokes the certificates minted for the given hosts and evicts them from the store.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/revocation"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+var (
+	storeURI    = pflag.String("store", "file:///app/certs", "Certificate store, file:///path/to/dir or sqlite:///path/to/file.db")
+	kekFile     = pflag.String("kek-file", "", "Base64 encoded 32 byte key to encrypt private keys in the store with, $CERTSTORE_KEK when unset")
+	revocations = pflag.String("revocations", "/app/revocations/revoked.json", "Revocation list served by als")
+	tenantName  = pflag.String("tenant", tenant.DefaultName, "Tenant whose certificates to revoke")
+	reason      = pflag.String("reason", "unspecified", "Revocation reason: unspecified, keyCompromise, caCompromise, affiliationChanged, superseded or cessationOfOperation")
+)
+
+var reasons = map[string]int{
+	"unspecified":          ocsp.Unspecified,
+	"keyCompromise":        ocsp.KeyCompromise,
+	"caCompromise":         ocsp.CACompromise,
+	"affiliationChanged":   ocsp.AffiliationChanged,
+	"superseded":           ocsp.Superseded,
+	"cessationOfOperation": ocsp.CessationOfOperation,
+}
+
+func main() {
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] host...\n", os.Args[0])
+		pflag.PrintDefaults()
+	}
+	pflag.Parse()
+
+	if pflag.NArg() == 0 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+
+	code, ok := reasons[*reason]
+	if !ok {
+		log.Fatalf("unknown revocation reason %q", *reason)
+	}
+
+	sealer, err := certstore.LoadSealer(*kekFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := certstore.OpenNamespace(*storeURI, (&tenant.Tenant{Name: *tenantName}).Namespace(), sealer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	list, err := revocation.Open(*revocations)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	failed := false
+	for _, host := range pflag.Args() {
+		cert, err := lookup(ctx, store, host)
+		if err != nil {
+			log.Printf("Error revoking %s: %v", host, err)
+			failed = true
+			continue
+		}
+
+		if err := revocation.RevokeCertificate(ctx, store, list, cert, code); err != nil {
+			log.Printf("Error revoking %s: %v", host, err)
+			failed = true
+			continue
+		}
+
+		log.Println("Revoked certificate", cert.SNI)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// lookup finds the certificate serving host, which is keyed by its registrable domain in wildcard mode.
+func lookup(ctx context.Context, store certstore.Store, host string) (*types.Certificate, error) {
+	sni, err := hostname.Normalize(host)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := store.Get(ctx, sni)
+	if !errors.Is(err, certstore.ErrNotFound) {
+		return cert, err
+	}
+
+	domain, domainErr := hostname.Registrable(sni)
+	if domainErr != nil || domain == sni {
+		return nil, err
+	}
+
+	wildcard, domainErr := store.Get(ctx, domain)
+	if domainErr != nil || !wildcard.Wildcard {
+		return nil, err
+	}
+
+	return wildcard, nil
+}
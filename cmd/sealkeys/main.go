@@ -0,0 +1,71 @@
+// Command sealkeys rewrites every certificate in the store so that its private keys are encrypted with the
+// key-encryption key, e.g. to migrate a store written before encryption was turned on. --decrypt reverts it.
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/pflag"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/tenant"
+)
+
+var (
+	storeURI   = pflag.String("store", "file:///app/certs", "Certificate store, file:///path/to/dir or sqlite:///path/to/file.db")
+	kekFile    = pflag.String("kek-file", "", "Base64 encoded 32 byte key to encrypt private keys in the store with, $CERTSTORE_KEK when unset")
+	tenantName = pflag.String("tenant", tenant.DefaultName, "Tenant whose keys to re-seal")
+	decrypt    = pflag.Bool("decrypt", false, "Write the private keys back in plaintext")
+)
+
+func main() {
+	pflag.Parse()
+
+	sealer, err := certstore.LoadSealer(*kekFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sealer == nil {
+		log.Fatalf("no key-encryption key, pass --kek-file or set $%s", certstore.KEKEnv)
+	}
+
+	namespace := (&tenant.Tenant{Name: *tenantName}).Namespace()
+
+	// Reads both plaintext and encrypted keys
+	src, err := certstore.OpenNamespace(*storeURI, namespace, sealer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer src.Close()
+
+	dstSealer := sealer
+	if *decrypt {
+		dstSealer = nil
+	}
+
+	dst, err := certstore.OpenNamespace(*storeURI, namespace, dstSealer)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dst.Close()
+
+	ctx := context.Background()
+
+	certs, err := src.List(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, cert := range certs {
+		if err := dst.Put(ctx, cert); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *decrypt {
+		log.Printf("Decrypted the keys of %d certificates", len(certs))
+	} else {
+		log.Printf("Encrypted the keys of %d certificates", len(certs))
+	}
+}
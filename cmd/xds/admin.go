@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	envoy_resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+
+	"github.com/epk/envoy-egress-mitm/cmd/xds/reconciler"
+)
+
+const (
+	quarantinePath = "/quarantine"
+	resourcesPath  = "/resources/"
+)
+
+// resourceTypes are the type URLs served below resourcesPath
+var resourceTypes = map[string]string{
+	"clusters":  envoy_resource_v3.ClusterType,
+	"listeners": envoy_resource_v3.ListenerType,
+	"secrets":   envoy_resource_v3.SecretType,
+}
+
+// serveAdmin serves the admin API of r on addr.
+func serveAdmin(r *reconciler.Reconciler, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for admin requests: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           adminHandler(r),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		log.Println("Serving admin API on", lis.Addr())
+		if err := srv.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return nil
+}
+
+// adminHandler serves:
+//
+//	GET /snapshot                     the current snapshot version and the versions kept to diff against
+//	GET /nodes                        the connected nodes and how they answered the last responses
+//	GET /resources/<type>             the clusters, listeners or secrets of the current snapshot as YAML,
+//	                                  ?version=<version> picks an older one, ?diff=<version> diffs against it
+//	GET /quarantine                   the certificates Envoy rejected
+//	DELETE /quarantine/<tenant>/<sni> serve a quarantined certificate again
+//
+// Snapshots are those of nodes without group metadata, ?group=<group> as listed by /nodes picks another group.
+func adminHandler(r *reconciler.Reconciler) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/snapshot", get(func(w http.ResponseWriter, req *http.Request) {
+		g, err := reconciler.ParseGroup(req.URL.Query().Get("group"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snapshots, err := r.Snapshots(g)
+		if errors.Is(err, reconciler.ErrUnknownGroup) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if len(snapshots) == 0 {
+			http.Error(w, "no snapshot yet", http.StatusNotFound)
+			return
+		}
+
+		versions := make([]uint64, 0, len(snapshots))
+		for _, s := range snapshots {
+			versions = append(versions, s.Version)
+		}
+
+		writeJSON(w, struct {
+			reconciler.Snapshot
+			History []uint64 `json:"history"`
+		}{snapshots[len(snapshots)-1], versions})
+	}))
+
+	mux.HandleFunc("/nodes", get(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, r.Nodes())
+	}))
+
+	mux.HandleFunc(resourcesPath, get(func(w http.ResponseWriter, req *http.Request) {
+		typeURL, ok := resourceTypes[strings.TrimPrefix(req.URL.Path, resourcesPath)]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		g, err := reconciler.ParseGroup(req.URL.Query().Get("group"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		version, err := versionParam(req, "version")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		diff, err := versionParam(req, "diff")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var out []byte
+		if diff == 0 {
+			out, err = r.Render(g, typeURL, version)
+		} else {
+			var d string
+			d, err = r.Diff(g, typeURL, diff, version)
+			out = []byte(d)
+		}
+
+		switch {
+		case errors.Is(err, reconciler.ErrUnknownVersion), errors.Is(err, reconciler.ErrUnknownGroup):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			log.Println("Error rendering resources:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := w.Write(out); err != nil {
+			log.Println("Error writing admin response:", err)
+		}
+	}))
+
+	mux.HandleFunc(quarantinePath, get(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, r.Quarantined())
+	}))
+
+	mux.HandleFunc(quarantinePath+"/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tenantName, sni, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, quarantinePath+"/"), "/")
+		if !ok || tenantName == "" || sni == "" {
+			http.Error(w, "want "+quarantinePath+"/<tenant>/<sni>", http.StatusBadRequest)
+			return
+		}
+
+		if !r.Release(tenantName, sni) {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+// get only lets GET requests through to h.
+func get(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		h(w, req)
+	}
+}
+
+// versionParam parses the snapshot version in query parameter name, 0 when it is missing.
+func versionParam(req *http.Request, name string) (uint64, error) {
+	value := req.URL.Query().Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+
+	return version, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Error writing admin response:", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/cmd/xds/reconciler"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestAdmin(t *testing.T) {
+	r := reconciler.New(builders.New())
+	if err := r.Reconcile(context.Background(), []*reconciler.Tenant{{
+		Tenant: tenant.Default(),
+		Certs:  []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	h := adminHandler(r)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quarantine", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	var quarantined []reconciler.Quarantine
+	if err := json.NewDecoder(rec.Body).Decode(&quarantined); err != nil || len(quarantined) != 0 {
+		t.Fatalf("got %v, %v", quarantined, err)
+	}
+
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{method: http.MethodDelete, path: "/quarantine/default/example.com", want: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/quarantine/default", want: http.StatusBadRequest},
+		{method: http.MethodPost, path: "/quarantine", want: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: "/quarantine/default/example.com", want: http.StatusMethodNotAllowed},
+		{method: http.MethodGet, path: "/snapshot", want: http.StatusOK},
+		{method: http.MethodGet, path: "/snapshot?group=all", want: http.StatusOK},
+		{method: http.MethodGet, path: "/snapshot?group=shard=0/2", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/snapshot?group=region", want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/nodes", want: http.StatusOK},
+		{method: http.MethodGet, path: "/resources/secrets", want: http.StatusOK},
+		{method: http.MethodGet, path: "/resources/secrets?diff=1", want: http.StatusOK},
+		{method: http.MethodGet, path: "/resources/secrets?version=2", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/resources/secrets?diff=x", want: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/resources/secrets?group=tenant=team-a", want: http.StatusNotFound},
+		{method: http.MethodGet, path: "/resources/routes", want: http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
+	"time"
 
+	"github.com/spf13/pflag"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
@@ -16,58 +19,184 @@ import (
 	envoy_service_route_v3 "github.com/envoyproxy/go-control-plane/envoy/service/route/v3"
 	envoy_service_runtime_v3 "github.com/envoyproxy/go-control-plane/envoy/service/runtime/v3"
 	envoy_service_secret_v3 "github.com/envoyproxy/go-control-plane/envoy/service/secret/v3"
-	envoy_cache_v3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	envoy_server_v3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 
-	"github.com/epk/envoy-egress-mitm/cmd/xds/certstore"
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/certstore"
 	"github.com/epk/envoy-egress-mitm/cmd/xds/reconciler"
+	"github.com/epk/envoy-egress-mitm/config"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/tenant"
 )
 
-const (
-	certsDir = "/app/certs"
+var (
+	cfg = config.Default()
+
+	kekFile     = pflag.String("kek-file", "", "Base64 encoded 32 byte key to encrypt private keys in the store with, $CERTSTORE_KEK when unset")
+	policyFile  = pflag.String("policy", "", "Interception policy file of the default tenant, every host is intercepted when unset")
+	tenantsFile = pflag.String("tenants", "", "Tenants to serve besides the default one, each on its own listener")
+	adminListen = pflag.String("admin-listen", "127.0.0.1:9090", "Address to serve the unauthenticated admin API on, disabled when empty")
+	batchDelay  = pflag.Duration("batch-delay", time.Second, "How long to wait for more changes before reconciling, 0 reconciles every change on its own")
 )
 
+// tenantSource is where the certificates and policy of a tenant come from.
+type tenantSource struct {
+	tenant   *tenant.Tenant
+	store    certstore.Store
+	policies *policy.File
+}
+
+// forward coalesces the notifications on from into to, until from is closed.
+func forward(from <-chan struct{}, to chan<- struct{}) {
+	for range from {
+		select {
+		case to <- struct{}{}:
+		default:
+		}
+	}
+}
+
 func main() {
+	cfg.Flags(pflag.CommandLine)
+	pflag.Parse()
+
+	if err := cfg.Load(pflag.CommandLine); err != nil {
+		log.Fatal(err)
+	}
+
 	ctx := context.Background()
 
-	// Create cache
-	cache := envoy_cache_v3.NewSnapshotCache(true, envoy_cache_v3.IDHash{}, nil)
+	opts := []builders.Option{
+		builders.WithALS(cfg.ALSHost, cfg.ALSPort),
+		builders.WithUpstreamPort(cfg.UpstreamPort),
+		builders.WithKeyLogDir(cfg.KeyLogDir),
+		builders.WithTrustBundle(cfg.TrustBundle),
+	}
+	if cfg.OriginalDst {
+		opts = append(opts, builders.WithOriginalDst(cfg.Transparent))
+	}
 
-	store := certstore.NewConfigStore(certsDir)
+	// Create reconciler, it owns the xDS cache
+	r := reconciler.New(builders.New(opts...))
 
-	go func() {
-		updateCh, err := store.StartWatcher()
+	sealer, err := certstore.LoadSealer(*kekFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	def := tenant.Default()
+	def.Port = cfg.ListenerPort
+	def.ConnectPort = cfg.ConnectPort
+	def.HTTPPort = cfg.HTTPPort
+	def.Policy = *policyFile
+
+	extra, err := tenant.Load(*tenantsFile, def)
+	if err != nil {
+		log.Fatal(err)
+	}
 
+	// Any change to the store or a policy reconciles every tenant
+	changed := make(chan struct{}, 1)
+
+	var sources []*tenantSource
+	for _, t := range append([]*tenant.Tenant{def}, extra...) {
+		store, err := certstore.OpenNamespace(cfg.Store, t.Namespace(), sealer)
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer store.Close()
 
+		policies, err := policy.Load(t.Policy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// Watch loads every certificate already in the store so the first snapshot includes them
+		updateCh, err := store.Watch(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		policyCh, err := policies.Watch(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go forward(updateCh, changed)
+		go forward(policyCh, changed)
+
+		log.Printf("Serving tenant %s on port %d", t.Name, t.Port)
+		if cfg.OriginalDst && t.ConnectPort != 0 {
+			log.Printf("Warning: tenant %s: CONNECT tunnels on port %d go straight upstream with original_dst, they aren't intercepted", t.Name, t.ConnectPort)
+		}
+		sources = append(sources, &tenantSource{tenant: t, store: store, policies: policies})
+	}
+
+	reconcile := func() error {
+		tenants := make([]*reconciler.Tenant, 0, len(sources))
+		for _, source := range sources {
+			certs, err := source.store.List(ctx)
+			if err != nil {
+				return fmt.Errorf("error listing certificates of tenant %s: %w", source.tenant.Name, err)
+			}
+
+			tenants = append(tenants, &reconciler.Tenant{
+				Tenant: source.tenant,
+				Certs:  certs,
+				Policy: source.policies.Policy(),
+			})
+		}
+
+		return r.Reconcile(ctx, tenants)
+	}
+
+	go func() {
 		for {
 			select {
 			case <-ctx.Done(): // superficial
 				return
-			case <-updateCh:
-				err := reconciler.Reconcile(ctx, cache, store.List())
-				if err != nil {
-					log.Println("Error reconciling: ", err)
+			case <-changed:
+			}
+
+			// Every new host changes the listener, hosts minted in a burst are pushed with a single listener
+			if *batchDelay > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(*batchDelay):
+				}
+
+				// Changes made while waiting are part of this reconcile
+				select {
+				case <-changed:
+				default:
 				}
 			}
+
+			if err := reconcile(); err != nil {
+				log.Println("Error reconciling:", err)
+			}
 		}
 	}()
 
 	// Perform initial snapshot update
-	err := reconciler.Reconcile(ctx, cache, nil)
-	if err != nil {
+	if err := reconcile(); err != nil {
 		log.Fatal(err)
 	}
 
+	if *adminListen != "" {
+		if err := serveAdmin(r, *adminListen); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Create gRPC server
 	srv := grpc.NewServer()
 	// Register gRPC healthcheck
 	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
 
 	// Create xDS server
-	srv3 := envoy_server_v3.NewServer(ctx, cache, envoy_server_v3.CallbackFuncs{})
+	srv3 := envoy_server_v3.NewServer(ctx, r.Cache(), r.Callbacks())
 	// Register services
 	envoy_service_discovery_v3.RegisterAggregatedDiscoveryServiceServer(srv, srv3)
 	envoy_service_secret_v3.RegisterSecretDiscoveryServiceServer(srv, srv3)
@@ -77,7 +206,7 @@ func main() {
 	envoy_service_route_v3.RegisterRouteDiscoveryServiceServer(srv, srv3)
 	envoy_service_runtime_v3.RegisterRuntimeDiscoveryServiceServer(srv, srv3)
 
-	lis, err := net.Listen("tcp", ":50051")
+	lis, err := net.Listen("tcp", cfg.GRPCListen)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,382 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	envoy_cache_v3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	envoy_stream_v3 "github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	envoy_server_v3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// groupIdleTimeout is how long a group is kept after its last node disconnected
+const groupIdleTimeout = time.Hour
+
+const (
+	// TenantMetadataKey limits a node to the listener of a single tenant
+	TenantMetadataKey = "tenant"
+	// ShardMetadataKey limits a node to a shard of the hosts, "<shard>/<shards>" like "0/3"
+	ShardMetadataKey = "shard"
+)
+
+// Group is the part of the config a set of nodes receives, selected by their metadata.
+// The zero Group serves everything.
+type Group struct {
+	// Tenant limits the group to one tenant, every tenant is served when empty
+	Tenant string
+	// Shard is the shard of hosts the group intercepts, every host is intercepted when Shards is 0.
+	// Hosts of other shards go through L4 passthrough.
+	Shard, Shards int
+}
+
+// GroupOf returns the group node belongs to according to its metadata. Only TenantMetadataKey and
+// ShardMetadataKey change the config, other metadata such as a region is ignored.
+func GroupOf(node *envoy_core_v3.Node) (Group, error) {
+	fields := node.GetMetadata().GetFields()
+
+	g := Group{
+		Tenant: fields[TenantMetadataKey].GetStringValue(),
+	}
+
+	if shard := fields[ShardMetadataKey].GetStringValue(); shard != "" {
+		if err := g.parseShard(shard); err != nil {
+			return Group{}, err
+		}
+	}
+
+	return g, nil
+}
+
+// ParseGroup parses a group the way String formats it.
+func ParseGroup(s string) (Group, error) {
+	var g Group
+	if s == "" || s == "all" {
+		return g, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(part, "=")
+		switch {
+		case ok && key == TenantMetadataKey:
+			g.Tenant = value
+		case ok && key == ShardMetadataKey:
+			if err := g.parseShard(value); err != nil {
+				return Group{}, err
+			}
+		default:
+			return Group{}, fmt.Errorf("invalid group %q, want %s=<tenant>,%s=<shard>/<shards>", s, TenantMetadataKey, ShardMetadataKey)
+		}
+	}
+
+	return g, nil
+}
+
+// parseShard sets the shard of g from "<shard>/<shards>".
+func (g *Group) parseShard(shard string) error {
+	index, count, ok := strings.Cut(shard, "/")
+	if !ok {
+		return fmt.Errorf("invalid shard %q, want <shard>/<shards>", shard)
+	}
+
+	var err error
+	if g.Shard, err = strconv.Atoi(index); err != nil {
+		return fmt.Errorf("invalid shard %q: %w", shard, err)
+	}
+	if g.Shards, err = strconv.Atoi(count); err != nil {
+		return fmt.Errorf("invalid shard %q: %w", shard, err)
+	}
+
+	if g.Shards < 1 || g.Shard < 0 || g.Shard >= g.Shards {
+		return fmt.Errorf("invalid shard %q", shard)
+	}
+
+	return nil
+}
+
+func (g Group) String() string {
+	var parts []string
+	if g.Tenant != "" {
+		parts = append(parts, "tenant="+g.Tenant)
+	}
+	if g.Shards > 0 {
+		parts = append(parts, fmt.Sprintf("shard=%d/%d", g.Shard, g.Shards))
+	}
+
+	if len(parts) == 0 {
+		return "all"
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (g Group) MarshalText() ([]byte, error) {
+	return []byte(g.String()), nil
+}
+
+// Owns reports whether hosts keyed by sni are intercepted by the group. Wildcard certificates are sharded
+// by the domain they are keyed by, so every host below it lands on the same shard.
+func (g Group) Owns(sni string) bool {
+	if g.Shards == 0 {
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(sni))
+	return int(h.Sum32()%uint32(g.Shards)) == g.Shard
+}
+
+// filter returns the tenants and certificates the group serves.
+func (g Group) filter(tenants []*Tenant) []*Tenant {
+	if g == (Group{}) {
+		return tenants
+	}
+
+	var out []*Tenant
+	for _, t := range tenants {
+		if g.Tenant != "" && t.Name != g.Tenant {
+			continue
+		}
+
+		var certs []*types.Certificate
+		for _, cert := range t.Certs {
+			if g.Owns(cert.SNI) {
+				certs = append(certs, cert)
+			}
+		}
+
+		out = append(out, &Tenant{Tenant: t.Tenant, Certs: certs, Policy: t.Policy})
+	}
+
+	return out
+}
+
+// stream is a connected xDS stream.
+type stream struct {
+	node  *envoy_core_v3.Node
+	group Group
+	// responses waiting for an ACK or NACK by nonce
+	responses map[string]*response
+	// states are the answers to the last responses by type URL
+	states map[string]*ResourceState
+}
+
+// Node is an Envoy connected to the xDS server.
+type Node struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster"`
+	Group   Group  `json:"group"`
+	// Streams is the number of open xDS streams, one with ADS
+	Streams int `json:"streams"`
+	// Resources is how the node answered the last response of each type URL
+	Resources map[string]ResourceState `json:"resources"`
+}
+
+// ResourceState is how a node answered the last response of a resource type.
+type ResourceState struct {
+	// Version is the version_info of the last response the node ACKed
+	Version string `json:"version,omitempty"`
+	// Error is the reason of the last NACK, cleared by the next ACK
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// Nodes returns the connected nodes sorted by ID.
+func (r *Reconciler) Nodes() []Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byID := map[string]*Node{}
+	for _, s := range r.streams {
+		n, ok := byID[s.node.GetId()]
+		if !ok {
+			n = &Node{ID: s.node.GetId(), Cluster: s.node.GetCluster(), Group: s.group, Resources: map[string]ResourceState{}}
+			byID[n.ID] = n
+		}
+		n.Streams++
+
+		for typeURL, state := range s.states {
+			if current, ok := n.Resources[typeURL]; !ok || state.Updated.After(current.Updated) {
+				n.Resources[typeURL] = *state
+			}
+		}
+	}
+
+	nodes := make([]Node, 0, len(byID))
+	for _, n := range byID {
+		nodes = append(nodes, *n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+
+	return nodes
+}
+
+// Callbacks track the nodes connected to the xDS server and the groups they belong to.
+// Streams of nodes with invalid group metadata are refused. Certificates Envoy rejects are quarantined.
+func (r *Reconciler) Callbacks() envoy_server_v3.Callbacks {
+	return envoy_server_v3.CallbackFuncs{
+		StreamRequestFunc: func(id int64, req *envoy_discovery_v3.DiscoveryRequest) error {
+			return r.request(id, req.GetNode(), req.GetResponseNonce(), req.GetErrorDetail())
+		},
+		StreamDeltaRequestFunc: func(id int64, req *envoy_discovery_v3.DeltaDiscoveryRequest) error {
+			return r.request(id, req.GetNode(), req.GetResponseNonce(), req.GetErrorDetail())
+		},
+		// Responses only carry serialized resources, the names come from the request, or the snapshot of the
+		// version for wildcard requests, rather than unmarshaling every resource of every response
+		StreamResponseFunc: func(_ context.Context, id int64, req *envoy_discovery_v3.DiscoveryRequest, resp *envoy_discovery_v3.DiscoveryResponse) {
+			var names []string
+			if len(req.GetResourceNames()) > 0 {
+				names = req.GetResourceNames()
+			}
+
+			r.sent(id, resp.GetNonce(), resp.GetTypeUrl(), resp.GetVersionInfo(), names)
+		},
+		StreamDeltaResponseFunc: func(id int64, _ *envoy_discovery_v3.DeltaDiscoveryRequest, resp *envoy_discovery_v3.DeltaDiscoveryResponse) {
+			names := make([]string, 0, len(resp.GetResources()))
+			for _, res := range resp.GetResources() {
+				names = append(names, res.GetName())
+			}
+
+			r.sent(id, resp.GetNonce(), resp.GetTypeUrl(), resp.GetSystemVersionInfo(), names)
+		},
+		StreamClosedFunc:      r.disconnect,
+		DeltaStreamClosedFunc: r.disconnect,
+	}
+}
+
+// request registers the stream on its first request and handles the ACK or NACK every request carries.
+func (r *Reconciler) request(id int64, node *envoy_core_v3.Node, nonce string, detail *status.Status) error {
+	if err := r.connect(id, node); err != nil {
+		return err
+	}
+
+	// The stream waits for us, the new snapshot can only be pushed once we return
+	if r.answered(id, node, nonce, detail) {
+		go r.requeue()
+	}
+
+	return nil
+}
+
+// connect registers the stream of node on its first request.
+func (r *Reconciler) connect(id int64, node *envoy_core_v3.Node) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.streams[id]; ok {
+		return nil
+	}
+
+	g, err := GroupOf(node)
+	if err != nil {
+		log.Printf("Refusing node %s: %v", node.GetId(), err)
+		return err
+	}
+
+	r.streams[id] = &stream{node: node, group: g, responses: map[string]*response{}, states: map[string]*ResourceState{}}
+	existing := r.groupLocked(g)
+	existing.streams++
+	existing.idle = time.Time{}
+
+	log.Printf("Node %s connected, group %s", node.GetId(), g)
+	return nil
+}
+
+func (r *Reconciler) disconnect(id int64, node *envoy_core_v3.Node) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.streams[id]
+	if !ok {
+		return
+	}
+	delete(r.streams, id)
+
+	log.Printf("Node %s disconnected", node.GetId())
+
+	// Nodes reconnect to the group they left, with its versions and snapshots, unless it was evicted meanwhile
+	if g := r.groups[s.group]; g != nil {
+		g.streams--
+		if g.streams == 0 {
+			g.idle = time.Now()
+		}
+	}
+}
+
+// evictIdle stops reconciling groups no node connected to for groupIdleTimeout,
+// the group of nodes without metadata always stays.
+func (r *Reconciler) evictIdle(now time.Time) {
+	for key, g := range r.groups {
+		if key != (Group{}) && g.streams == 0 && !g.idle.IsZero() && now.Sub(g.idle) > groupIdleTimeout {
+			log.Printf("Evicting group %s, no node connected since %s", key, g.idle.Format(time.RFC3339))
+			delete(r.groups, key)
+		}
+	}
+}
+
+// group returns the group of node, creating it from the last reconciled tenants if it is new.
+func (r *Reconciler) group(node *envoy_core_v3.Node) (*group, error) {
+	g, err := GroupOf(node)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.groupLocked(g), nil
+}
+
+func (r *Reconciler) groupLocked(g Group) *group {
+	if existing, ok := r.groups[g]; ok {
+		return existing
+	}
+
+	created := r.newGroup(g)
+	if _, err := created.reconcile(g.filter(r.tenants)); err != nil {
+		log.Printf("Error building config of group %s: %v", g, err)
+	}
+	r.groups[g] = created
+
+	return created
+}
+
+var _ envoy_cache_v3.Cache = &Reconciler{}
+
+func (r *Reconciler) CreateWatch(req *envoy_cache_v3.Request, state envoy_stream_v3.StreamState, value chan envoy_cache_v3.Response) func() {
+	g, err := r.group(req.GetNode())
+	if err != nil {
+		// The callbacks refuse the stream before it gets here
+		log.Printf("Not watching %s for node %s: %v", req.GetTypeUrl(), req.GetNode().GetId(), err)
+		return nil
+	}
+
+	return g.mux.CreateWatch(req, state, value)
+}
+
+func (r *Reconciler) CreateDeltaWatch(req *envoy_cache_v3.DeltaRequest, state envoy_stream_v3.StreamState, value chan envoy_cache_v3.DeltaResponse) func() {
+	g, err := r.group(req.GetNode())
+	if err != nil {
+		log.Printf("Not watching %s for node %s: %v", req.GetTypeUrl(), req.GetNode().GetId(), err)
+		return nil
+	}
+
+	return g.mux.CreateDeltaWatch(req, state, value)
+}
+
+func (r *Reconciler) Fetch(ctx context.Context, req *envoy_cache_v3.Request) (envoy_cache_v3.Response, error) {
+	return nil, errors.New("fetch is not supported")
+}
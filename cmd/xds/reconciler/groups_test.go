@@ -0,0 +1,245 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_cache_v3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	envoy_resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	envoy_stream_v3 "github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestGroupOf(t *testing.T) {
+	tests := []struct {
+		metadata map[string]any
+		want     Group
+		wantErr  bool
+	}{
+		{metadata: nil, want: Group{}},
+		{metadata: map[string]any{"region": "eu"}, want: Group{}},
+		{metadata: map[string]any{"tenant": "team-a"}, want: Group{Tenant: "team-a"}},
+		{metadata: map[string]any{"tenant": "team-a", "shard": "1/3"}, want: Group{Tenant: "team-a", Shard: 1, Shards: 3}},
+		{metadata: map[string]any{"shard": "3/3"}, wantErr: true},
+		{metadata: map[string]any{"shard": "1"}, wantErr: true},
+		{metadata: map[string]any{"shard": "a/b"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := GroupOf(testNode(t, "envoy", tt.metadata))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v: got error %v", tt.metadata, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("%v: got group %s, want %s", tt.metadata, got, tt.want)
+		}
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	for _, g := range []Group{{}, {Tenant: "team-a"}, {Shard: 1, Shards: 3}, {Tenant: "team-a", Shard: 0, Shards: 2}} {
+		got, err := ParseGroup(g.String())
+		if err != nil || got != g {
+			t.Errorf("%s: got %s, %v", g, got, err)
+		}
+	}
+
+	for _, s := range []string{"region=eu", "shard=2/2", "tenant"} {
+		if _, err := ParseGroup(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
+
+func TestGroupShards(t *testing.T) {
+	shards := []Group{{Shard: 0, Shards: 3}, {Shard: 1, Shards: 3}, {Shard: 2, Shards: 3}}
+
+	for i := 0; i < 100; i++ {
+		sni := fmt.Sprintf("host-%d.example.com", i)
+
+		owners := 0
+		for _, g := range shards {
+			if g.Owns(sni) {
+				owners++
+			}
+		}
+
+		if owners != 1 {
+			t.Fatalf("%s is owned by %d shards", sni, owners)
+		}
+	}
+}
+
+func TestReconcileGroups(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+
+	var certs []*types.Certificate
+	for i := 0; i < 10; i++ {
+		certs = append(certs, &types.Certificate{SNI: fmt.Sprintf("host-%d.example.com", i), Cert: []byte("cert"), Key: []byte("key")})
+	}
+
+	teamA := &tenant.Tenant{Name: "team-a", Port: 9443}
+	if err := r.Reconcile(ctx, []*Tenant{
+		{Tenant: tenant.Default(), Certs: certs},
+		{Tenant: teamA, Certs: certs[:1]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes of a new group get the config of the last Reconcile right away
+	if err := r.connect(1, testNode(t, "envoy-0", map[string]any{"shard": "0/2"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.connect(2, testNode(t, "envoy-1", map[string]any{"shard": "1/2"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.connect(3, testNode(t, "envoy-a", map[string]any{"tenant": "team-a"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.connect(4, testNode(t, "envoy-x", map[string]any{"shard": "2/2"})); err == nil {
+		t.Fatal("node with an invalid shard connected")
+	}
+
+	if nodes := r.Nodes(); len(nodes) != 3 || nodes[0].ID != "envoy-0" || nodes[2].Group != (Group{Tenant: "team-a"}) {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+
+	// Every host is served by exactly one shard
+	shard0 := r.groups[Group{Shard: 0, Shards: 2}].caches[envoy_resource_v3.SecretType].GetResources()
+	shard1 := r.groups[Group{Shard: 1, Shards: 2}].caches[envoy_resource_v3.SecretType].GetResources()
+	if len(shard0) == 0 || len(shard1) == 0 || len(shard0)+len(shard1) != 11 {
+		t.Fatalf("shards serve %d and %d secrets", len(shard0), len(shard1))
+	}
+	for name := range shard0 {
+		if _, ok := shard1[name]; ok {
+			t.Fatalf("%s is served by both shards", name)
+		}
+	}
+
+	assertGroupResources(t, r, Group{Tenant: "team-a"}, envoy_resource_v3.ListenerType, "team-a/listener_0")
+	assertGroupResources(t, r, Group{Tenant: "team-a"}, envoy_resource_v3.SecretType, "team-a/host-0.example.com")
+
+	// Later reconciles update every group
+	if err := r.Reconcile(ctx, []*Tenant{
+		{Tenant: tenant.Default(), Certs: certs},
+		{Tenant: teamA, Certs: certs[:2]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertGroupResources(t, r, Group{Tenant: "team-a"}, envoy_resource_v3.SecretType, "team-a/host-0.example.com", "team-a/host-1.example.com")
+
+	// The group outlives its last node, a reconnecting node keeps its versions and snapshots
+	r.disconnect(3, testNode(t, "envoy-a", nil))
+	teamAGroup := r.groups[Group{Tenant: "team-a"}]
+	if teamAGroup == nil {
+		t.Fatal("group went away with its last node")
+	}
+	if err := r.connect(5, testNode(t, "envoy-a", map[string]any{"tenant": "team-a"})); err != nil {
+		t.Fatal(err)
+	}
+	if r.groups[Group{Tenant: "team-a"}] != teamAGroup || !teamAGroup.idle.IsZero() {
+		t.Fatal("reconnecting node got a new group")
+	}
+
+	// Until nothing connected to it for groupIdleTimeout
+	r.disconnect(5, testNode(t, "envoy-a", nil))
+	teamAGroup.idle = time.Now().Add(-groupIdleTimeout - time.Minute)
+	if err := r.Reconcile(ctx, []*Tenant{{Tenant: tenant.Default(), Certs: certs}, {Tenant: teamA, Certs: certs[:2]}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.groups[Group{Tenant: "team-a"}]; ok {
+		t.Fatal("idle group is still reconciled")
+	}
+	if _, ok := r.groups[Group{}]; !ok {
+		t.Fatal("group of nodes without metadata was evicted")
+	}
+}
+
+func TestReconnectAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	node := testNode(t, "envoy", nil)
+
+	// The node ACKed the third version of the secret and the first listener of the previous process
+	before := New(builders.New())
+	for i := 0; i < 3; i++ {
+		certs := []*types.Certificate{{SNI: "example.com", Cert: []byte{byte(i)}, Key: []byte("key")}}
+		if i == 0 {
+			certs = append(certs, &types.Certificate{SNI: "example2.com", Cert: []byte("cert"), Key: []byte("key")})
+		}
+		if err := before.Reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshots, err := before.Snapshots(Group{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acked := snapshots[0].VersionInfo
+	acked[envoy_resource_v3.SecretType] = snapshots[len(snapshots)-1].VersionInfo[envoy_resource_v3.SecretType]
+
+	// The restarted process counts from 1 again, with a renewed certificate and a listener without example2.com
+	after := New(builders.New())
+	certs := []*types.Certificate{{SNI: "example.com", Cert: []byte("renewed"), Key: []byte("key")}}
+	if err := after.Reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, req := range []*envoy_cache_v3.Request{
+		{Node: node, TypeUrl: envoy_resource_v3.SecretType, VersionInfo: acked[envoy_resource_v3.SecretType], ResourceNames: []string{"example.com"}},
+		{Node: node, TypeUrl: envoy_resource_v3.ListenerType, VersionInfo: acked[envoy_resource_v3.ListenerType]},
+	} {
+		value := make(chan envoy_cache_v3.Response, 1)
+		if cancel := after.CreateWatch(req, envoy_stream_v3.NewStreamState(false, nil), value); cancel != nil {
+			cancel()
+		}
+
+		select {
+		case resp := <-value:
+			if resp == nil {
+				t.Fatalf("%s: no response", req.GetTypeUrl())
+			}
+		default:
+			t.Fatalf("%s: version %s of the previous process is taken for up to date", req.GetTypeUrl(), req.GetVersionInfo())
+		}
+	}
+}
+
+func testNode(t *testing.T, id string, metadata map[string]any) *envoy_core_v3.Node {
+	t.Helper()
+
+	node := &envoy_core_v3.Node{Id: id}
+	if metadata != nil {
+		s, err := structpb.NewStruct(metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Metadata = s
+	}
+
+	return node
+}
+
+func assertGroupResources(t *testing.T, r *Reconciler, g Group, typeURL string, want ...string) {
+	t.Helper()
+
+	got := r.groups[g].caches[typeURL].GetResources()
+	if len(got) != len(want) {
+		t.Fatalf("%s %s: got %d resources, want %v", g, typeURL, len(got), want)
+	}
+
+	for _, name := range want {
+		if _, ok := got[name]; !ok {
+			t.Fatalf("%s %s: missing resource %q", g, typeURL, name)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package reconciler
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/tenant"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// Quarantine is a certificate Envoy rejected. It is left out of every snapshot until it changes or is released,
+// otherwise Envoy would reject every later snapshot too.
+type Quarantine struct {
+	Tenant string `json:"tenant"`
+	SNI    string `json:"sni"`
+	// Node rejected Resource of TypeURL with Error
+	Node     string    `json:"node"`
+	TypeURL  string    `json:"type_url"`
+	Resource string    `json:"resource"`
+	Error    string    `json:"error"`
+	Since    time.Time `json:"since"`
+
+	// cert is the rejected certificate, a renewed one gets another chance
+	cert []byte
+}
+
+type certKey struct {
+	tenant, sni string
+}
+
+// response is what was sent to a stream, until Envoy ACKs or NACKs it.
+type response struct {
+	group   Group
+	typeURL string
+	version string
+	// names are nil for wildcard responses, which carried every resource of the version
+	names []string
+}
+
+// Quarantined returns the quarantined certificates sorted by tenant and SNI.
+func (r *Reconciler) Quarantined() []Quarantine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]Quarantine, 0, len(r.quarantine))
+	for _, q := range r.quarantine {
+		out = append(out, *q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Tenant != out[j].Tenant {
+			return out[i].Tenant < out[j].Tenant
+		}
+		return out[i].SNI < out[j].SNI
+	})
+
+	return out
+}
+
+// Release lifts the quarantine of the certificate of sni in tenantName and serves it again.
+// It returns false if the certificate isn't quarantined.
+func (r *Reconciler) Release(tenantName, sni string) bool {
+	r.mu.Lock()
+	key := certKey{tenant: tenantName, sni: sni}
+	_, ok := r.quarantine[key]
+	delete(r.quarantine, key)
+	r.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	log.Printf("Releasing %s of tenant %s from quarantine", sni, tenantName)
+	r.requeue()
+	return true
+}
+
+// quarantined returns the quarantine of cert, unless cert changed since it was rejected.
+func (r *Reconciler) quarantined(t *tenant.Tenant, cert *types.Certificate) *Quarantine {
+	key := certKey{tenant: t.Name, sni: cert.SNI}
+
+	q, ok := r.quarantine[key]
+	if !ok {
+		return nil
+	}
+
+	if !bytes.Equal(q.cert, cert.Cert) {
+		log.Printf("Certificate of %s changed, lifting its quarantine", t.Qualify(cert.SNI))
+		delete(r.quarantine, key)
+		return nil
+	}
+
+	return q
+}
+
+// sent records the resources of a response to stream id until Envoy answers it, nil names for every
+// resource of version.
+func (r *Reconciler) sent(id int64, nonce, typeURL, version string, names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.streams[id]; ok {
+		s.responses[nonce] = &response{group: s.group, typeURL: typeURL, version: version, names: names}
+	}
+}
+
+// responseNames returns the names of the resources in res. Wildcard responses are only resolved once
+// rejected, from the snapshot of the version they carried or the cache if it is no longer kept.
+func (r *Reconciler) responseNames(res *response) []string {
+	if res.names != nil {
+		return res.names
+	}
+
+	g, ok := r.groups[res.group]
+	if !ok {
+		return nil
+	}
+
+	resources := g.caches[res.typeURL].GetResources()
+	for _, s := range g.snapshots {
+		if s.VersionInfo[res.typeURL] == res.version {
+			resources = s.byType[res.typeURL]
+		}
+	}
+
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// answered handles Envoy's answer to the response with nonce. It returns true if a certificate was quarantined.
+func (r *Reconciler) answered(id int64, node *envoy_core_v3.Node, nonce string, detail *status.Status) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.streams[id]
+	if !ok || nonce == "" {
+		return false
+	}
+
+	res, ok := s.responses[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.responses, nonce)
+
+	state, ok := s.states[res.typeURL]
+	if !ok {
+		state = &ResourceState{}
+		s.states[res.typeURL] = state
+	}
+	state.Updated = time.Now()
+
+	if detail == nil {
+		state.Version = res.version
+		state.Error = ""
+		return false
+	}
+	state.Error = detail.GetMessage()
+
+	log.Printf("Node %s rejected %s: %s", node.GetId(), res.typeURL, detail.GetMessage())
+
+	key, resource, cert := r.culprit(res, detail.GetMessage())
+	if cert == nil {
+		log.Printf("Could not tell which certificate node %s rejected, not quarantining anything", node.GetId())
+		return false
+	}
+
+	if _, ok := r.quarantine[key]; ok {
+		return false
+	}
+
+	log.Printf("Quarantining %s of tenant %s: node %s rejected %s", key.sni, key.tenant, node.GetId(), resource)
+	r.quarantine[key] = &Quarantine{
+		Tenant:   key.tenant,
+		SNI:      key.sni,
+		Node:     node.GetId(),
+		TypeURL:  res.typeURL,
+		Resource: resource,
+		Error:    detail.GetMessage(),
+		Since:    time.Now(),
+		cert:     cert.Cert,
+	}
+
+	return true
+}
+
+// culprit maps a rejected response to the certificate behind it. Envoy names the resource or filter chain in
+// most errors, otherwise only a response with a single resource is conclusive.
+func (r *Reconciler) culprit(res *response, message string) (certKey, string, *types.Certificate) {
+	names := r.responseNames(res)
+	resource := mentioned(message, names)
+	if resource == "" && len(names) == 1 {
+		resource = names[0]
+	}
+	if resource == "" {
+		return certKey{}, "", nil
+	}
+
+	for _, t := range r.tenants {
+		switch res.typeURL {
+		case envoy_resource_v3.SecretType, envoy_resource_v3.ClusterType:
+			for _, cert := range t.Certs {
+				names := builders.SecretNames(t.Tenant, cert)
+				if res.typeURL == envoy_resource_v3.ClusterType {
+					names = []string{r.builder.ClusterName(t.Tenant, cert)}
+				}
+
+				for _, name := range names {
+					if name == resource {
+						return certKey{tenant: t.Name, sni: cert.SNI}, resource, cert
+					}
+				}
+			}
+
+		case envoy_resource_v3.ListenerType:
+			if r.builder.ListenerName(t.Tenant) != resource {
+				continue
+			}
+
+			// Filter chains are named after the certificate's SNI
+			snis := make([]string, 0, len(t.Certs))
+			for _, cert := range t.Certs {
+				snis = append(snis, cert.SNI)
+			}
+
+			sni := mentioned(message, snis)
+			for _, cert := range t.Certs {
+				if cert.SNI == sni {
+					return certKey{tenant: t.Name, sni: sni}, resource + " filter chain " + sni, cert
+				}
+			}
+		}
+	}
+
+	return certKey{}, "", nil
+}
+
+// mentioned returns the longest of names that appears in message, so that example.com doesn't claim
+// an error about www.example.com.
+func mentioned(message string, names []string) string {
+	var found string
+	for _, name := range names {
+		if len(name) > len(found) && strings.Contains(message, name) {
+			found = name
+		}
+	}
+
+	return found
+}
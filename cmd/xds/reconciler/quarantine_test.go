@@ -0,0 +1,109 @@
+package reconciler
+
+import (
+	"context"
+	"testing"
+
+	envoy_resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+	certs := []*types.Certificate{
+		{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")},
+		{SNI: "bad.example.com", Cert: []byte("bad"), Key: []byte("key")},
+	}
+
+	if err := r.Reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	node := testNode(t, "envoy", nil)
+	if err := r.request(1, node, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// An ACK quarantines nothing
+	r.sent(1, "1", envoy_resource_v3.SecretType, "1", []string{"example.com", "bad.example.com"})
+	if r.answered(1, node, "1", nil) {
+		t.Fatal("ACK quarantined a certificate")
+	}
+
+	// The error names the secret
+	r.sent(1, "2", envoy_resource_v3.SecretType, "2", []string{"example.com", "bad.example.com"})
+	if !r.answered(1, node, "2", &status.Status{Message: "Failed to load certificate chain from <inline> of secret bad.example.com"}) {
+		t.Fatal("NACK quarantined nothing")
+	}
+	r.requeue()
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+	if q := r.Quarantined(); len(q) != 1 || q[0].SNI != "bad.example.com" || q[0].Node != "envoy" || q[0].Resource != "bad.example.com" {
+		t.Fatalf("unexpected quarantine %+v", q)
+	}
+
+	// A renewed certificate gets another chance
+	certs[1] = &types.Certificate{SNI: "bad.example.com", Cert: []byte("renewed"), Key: []byte("key")}
+	if err := r.Reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com", "bad.example.com")
+	if q := r.Quarantined(); len(q) != 0 {
+		t.Fatalf("changed certificate is still quarantined %+v", q)
+	}
+
+	// The error names the filter chain of the listener, the wildcard response's names come from its snapshot
+	snapshots, err := r.Snapshots(Group{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.sent(1, "3", envoy_resource_v3.ListenerType, snapshots[len(snapshots)-1].VersionInfo[envoy_resource_v3.ListenerType], nil)
+	if !r.answered(1, node, "3", &status.Status{Message: "Error adding/updating listener(s) listener_0: filter chain 'bad.example.com' is invalid"}) {
+		t.Fatal("listener NACK quarantined nothing")
+	}
+	r.requeue()
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+	if q := r.Quarantined(); len(q) != 1 || q[0].Resource != "listener_0 filter chain bad.example.com" {
+		t.Fatalf("unexpected quarantine %+v", q)
+	}
+
+	if r.Release("default", "example.com") {
+		t.Fatal("released a certificate that isn't quarantined")
+	}
+	if !r.Release("default", "bad.example.com") {
+		t.Fatal("quarantined certificate not released")
+	}
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com", "bad.example.com")
+}
+
+func TestQuarantineInconclusive(t *testing.T) {
+	r := New(builders.New())
+	certs := []*types.Certificate{
+		{SNI: "a.example.com", Cert: []byte("cert"), Key: []byte("key")},
+		{SNI: "b.example.com", Cert: []byte("cert"), Key: []byte("key")},
+	}
+
+	if err := r.Reconcile(context.Background(), defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	node := testNode(t, "envoy", nil)
+	if err := r.connect(1, node); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing points at a certificate, quarantining a random one would do more harm than good
+	r.sent(1, "1", envoy_resource_v3.SecretType, "1", []string{"a.example.com", "b.example.com"})
+	if r.answered(1, node, "1", &status.Status{Message: "something went wrong"}) {
+		t.Fatal("inconclusive NACK quarantined a certificate")
+	}
+
+	if got := mentioned("secret www.example.com is invalid", []string{"example.com", "www.example.com"}); got != "www.example.com" {
+		t.Fatalf("mentioned %q", got)
+	}
+}
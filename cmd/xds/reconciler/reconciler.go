@@ -1,10 +1,18 @@
 package reconciler
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	envoy_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
@@ -15,64 +23,615 @@ import (
 
 	"gopkg.in/yaml.v2"
 
-	"github.com/epk/envoy-egress-mitm/cmd/xds/builders"
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/tenant"
 	"github.com/epk/envoy-egress-mitm/types"
 )
 
-func Reconcile(ctx context.Context, cache envoy_cache_v3.SnapshotCache, certs []*types.Certificate) error {
-	alsCluster, err := builders.BuildALSCluster()
-	if err != nil {
-		return fmt.Errorf("failed to build ALS cluster: %w", err)
+// Reconciler serves every resource type from its own LinearCache, per group of nodes.
+// Each call to Reconcile only updates the resources that changed since the previous call,
+// so that adding a host pushes its Secret, Cluster and the Listener instead of everything.
+// The Listener is a single resource, callers batch changes to push it once for many hosts.
+type Reconciler struct {
+	mu sync.Mutex
+
+	builder *builders.Builder
+
+	// instance and created make the version prefix of every group's caches unique, see newGroup
+	instance string
+	created  uint64
+
+	// input are the tenants passed to the last Reconcile
+	input []*Tenant
+	// tenants are input minus the hosts that aren't intercepted, new groups start from them
+	tenants []*Tenant
+	// skipped are why the hosts left out of tenants aren't intercepted, by qualified SNI
+	skipped map[string]string
+	// quarantine holds the certificates Envoy rejected
+	quarantine map[certKey]*Quarantine
+	groups     map[Group]*group
+	// streams are the connected xDS streams by ID
+	streams map[int64]*stream
+}
+
+// group holds the resources served to the nodes of a Group.
+type group struct {
+	Group
+
+	builder *builders.Builder
+	caches  map[string]*envoy_cache_v3.LinearCache
+	mux     *envoy_cache_v3.MuxCache
+	// prefix starts the version_info of every cache of the group
+	prefix string
+
+	// tenants as of the last successful reconcile, by name
+	tenants map[string]*tenantState
+	// streams counts the connected streams of the group's nodes
+	streams int
+	// idle is when the last stream went away, the group is evicted groupIdleTimeout later
+	idle time.Time
+	// versions mirror the version of each cache, LinearCache bumps it on every update but doesn't expose it
+	versions map[string]uint64
+	// snapshots are the last versions of the group's config, the current one last
+	snapshots []*Snapshot
+}
+
+// Tenant is everything Reconcile needs to know about a tenant.
+type Tenant struct {
+	*tenant.Tenant
+	// Certs are the certificates in the tenant's namespace of the store
+	Certs []*types.Certificate
+	// Policy intercepts everything when nil
+	Policy *policy.Policy
+}
+
+// tenantState is what the last successful reconcile served for a tenant.
+type tenantState struct {
+	tenant *tenant.Tenant
+	certs  map[string]*types.Certificate
+	hosts  []string
+	policy *policy.Policy
+}
+
+// New returns a Reconciler that builds its resources with builder.
+func New(builder *builders.Builder) *Reconciler {
+	r := &Reconciler{
+		builder:    builder,
+		instance:   instanceID(),
+		groups:     map[Group]*group{},
+		streams:    map[int64]*stream{},
+		quarantine: map[certKey]*Quarantine{},
+	}
+
+	// Nodes without group metadata get everything, their group exists before the first of them connects
+	r.groups[Group{}] = r.newGroup(Group{})
+
+	return r
+}
+
+// newGroup returns an empty group whose caches version their resources apart from every other cache.
+// LinearCache counts versions from 1 and takes a version it didn't hand out for up to date, so a node
+// reconnecting after a restart with version 37 would never get the resources changed since.
+func (r *Reconciler) newGroup(g Group) *group {
+	r.created++
+	prefix := fmt.Sprintf("%s-%s-%d-", r.instance, g, r.created)
+
+	caches := map[string]*envoy_cache_v3.LinearCache{}
+	for _, typeURL := range []string{envoy_resource_v3.ClusterType, envoy_resource_v3.ListenerType, envoy_resource_v3.SecretType} {
+		caches[typeURL] = envoy_cache_v3.NewLinearCache(typeURL, envoy_cache_v3.WithVersionPrefix(prefix))
+	}
+
+	mux := &envoy_cache_v3.MuxCache{
+		Classify: func(r *envoy_cache_v3.Request) string {
+			return r.GetTypeUrl()
+		},
+		ClassifyDelta: func(r *envoy_cache_v3.DeltaRequest) string {
+			return r.GetTypeUrl()
+		},
+		Caches: map[string]envoy_cache_v3.Cache{},
+	}
+	for typeURL, cache := range caches {
+		mux.Caches[typeURL] = cache
 	}
 
-	dynamicForwardProxyCluster, err := builders.BuildDynamicForwardProxyCluster()
+	return &group{
+		Group:    g,
+		builder:  r.builder,
+		caches:   caches,
+		mux:      mux,
+		prefix:   prefix,
+		tenants:  map[string]*tenantState{},
+		versions: map[string]uint64{},
+	}
+}
+
+// instanceID tells the Reconcilers of different processes apart.
+func instanceID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Cache returns the cache to serve xDS from, it hands every request to the cache of the node's group.
+func (r *Reconciler) Cache() envoy_cache_v3.Cache {
+	return r
+}
+
+// Reconcile serves the certificates of every tenant on the tenant's listener, minus every host the tenant's
+// policy says to pass through, every host that has been demoted back to L4 and every quarantined certificate.
+// Wildcard certificates cover hosts the policy may treat differently, the listener applies the policy to them instead.
+// Tenants missing from tenants are removed along with all their resources.
+func (r *Reconciler) Reconcile(ctx context.Context, tenants []*Tenant) error {
+	stats, err := r.reconcile(ctx, tenants)
 	if err != nil {
-		return fmt.Errorf("failed to build dynamic forward proxy cluster: %w", err)
+		return err
 	}
 
-	listener, err := builders.BuildListener(certs)
+	log.Printf("snapshot updated: %d resources updated, %d deleted, %d bytes", stats.updated, stats.deleted, stats.bytes)
+	return nil
+}
+
+// requeue reconciles the tenants of the last Reconcile again, after the quarantine changed.
+func (r *Reconciler) requeue() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, err := r.reconcileLocked()
 	if err != nil {
-		return fmt.Errorf("failed to build listener: %w", err)
+		log.Println("Error reconciling:", err)
+		return
+	}
+
+	log.Printf("snapshot updated: %d resources updated, %d deleted, %d bytes", stats.updated, stats.deleted, stats.bytes)
+}
+
+// intercepted returns the tenants of the last Reconcile with only the certificates that are intercepted.
+// Hosts are only logged when they stop or start being intercepted, not on every call.
+func (r *Reconciler) intercepted(now time.Time) []*Tenant {
+	skipped := map[string]string{}
+
+	intercepted := make([]*Tenant, 0, len(r.input))
+	for _, t := range r.input {
+		var certs []*types.Certificate
+		for _, cert := range t.Certs {
+			key := t.Qualify(cert.SNI)
+			if reason := r.skipReason(t, cert, now); reason != "" {
+				if r.skipped[key] != reason {
+					log.Printf("not intercepting %s: %s", key, reason)
+				}
+				skipped[key] = reason
+				continue
+			}
+
+			if _, ok := r.skipped[key]; ok {
+				log.Printf("intercepting %s again", key)
+			}
+
+			certs = append(certs, cert)
+		}
+
+		intercepted = append(intercepted, &Tenant{Tenant: t.Tenant, Certs: certs, Policy: t.Policy})
 	}
 
-	var clusters []envoy_types.Resource
-	clusters = append(clusters, alsCluster, dynamicForwardProxyCluster)
+	r.skipped = skipped
 
-	var secrets []envoy_types.Resource
-	for _, cert := range certs {
-		secret, err := builders.BuildSecret(cert)
+	return intercepted
+}
+
+// skipReason returns why cert of t isn't intercepted at now, or an empty string if it is.
+func (r *Reconciler) skipReason(t *Tenant, cert *types.Certificate, now time.Time) string {
+	if cert.Demoted(now) {
+		return "demoted until " + cert.DemotedUntil.Format(time.RFC3339)
+	}
+
+	if decision := t.Policy.Decide(cert.SNI); !cert.Wildcard && decision.Action != policy.Intercept {
+		return decision.String()
+	}
+
+	if q := r.quarantined(t.Tenant, cert); q != nil {
+		return "quarantined since " + q.Since.Format(time.RFC3339)
+	}
+
+	if len(builders.SecretNames(t.Tenant, cert)) == 0 {
+		return "Envoy can't serve any of its keys"
+	}
+
+	return ""
+}
+
+// updateStats describes what a reconcile pushed to the caches.
+type updateStats struct {
+	updated int
+	deleted int
+	bytes   int
+}
+
+func (s *updateStats) add(other updateStats) {
+	s.updated += other.updated
+	s.deleted += other.deleted
+	s.bytes += other.bytes
+}
+
+// delta collects the changes to a single resource type.
+type delta struct {
+	toUpdate map[string]envoy_types.Resource
+	toDelete []string
+}
+
+// update is everything a group's reconcile built, nothing of it is served until it is applied.
+type update struct {
+	group     *group
+	clusters  *delta
+	secrets   *delta
+	listeners *delta
+	// tenants become the group's tenants once applied
+	tenants map[string]*tenantState
+}
+
+// reconcile updates the caches of every group.
+func (r *Reconciler) reconcile(_ context.Context, tenants []*Tenant) (updateStats, error) {
+	seen := make(map[string]bool, len(tenants))
+	for _, t := range tenants {
+		if seen[t.Name] {
+			return updateStats{}, fmt.Errorf("duplicate tenant %s", t.Name)
+		}
+		seen[t.Name] = true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.input = tenants
+
+	return r.reconcileLocked()
+}
+
+// reconcileLocked updates the caches of every group. Every resource is built before any is pushed,
+// if one fails to build every group keeps serving what it did.
+func (r *Reconciler) reconcileLocked() (updateStats, error) {
+	now := time.Now()
+	tenants := r.intercepted(now)
+	r.evictIdle(now)
+
+	var errs []error
+	updates := make([]*update, 0, len(r.groups))
+	for _, g := range r.groups {
+		u, err := g.build(g.filter(tenants))
 		if err != nil {
-			return fmt.Errorf("failed to build secret: %w", err)
+			errs = append(errs, fmt.Errorf("group %s: %w", g.Group, err))
+			continue
 		}
-		secrets = append(secrets, secret)
+		updates = append(updates, u)
+	}
 
-		cluster, err := builders.BuildManualUpstream(cert)
+	if len(errs) > 0 {
+		return updateStats{}, errors.Join(errs...)
+	}
+
+	var stats updateStats
+	for _, u := range updates {
+		groupStats, err := u.apply()
 		if err != nil {
-			return fmt.Errorf("failed to build manual upstream cluster: %w", err)
+			errs = append(errs, fmt.Errorf("group %s: %w", u.group.Group, err))
+			continue
 		}
+		stats.add(groupStats)
+	}
+
+	r.tenants = tenants
+
+	return stats, errors.Join(errs...)
+}
 
-		clusters = append(clusters, cluster)
+// reconcile builds and applies the resources of tenants.
+func (g *group) reconcile(tenants []*Tenant) (updateStats, error) {
+	u, err := g.build(tenants)
+	if err != nil {
+		return updateStats{}, err
 	}
 
-	snap, err := envoy_cache_v3.NewSnapshot(time.Now().String(), map[envoy_resource_v3.Type][]envoy_types.Resource{
-		envoy_resource_v3.ClusterType:  clusters,
-		envoy_resource_v3.ListenerType: {listener},
-		envoy_resource_v3.SecretType:   secrets,
-	})
+	return u.apply()
+}
+
+// build collects the changes to the group's resources since the last applied update, without pushing them.
+func (g *group) build(tenants []*Tenant) (*update, error) {
+	clusters := newDelta()
+	secrets := newDelta()
+	listeners := newDelta()
+
+	// The ALS and dynamic forward proxy clusters are shared by every tenant
+	alsCluster, err := g.builder.BuildALSCluster()
 	if err != nil {
-		return fmt.Errorf("failed to create snapshot: %w", err)
+		return nil, fmt.Errorf("failed to build ALS cluster: %w", err)
 	}
+	clusters.updateIfChanged(g.caches[envoy_resource_v3.ClusterType], alsCluster.GetName(), alsCluster)
 
-	if err := snap.Consistent(); err != nil {
-		return fmt.Errorf("inconsistent snapshot: %w", err)
+	dynamicForwardProxyCluster, err := g.builder.BuildDynamicForwardProxyCluster()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dynamic forward proxy cluster: %w", err)
 	}
+	clusters.updateIfChanged(g.caches[envoy_resource_v3.ClusterType], dynamicForwardProxyCluster.GetName(), dynamicForwardProxyCluster)
 
-	if err := cache.SetSnapshot(ctx, "default", snap); err != nil {
-		return fmt.Errorf("failed to set snapshot: %w", err)
+	dynamicForwardProxyTLSCluster, err := g.builder.BuildDynamicForwardProxyTLSCluster()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build dynamic forward proxy TLS cluster: %w", err)
 	}
+	clusters.updateIfChanged(g.caches[envoy_resource_v3.ClusterType], dynamicForwardProxyTLSCluster.GetName(), dynamicForwardProxyTLSCluster)
 
-	log.Println("snapshot updated")
-	return nil
+	// In transparent mode the listeners send everything they don't resolve themselves to the original destination
+	if g.builder.Options().OriginalDst {
+		originalDstCluster, err := g.builder.BuildOriginalDstCluster()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build original dst cluster: %w", err)
+		}
+		clusters.updateIfChanged(g.caches[envoy_resource_v3.ClusterType], originalDstCluster.GetName(), originalDstCluster)
+
+		originalDstTLSCluster, err := g.builder.BuildOriginalDstTLSCluster()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build original dst TLS cluster: %w", err)
+		}
+		clusters.updateIfChanged(g.caches[envoy_resource_v3.ClusterType], originalDstTLSCluster.GetName(), originalDstTLSCluster)
+	}
+
+	// Everything else is qualified with the tenant's name, so tenants can't collide
+	desired := make(map[string]*tenantState, len(tenants))
+	for _, t := range tenants {
+		previous, ok := g.tenants[t.Name]
+		if !ok {
+			previous = &tenantState{tenant: t.Tenant, certs: map[string]*types.Certificate{}}
+		}
+
+		state, err := g.reconcileTenant(t, previous, clusters, secrets, listeners)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		desired[t.Name] = state
+	}
+
+	// Tenants that went away take their listener and everything it referenced with them
+	for name, previous := range g.tenants {
+		if _, ok := desired[name]; ok {
+			continue
+		}
+
+		for _, cert := range previous.certs {
+			secrets.toDelete = append(secrets.toDelete, builders.SecretNames(previous.tenant, cert)...)
+			if !cert.Wildcard {
+				clusters.toDelete = append(clusters.toDelete, g.builder.ClusterName(previous.tenant, cert))
+			}
+		}
+		listeners.toDelete = append(listeners.toDelete, g.builder.ListenerName(previous.tenant))
+		if previous.tenant.ConnectPort != 0 {
+			listeners.toDelete = append(listeners.toDelete, g.builder.ConnectListenerName(previous.tenant))
+			if !g.builder.Options().OriginalDst {
+				clusters.toDelete = append(clusters.toDelete, g.builder.ConnectLoopbackClusterName(previous.tenant))
+			}
+		}
+		if previous.tenant.HTTPPort != 0 {
+			listeners.toDelete = append(listeners.toDelete, g.builder.HTTPListenerName(previous.tenant))
+		}
+	}
+
+	return &update{
+		group:     g,
+		clusters:  clusters,
+		secrets:   secrets,
+		listeners: listeners,
+		tenants:   desired,
+	}, nil
+}
+
+// apply pushes u to the caches of its group. Should a cache reject it, the group keeps its tenants and
+// the next reconcile builds the same changes again.
+func (u *update) apply() (updateStats, error) {
+	g := u.group
+
+	// Push clusters and secrets before the listener that references them
+	var stats updateStats
+	for _, change := range []struct {
+		typeURL string
+		delta   *delta
+	}{
+		{envoy_resource_v3.ClusterType, u.clusters},
+		{envoy_resource_v3.SecretType, u.secrets},
+		{envoy_resource_v3.ListenerType, u.listeners},
+	} {
+		if len(change.delta.toUpdate) == 0 && len(change.delta.toDelete) == 0 {
+			continue
+		}
+
+		if err := g.caches[change.typeURL].UpdateResources(change.delta.toUpdate, change.delta.toDelete); err != nil {
+			return updateStats{}, fmt.Errorf("failed to update %s: %w", change.typeURL, err)
+		}
+		g.versions[change.typeURL]++
+
+		stats.updated += len(change.delta.toUpdate)
+		stats.deleted += len(change.delta.toDelete)
+		for _, res := range change.delta.toUpdate {
+			stats.bytes += proto.Size(res)
+		}
+	}
+
+	g.tenants = u.tenants
+	if stats.updated+stats.deleted > 0 {
+		g.record()
+	}
+
+	return stats, nil
+}
+
+// reconcileTenant records the changes to the resources of t since previous.
+func (g *group) reconcileTenant(t *Tenant, previous *tenantState, clusters, secrets, listeners *delta) (*tenantState, error) {
+	desired := make(map[string]*types.Certificate, len(t.Certs))
+	hosts := make([]string, 0, len(t.Certs))
+	for _, cert := range t.Certs {
+		desired[cert.SNI] = cert
+		hosts = append(hosts, listenerKey(t.Tenant, cert))
+
+		// Only build resources for certificates that are new or changed
+		old, existed := previous.certs[cert.SNI]
+		if existed && equalCertificate(old, cert) {
+			continue
+		}
+
+		certSecrets, err := builders.BuildSecrets(t.Tenant, cert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build secret: %w", err)
+		}
+		for _, secret := range certSecrets {
+			secrets.toUpdate[secret.GetName()] = secret
+		}
+
+		// Alternates that went away take their secret with them
+		if existed {
+			for _, name := range builders.SecretNames(t.Tenant, old) {
+				if _, ok := secrets.toUpdate[name]; !ok {
+					secrets.toDelete = append(secrets.toDelete, name)
+				}
+			}
+		}
+
+		// The upstream cluster only depends on the SNI, wildcard certificates go through the dynamic forward proxy
+		switch {
+		case cert.Wildcard && existed && !old.Wildcard:
+			clusters.toDelete = append(clusters.toDelete, g.builder.ClusterName(t.Tenant, cert))
+		case !cert.Wildcard && (!existed || old.Wildcard):
+			cluster, err := g.builder.BuildManualUpstream(t.Tenant, cert)
+			if err != nil {
+				return nil, fmt.Errorf("failed to build manual upstream cluster: %w", err)
+			}
+			clusters.toUpdate[cluster.GetName()] = cluster
+		}
+	}
+
+	sort.Strings(hosts)
+
+	for sni, old := range previous.certs {
+		if _, ok := desired[sni]; !ok {
+			secrets.toDelete = append(secrets.toDelete, builders.SecretNames(t.Tenant, old)...)
+			if !old.Wildcard {
+				clusters.toDelete = append(clusters.toDelete, g.builder.ClusterName(t.Tenant, old))
+			}
+		}
+	}
+
+	// The listener holds a filter chain per host and the policy for wildcard certificates,
+	// it only needs rebuilding when either or the tenant's port changes
+	if previous.hosts == nil || !equalStrings(previous.hosts, hosts) || previous.policy != t.Policy || *previous.tenant != *t.Tenant {
+		listener, err := g.builder.BuildListener(t.Tenant, t.Certs, t.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build listener: %w", err)
+		}
+		listeners.updateIfChanged(g.caches[envoy_resource_v3.ListenerType], listener.GetName(), listener)
+	}
+
+	// The explicit forward proxy only depends on the tenant, it tunnels into the listener above unless in
+	// transparent mode
+	loopback := !g.builder.Options().OriginalDst
+	switch {
+	case t.ConnectPort != 0:
+		if loopback {
+			cluster, err := g.builder.BuildConnectLoopbackCluster(t.Tenant)
+			if err != nil {
+				return nil, fmt.Errorf("failed to build connect loopback cluster: %w", err)
+			}
+			clusters.updateIfChanged(g.caches[envoy_resource_v3.ClusterType], cluster.GetName(), cluster)
+		}
+
+		listener, err := g.builder.BuildConnectListener(t.Tenant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build connect listener: %w", err)
+		}
+		listeners.updateIfChanged(g.caches[envoy_resource_v3.ListenerType], listener.GetName(), listener)
+	case previous.tenant.ConnectPort != 0:
+		listeners.toDelete = append(listeners.toDelete, g.builder.ConnectListenerName(t.Tenant))
+		if loopback {
+			clusters.toDelete = append(clusters.toDelete, g.builder.ConnectLoopbackClusterName(t.Tenant))
+		}
+	}
+
+	// The plaintext listener evaluates the policy itself, it doesn't depend on the certificates
+	switch {
+	case t.HTTPPort != 0:
+		listener, err := g.builder.BuildHTTPListener(t.Tenant, t.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build http listener: %w", err)
+		}
+		listeners.updateIfChanged(g.caches[envoy_resource_v3.ListenerType], listener.GetName(), listener)
+	case previous.tenant.HTTPPort != 0:
+		listeners.toDelete = append(listeners.toDelete, g.builder.HTTPListenerName(t.Tenant))
+	}
+
+	return &tenantState{
+		tenant: t.Tenant,
+		certs:  desired,
+		hosts:  hosts,
+		policy: t.Policy,
+	}, nil
+}
+
+func newDelta() *delta {
+	return &delta{
+		toUpdate: map[string]envoy_types.Resource{},
+	}
+}
+
+// updateIfChanged records res as an update unless the cache already holds an identical resource.
+func (d *delta) updateIfChanged(cache *envoy_cache_v3.LinearCache, name string, res envoy_types.Resource) {
+	if current, ok := cache.GetResources()[name]; ok && proto.Equal(current, res) {
+		return
+	}
+
+	d.toUpdate[name] = res
+}
+
+func equalCertificate(a, b *types.Certificate) bool {
+	if a.SNI != b.SNI || a.Wildcard != b.Wildcard || !bytes.Equal(a.Cert, b.Cert) || !bytes.Equal(a.Key, b.Key) {
+		return false
+	}
+
+	if len(a.Alternates) != len(b.Alternates) {
+		return false
+	}
+
+	for i := range a.Alternates {
+		if a.Alternates[i].Algorithm != b.Alternates[i].Algorithm ||
+			!bytes.Equal(a.Alternates[i].Cert, b.Alternates[i].Cert) ||
+			!bytes.Equal(a.Alternates[i].Key, b.Alternates[i].Key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// listenerKey identifies what the listener needs to know about cert: the secrets it serves and,
+// for wildcard certificates, the names it covers.
+func listenerKey(t *tenant.Tenant, cert *types.Certificate) string {
+	key := strings.Join(builders.SecretNames(t, cert), " ")
+	if !cert.Wildcard {
+		return key
+	}
+
+	return key + " " + strings.Join(cert.DNSNames, " ")
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
 }
 
 func protoYaml(m proto.Message) ([]byte, error) {
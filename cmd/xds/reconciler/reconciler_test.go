@@ -2,15 +2,22 @@ package reconciler
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
-	envoy_cache_v3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	envoy_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	envoy_resource_v3 "github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/epk/envoy-egress-mitm/builders"
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/tenant"
 	"github.com/epk/envoy-egress-mitm/types"
 )
 
 func TestReconcile(t *testing.T) {
-	cache := envoy_cache_v3.NewSnapshotCache(false, envoy_cache_v3.IDHash{}, nil)
+	r := New(builders.New())
 	certs := []*types.Certificate{
 		{
 			SNI:  "example.com",
@@ -19,8 +26,424 @@ func TestReconcile(t *testing.T) {
 		},
 	}
 
-	err := Reconcile(context.Background(), cache, certs)
+	err := r.Reconcile(context.Background(), defaultTenant(certs, nil))
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com")
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0")
+}
+
+func TestReconcilePolicy(t *testing.T) {
+	r := New(builders.New())
+	certs := []*types.Certificate{
+		{SNI: "bank.example", Cert: []byte("cert"), Key: []byte("key")},
+		{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")},
+	}
+
+	pol, err := policy.Parse([]byte("rules:\n- suffix: bank.example\n  action: passthrough\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reconcile(context.Background(), defaultTenant(certs, pol)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+
+	// Dropping the rule moves the host to L7
+	if err := r.Reconcile(context.Background(), defaultTenant(certs, policy.Default())); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "bank.example", "example.com")
+}
+
+func TestReconcileDemoted(t *testing.T) {
+	r := New(builders.New())
+	until := time.Now().Add(time.Hour)
+	certs := []*types.Certificate{
+		{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")},
+		{SNI: "pinned.example.com", Cert: []byte("cert"), Key: []byte("key"), DemotedUntil: &until},
+	}
+
+	if err := r.Reconcile(context.Background(), defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+}
+
+func TestReconcileWildcard(t *testing.T) {
+	r := New(builders.New())
+	ctx := context.Background()
+
+	pol, err := policy.Parse([]byte("rules:\n- exact: login.example.com\n  action: passthrough\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exact := []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}}
+	if err := r.Reconcile(ctx, defaultTenant(exact, pol)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com")
+
+	// Re-keying the domain to a wildcard certificate drops its upstream cluster, the dynamic forward proxy takes over
+	wildcard := []*types.Certificate{{
+		SNI:      "example.com",
+		Cert:     []byte("cert2"),
+		Key:      []byte("key2"),
+		Wildcard: true,
+		DNSNames: []string{"*.example.com", "example.com"},
+	}}
+	if err := r.Reconcile(ctx, defaultTenant(wildcard, pol)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service")
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+
+	// Covering a new name changes the listener
+	before := r.groups[Group{}].caches[envoy_resource_v3.ListenerType].GetResources()["listener_0"]
+	wildcard[0].DNSNames = append(wildcard[0].DNSNames, "*.cdn.example.com")
+	if err := r.Reconcile(ctx, defaultTenant(wildcard, pol)); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := r.groups[Group{}].caches[envoy_resource_v3.ListenerType].GetResources()["listener_0"]; proto.Equal(before, after) {
+		t.Fatal("listener not updated for new wildcard name")
+	}
+}
+
+func TestReconcileAlternates(t *testing.T) {
+	r := New(builders.New())
+	ctx := context.Background()
+
+	dual := []*types.Certificate{{
+		SNI:        "example.com",
+		Cert:       []byte("cert"),
+		Key:        []byte("key"),
+		Alternates: []*types.KeyPair{{Algorithm: types.RSA2048, Cert: []byte("rsa-cert"), Key: []byte("rsa-key")}},
+	}}
+	if err := r.Reconcile(ctx, defaultTenant(dual, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com", "example.com/rsa")
+
+	// Dropping the alternate deletes its secret
+	single := []*types.Certificate{{SNI: "example.com", Cert: []byte("cert2"), Key: []byte("key2")}}
+	if err := r.Reconcile(ctx, defaultTenant(single, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+}
+
+func TestReconcileBuildFailure(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+
+	certs := []*types.Certificate{
+		{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")},
+	}
+	if _, err := r.reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	r.groupLocked(Group{Tenant: tenant.DefaultName})
+	r.mu.Unlock()
+
+	// A tenant whose listener can't be built fails the zero group, and keeps the group of the default
+	// tenant from being pushed the new host
+	certs = append(certs, &types.Certificate{SNI: "example2.com", Cert: []byte("cert2"), Key: []byte("key2")})
+	broken := &Tenant{Tenant: &tenant.Tenant{Name: "team-a", Port: 70000}}
+	if _, err := r.reconcile(ctx, append(defaultTenant(certs, nil), broken)); err == nil {
+		t.Fatal("expected an error building the listener of team-a")
+	}
+
+	for _, g := range []Group{{}, {Tenant: tenant.DefaultName}} {
+		assertGroupResources(t, r, g, envoy_resource_v3.SecretType, "example.com")
+		assertGroupResources(t, r, g, envoy_resource_v3.ListenerType, "listener_0")
+	}
+
+	// The next reconcile pushes everything that was held back
+	stats, err := r.reconcile(ctx, defaultTenant(certs, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 6 || stats.deleted != 0 {
+		t.Fatalf("expected 3 updates per group, got %+v", stats)
+	}
+
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com", "example2.com")
+}
+
+func TestReconcileIncremental(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+
+	certs := []*types.Certificate{
+		{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")},
+	}
+	if _, err := r.reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changed, nothing is pushed
+	stats, err := r.reconcile(ctx, defaultTenant(certs, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 0 || stats.deleted != 0 {
+		t.Fatalf("expected no updates, got %+v", stats)
+	}
+
+	// A new host pushes its secret, its cluster and the listener
+	certs = append(certs, &types.Certificate{SNI: "example2.com", Cert: []byte("cert2"), Key: []byte("key2")})
+	stats, err = r.reconcile(ctx, defaultTenant(certs, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 3 || stats.deleted != 0 {
+		t.Fatalf("expected 3 updates, got %+v", stats)
+	}
+
+	// A renewed certificate only pushes its secret
+	certs[0] = &types.Certificate{SNI: "example.com", Cert: []byte("renewed"), Key: []byte("key")}
+	stats, err = r.reconcile(ctx, defaultTenant(certs, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 1 || stats.deleted != 0 {
+		t.Fatalf("expected 1 update, got %+v", stats)
+	}
+
+	// A removed host deletes its secret and cluster and pushes the listener
+	stats, err = r.reconcile(ctx, defaultTenant(certs[:1], nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 1 || stats.deleted != 2 {
+		t.Fatalf("expected 1 update and 2 deletes, got %+v", stats)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com")
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+}
+
+func TestReconcileTenants(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+
+	pol, err := policy.Parse([]byte("default: passthrough\nrules:\n- suffix: example.com\n  action: intercept\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teamA := &tenant.Tenant{Name: "team-a", Port: 9443}
+	tenants := []*Tenant{
+		{
+			Tenant: tenant.Default(),
+			Certs:  []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}},
+		},
+		{
+			Tenant: teamA,
+			Certs: []*types.Certificate{
+				{SNI: "example.com", Cert: []byte("cert2"), Key: []byte("key2")},
+				{SNI: "example.org", Cert: []byte("cert3"), Key: []byte("key3")},
+			},
+			Policy: pol,
+		},
+	}
+
+	if err := r.Reconcile(ctx, tenants); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same host in two tenants, team-a's policy passes example.org through
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com", "team-a/example.com")
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com", "team-a/example.com")
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0", "team-a/listener_0")
+
+	secret := r.groups[Group{}].caches[envoy_resource_v3.SecretType].GetResources()["team-a/example.com"].(*envoy_tls_v3.Secret)
+	if got := string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes()); got != "cert2" {
+		t.Fatalf("team-a serves the certificate %q", got)
+	}
+
+	// Moving the tenant to another port only rebuilds its listener
+	moved := &Tenant{Tenant: &tenant.Tenant{Name: "team-a", Port: 9444}, Certs: tenants[1].Certs[:1], Policy: pol}
+	stats, err := r.reconcile(ctx, []*Tenant{tenants[0], moved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 1 || stats.deleted != 0 {
+		t.Fatalf("expected 1 update, got %+v", stats)
+	}
+
+	// Removing a tenant removes everything it served
+	if err := r.Reconcile(ctx, tenants[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com")
+	assertResources(t, r, envoy_resource_v3.SecretType, "example.com")
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0")
+}
+
+func TestReconcileConnect(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+
+	certs := []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}}
+	def := &tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, ConnectPort: 3128}
+	teamA := &tenant.Tenant{Name: "team-a", Port: 9443, ConnectPort: 3129}
+	if err := r.Reconcile(ctx, []*Tenant{{Tenant: def, Certs: certs}, {Tenant: teamA}}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "connect_loopback", "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com", "team-a/connect_loopback")
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0", "listener_connect", "team-a/listener_0", "team-a/listener_connect")
+
+	// The loopback cluster follows the tenant's listener
+	moved := &tenant.Tenant{Name: "team-a", Port: 9444, ConnectPort: 3129}
+	stats, err := r.reconcile(ctx, []*Tenant{{Tenant: def, Certs: certs}, {Tenant: moved}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 2 || stats.deleted != 0 {
+		t.Fatalf("expected 2 updates, got %+v", stats)
+	}
+
+	// Turning the connect port off removes the explicit forward proxy, removing the tenant the rest
+	if err := r.Reconcile(ctx, []*Tenant{{Tenant: tenant.Default(), Certs: certs}}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com")
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0")
+}
+
+func TestReconcileOriginalDst(t *testing.T) {
+	r := New(builders.New(builders.WithOriginalDst(false)))
+
+	certs := []*types.Certificate{{SNI: "example.com", Cert: []byte("cert"), Key: []byte("key")}}
+	def := &tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, ConnectPort: 3128}
+	if err := r.Reconcile(context.Background(), []*Tenant{{Tenant: def, Certs: certs}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tunnels can't be fed back into a listener that sends them to their original destination
+	assertResources(t, r, envoy_resource_v3.ClusterType, "dynamic_forward_proxy_cluster", "dynamic_forward_proxy_tls_cluster", "envoy_access_log_service", "example.com", "original_dst_cluster", "original_dst_tls_cluster")
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0", "listener_connect")
+}
+
+func TestReconcileHTTP(t *testing.T) {
+	ctx := context.Background()
+	r := New(builders.New())
+
+	pol, err := policy.Parse([]byte("rules:\n- suffix: bank.example\n  action: passthrough\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := &tenant.Tenant{Name: tenant.DefaultName, Port: tenant.DefaultPort, HTTPPort: 8000}
+	if err := r.Reconcile(ctx, []*Tenant{{Tenant: def}}); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0", "listener_http")
+
+	// The plaintext listener follows the policy, listener_0 only does for wildcard certificates
+	stats, err := r.reconcile(ctx, []*Tenant{{Tenant: def, Policy: pol}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.updated != 1 || stats.deleted != 0 {
+		t.Fatalf("expected 1 update, got %+v", stats)
+	}
+
+	if err := r.Reconcile(ctx, defaultTenant(nil, pol)); err != nil {
+		t.Fatal(err)
+	}
+
+	assertResources(t, r, envoy_resource_v3.ListenerType, "listener_0")
+}
+
+// BenchmarkReconcileAddHost measures adding hosts on top of 10k existing ones, one per reconcile and 100 per
+// reconcile like the batches xDS waits --batch-delay for. push-bytes is what the caches hand to Envoy per reconcile
+// and per added host, full-bytes is what a full snapshot would have sent.
+func BenchmarkReconcileAddHost(b *testing.B) {
+	for _, batch := range []int{1, 100} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			ctx := context.Background()
+			r := New(builders.New())
+
+			certs := make([]*types.Certificate, 0, 10000+b.N*batch)
+			for i := 0; i < 10000; i++ {
+				certs = append(certs, benchmarkCertificate(i))
+			}
+
+			if _, err := r.reconcile(ctx, defaultTenant(certs, nil)); err != nil {
+				b.Fatal(err)
+			}
+
+			var pushed, full int
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < batch; j++ {
+					certs = append(certs, benchmarkCertificate(10000+i*batch+j))
+				}
+
+				stats, err := r.reconcile(ctx, defaultTenant(certs, nil))
+				if err != nil {
+					b.Fatal(err)
+				}
+				pushed += stats.bytes
+
+				b.StopTimer()
+				full += cacheSize(r)
+				b.StartTimer()
+			}
+
+			b.ReportMetric(float64(pushed)/float64(b.N), "push-bytes/op")
+			b.ReportMetric(float64(pushed)/float64(b.N*batch), "push-bytes/host")
+			b.ReportMetric(float64(full)/float64(b.N), "full-bytes/op")
+		})
+	}
+}
+
+func benchmarkCertificate(i int) *types.Certificate {
+	return &types.Certificate{
+		SNI:  fmt.Sprintf("host-%05d.example.com", i),
+		Cert: []byte("cert"),
+		Key:  []byte("key"),
+	}
+}
+
+func cacheSize(r *Reconciler) int {
+	size := 0
+	for _, cache := range r.groups[Group{}].caches {
+		for _, res := range cache.GetResources() {
+			size += proto.Size(res)
+		}
+	}
+	return size
+}
+
+// defaultTenant serves certs on listener_0, like before there were tenants.
+func defaultTenant(certs []*types.Certificate, pol *policy.Policy) []*Tenant {
+	return []*Tenant{{Tenant: tenant.Default(), Certs: certs, Policy: pol}}
+}
+
+func assertResources(t *testing.T, r *Reconciler, typeURL string, want ...string) {
+	t.Helper()
+	assertGroupResources(t, r, Group{}, typeURL, want...)
 }
@@ -0,0 +1,192 @@
+package reconciler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	envoy_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	envoy_types "github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/pmezard/go-difflib/difflib"
+	"google.golang.org/protobuf/proto"
+)
+
+// snapshotHistory is how many snapshots are kept around to diff against
+const snapshotHistory = 20
+
+// redacted replaces private keys in rendered secrets
+const redacted = "[redacted]"
+
+var (
+	// ErrUnknownVersion is returned for snapshot versions that never existed or are no longer kept.
+	ErrUnknownVersion = errors.New("unknown snapshot version")
+	// ErrUnknownGroup is returned for groups no node connected to, or not within groupIdleTimeout.
+	ErrUnknownGroup = errors.New("unknown group")
+)
+
+// Snapshot is a version of the config served to the nodes of a group.
+type Snapshot struct {
+	// Version counts the snapshots of the group
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+	// Resources counts the resources by type URL
+	Resources map[string]int `json:"resources"`
+	// VersionInfo is the version_info the group's nodes get and ACK by type URL, as listed by Nodes
+	VersionInfo map[string]string `json:"version_info"`
+
+	byType map[string]map[string]envoy_types.Resource
+}
+
+// Snapshots returns the snapshots of g kept around, the current one last.
+func (r *Reconciler) Snapshots(g Group) ([]Snapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.groups[g]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownGroup, g)
+	}
+
+	out := make([]Snapshot, 0, len(existing.snapshots))
+	for _, s := range existing.snapshots {
+		out = append(out, *s)
+	}
+
+	return out, nil
+}
+
+// Render returns the resources of typeURL in snapshot version of g as YAML, sorted by name, with private keys
+// redacted. Version 0 is the current snapshot.
+func (r *Reconciler) Render(g Group, typeURL string, version uint64) ([]byte, error) {
+	s, err := r.snapshot(g, version)
+	if err != nil {
+		return nil, err
+	}
+
+	return render(s.byType[typeURL])
+}
+
+// Diff returns a unified diff of the resources of typeURL from snapshot version from to version to of g,
+// rendered like Render.
+func (r *Reconciler) Diff(g Group, typeURL string, from, to uint64) (string, error) {
+	a, err := r.snapshot(g, from)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := r.snapshot(g, to)
+	if err != nil {
+		return "", err
+	}
+
+	before, err := render(a.byType[typeURL])
+	if err != nil {
+		return "", err
+	}
+
+	after, err := render(b.byType[typeURL])
+	if err != nil {
+		return "", err
+	}
+
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(before)),
+		B:        difflib.SplitLines(string(after)),
+		FromFile: fmt.Sprintf("version %d", a.Version),
+		ToFile:   fmt.Sprintf("version %d", b.Version),
+		Context:  3,
+	})
+}
+
+// snapshot returns snapshot version of g, or the current one for version 0.
+func (r *Reconciler) snapshot(g Group, version uint64) (*Snapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.groups[g]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrUnknownGroup, g)
+	}
+
+	if len(existing.snapshots) == 0 {
+		return nil, ErrUnknownVersion
+	}
+
+	if version == 0 {
+		return existing.snapshots[len(existing.snapshots)-1], nil
+	}
+
+	for _, s := range existing.snapshots {
+		if s.Version == version {
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w %d", ErrUnknownVersion, version)
+}
+
+// record keeps the resources the group serves as a new snapshot version. Resources are never
+// modified once they are in a cache, so the snapshot shares them.
+func (g *group) record() {
+	s := &Snapshot{
+		Version:     1,
+		Time:        time.Now(),
+		Resources:   map[string]int{},
+		VersionInfo: map[string]string{},
+		byType:      map[string]map[string]envoy_types.Resource{},
+	}
+	if len(g.snapshots) > 0 {
+		s.Version = g.snapshots[len(g.snapshots)-1].Version + 1
+	}
+
+	for typeURL, cache := range g.caches {
+		s.byType[typeURL] = cache.GetResources()
+		s.Resources[typeURL] = len(s.byType[typeURL])
+		s.VersionInfo[typeURL] = g.prefix + strconv.FormatUint(g.versions[typeURL], 10)
+	}
+
+	g.snapshots = append(g.snapshots, s)
+	if len(g.snapshots) > snapshotHistory {
+		g.snapshots = g.snapshots[len(g.snapshots)-snapshotHistory:]
+	}
+}
+
+func render(resources map[string]envoy_types.Resource) ([]byte, error) {
+	names := make([]string, 0, len(resources))
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		out, err := protoYaml(redact(resources[name]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", name, err)
+		}
+
+		buf.WriteString("---\n")
+		buf.Write(out)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// redact returns res without private keys.
+func redact(res envoy_types.Resource) envoy_types.Resource {
+	secret, ok := res.(*envoy_tls_v3.Secret)
+	if !ok || secret.GetTlsCertificate().GetPrivateKey() == nil {
+		return res
+	}
+
+	secret = proto.Clone(secret).(*envoy_tls_v3.Secret)
+	secret.GetTlsCertificate().PrivateKey = &envoy_core_v3.DataSource{
+		Specifier: &envoy_core_v3.DataSource_InlineString{InlineString: redacted},
+	}
+
+	return secret
+}
@@ -0,0 +1,196 @@
+// Package config holds the settings the xds and als binaries need to fit into their environment, so the same
+// images run anywhere. Settings come from a YAML file, EGRESS_MITM_* environment variables and flags, each
+// overriding the one before.
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix prefixes the environment variable of every flag, --listener-port is EGRESS_MITM_LISTENER_PORT
+const EnvPrefix = "EGRESS_MITM_"
+
+// Config is shared by both binaries, one file can configure both. Each only reads the settings it needs.
+type Config struct {
+	// Store is the certificate store URI
+	Store string `yaml:"store"`
+	// GRPCListen is the address xds serves xDS and als serves access logs on
+	GRPCListen string `yaml:"grpc_listen"`
+
+	// ListenerPort is the port of the default tenant's listener
+	ListenerPort uint32 `yaml:"listener_port"`
+	// ConnectPort is the port of the default tenant's explicit forward proxy listener, there is none when 0
+	ConnectPort uint32 `yaml:"connect_port"`
+	// HTTPPort is the port of the default tenant's plaintext HTTP listener, there is none when 0
+	HTTPPort uint32 `yaml:"http_port"`
+	// UpstreamPort is the port intercepted and passed through hosts are reached on
+	UpstreamPort uint32 `yaml:"upstream_port"`
+	// ALSHost and ALSPort is where Envoy reaches als
+	ALSHost string `yaml:"als_host"`
+	ALSPort uint32 `yaml:"als_port"`
+	// OriginalDst sends connections redirected to the listeners to their original destination, keeping the port
+	OriginalDst bool `yaml:"original_dst"`
+	// Transparent binds the listeners for TPROXY, it needs OriginalDst
+	Transparent bool `yaml:"transparent"`
+	// KeyLogDir is where Envoy logs the TLS keys of upstream connections, key logging is off when empty
+	KeyLogDir string `yaml:"key_log_dir"`
+	// TrustBundle is the CA bundle Envoy verifies upstream certificates with
+	TrustBundle string `yaml:"trust_bundle"`
+
+	// CADir holds the intermediate CAs of the default tenant
+	CADir string `yaml:"ca_dir"`
+}
+
+// Default returns the settings of the docker compose setup.
+func Default() *Config {
+	return &Config{
+		Store:        "file:///app/certs",
+		GRPCListen:   ":50051",
+		ListenerPort: 8443,
+		ConnectPort:  3128,
+		HTTPPort:     8000,
+		UpstreamPort: 443,
+		ALSHost:      "als_service",
+		ALSPort:      50051,
+		KeyLogDir:    "/tmp",
+		TrustBundle:  "/etc/ssl/certs/ca-certificates.crt",
+		CADir:        "/app/cfssl",
+	}
+}
+
+// Flags registers a flag for every setting of c on fs, with the current values as defaults.
+func (c *Config) Flags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.Store, "store", c.Store, "Certificate store, file:///path/to/dir or sqlite:///path/to/file.db")
+	fs.StringVar(&c.GRPCListen, "grpc-listen", c.GRPCListen, "Address to serve gRPC on")
+	fs.Uint32Var(&c.ListenerPort, "listener-port", c.ListenerPort, "Port of the default tenant's listener (xds)")
+	fs.Uint32Var(&c.ConnectPort, "connect-port", c.ConnectPort, "Port of the default tenant's HTTP CONNECT proxy listener, disabled when 0 (xds)")
+	fs.Uint32Var(&c.HTTPPort, "http-port", c.HTTPPort, "Port of the default tenant's plaintext HTTP listener, disabled when 0 (xds)")
+	fs.Uint32Var(&c.UpstreamPort, "upstream-port", c.UpstreamPort, "Port upstreams are reached on")
+	fs.StringVar(&c.ALSHost, "als-host", c.ALSHost, "Host Envoy reaches the access log service at (xds)")
+	fs.Uint32Var(&c.ALSPort, "als-port", c.ALSPort, "Port Envoy reaches the access log service at (xds)")
+	fs.BoolVar(&c.OriginalDst, "original-dst", c.OriginalDst, "Send redirected connections to their original destination and port instead of the server name on --upstream-port (xds)")
+	fs.BoolVar(&c.Transparent, "transparent", c.Transparent, "Accept connections redirected with TPROXY, needs --original-dst (xds)")
+	fs.StringVar(&c.KeyLogDir, "key-log-dir", c.KeyLogDir, "Directory Envoy logs the TLS keys of upstream connections to, disabled when empty (xds)")
+	fs.StringVar(&c.TrustBundle, "trust-bundle", c.TrustBundle, "CA bundle Envoy verifies upstream certificates with (xds)")
+	fs.StringVar(&c.CADir, "ca-dir", c.CADir, "Directory holding the intermediate CAs of the default tenant (als)")
+	fs.String("config", "", "YAML file with the settings of this flag set, $"+EnvName("config")+" when unset")
+}
+
+// Load loads c from the file named by the --config flag, then the environment, then the command line.
+// fs must have been registered with Flags and parsed. Every flag of fs can be set from the environment,
+// not just the settings of c.
+func (c *Config) Load(fs *pflag.FlagSet) error {
+	path, err := fs.GetString("config")
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		path = os.Getenv(EnvName("config"))
+	}
+
+	// Flags write straight into c, the file would overwrite them
+	set := map[string]string{}
+	fs.Visit(func(f *pflag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading config: %w", err)
+		}
+
+		if err := yaml.UnmarshalStrict(data, c); err != nil {
+			return fmt.Errorf("invalid config %s: %w", path, err)
+		}
+	}
+
+	fs.VisitAll(func(f *pflag.Flag) {
+		value, ok := os.LookupEnv(EnvName(f.Name))
+		if _, onCommandLine := set[f.Name]; !ok || onCommandLine || err != nil {
+			return
+		}
+
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid %s: %w", EnvName(f.Name), setErr)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Every flag of both binaries is a scalar, setting one again is harmless if the file didn't touch it
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return err
+		}
+	}
+
+	return c.Validate()
+}
+
+// Validate checks that every required setting is there.
+func (c *Config) Validate() error {
+	for _, port := range []struct {
+		name  string
+		value uint32
+	}{
+		{"listener_port", c.ListenerPort},
+		{"upstream_port", c.UpstreamPort},
+		{"als_port", c.ALSPort},
+	} {
+		if port.value == 0 || port.value > 65535 {
+			return fmt.Errorf("invalid %s %d", port.name, port.value)
+		}
+	}
+
+	// Optional listeners are off at 0 and can't share a port with another listener
+	listeners := map[uint32]bool{c.ListenerPort: true}
+	for _, port := range []struct {
+		name  string
+		value uint32
+	}{
+		{"connect_port", c.ConnectPort},
+		{"http_port", c.HTTPPort},
+	} {
+		if port.value == 0 {
+			continue
+		}
+
+		if port.value > 65535 || listeners[port.value] {
+			return fmt.Errorf("invalid %s %d", port.name, port.value)
+		}
+		listeners[port.value] = true
+	}
+
+	if c.Transparent && !c.OriginalDst {
+		return fmt.Errorf("transparent needs original_dst")
+	}
+
+	for _, required := range []struct {
+		name  string
+		value string
+	}{
+		{"store", c.Store},
+		{"grpc_listen", c.GRPCListen},
+		{"als_host", c.ALSHost},
+		{"trust_bundle", c.TrustBundle},
+		{"ca_dir", c.CADir},
+	} {
+		if required.value == "" {
+			return fmt.Errorf("%s is required", required.name)
+		}
+	}
+
+	return nil
+}
+
+// EnvName returns the environment variable of flag name.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -0,0 +1,91 @@
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+
+	"github.com/epk/envoy-egress-mitm/config"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(`
+listener_port: 9443
+upstream_port: 8443
+als_host: als.internal
+key_log_dir: ""
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(config.EnvName("upstream-port"), "10443")
+	t.Setenv(config.EnvName("als-host"), "als.env")
+	t.Setenv(config.EnvName("policy"), "/env/policy.yaml")
+
+	cfg := config.Default()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	cfg.Flags(fs)
+	policyFile := fs.String("policy", "", "")
+
+	if err := fs.Parse([]string{"--config", path, "--als-host", "als.flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Load(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags beat the environment, which beats the file, which beats the defaults
+	want := config.Default()
+	want.ListenerPort = 9443
+	want.UpstreamPort = 10443
+	want.ALSHost = "als.flag"
+	want.KeyLogDir = ""
+	if *cfg != *want {
+		t.Fatalf("got %+v, want %+v", cfg, want)
+	}
+
+	if *policyFile != "/env/policy.yaml" {
+		t.Fatalf("policy flag not set from the environment: %q", *policyFile)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		want   string
+	}{
+		{name: "unknown setting", config: "listen: :50051", want: "not found"},
+		{name: "port", config: "als_port: 70000", want: "invalid als_port"},
+		{name: "connect port", config: "connect_port: 8443", want: "invalid connect_port"},
+		{name: "http port", config: "http_port: 3128", want: "invalid http_port"},
+		{name: "transparent", config: "transparent: true", want: "transparent needs original_dst"},
+		{name: "required", args: []string{"--trust-bundle", ""}, want: "trust_bundle is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := config.Default()
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			cfg.Flags(fs)
+
+			if err := fs.Parse(append([]string{"--config", path}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := cfg.Load(fs); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -27,11 +27,20 @@ var (
 	outFile    = pflag.StringP("out-file", "o", "results.csv", "Output file to write results to")
 
 	seedCertificates = pflag.BoolP("seed-certificates", "s", false, "Seed certificates and quit")
+	caBundle         = pflag.String("ca-bundle", "", "Trust bundle for the HTTPS proxy tests, the combined.crt embedded at build time when unset")
 )
 
 func main() {
 	pflag.Parse()
 
+	certPool := cfssl.CertPool()
+	if *caBundle != "" {
+		var err error
+		if certPool, err = cfssl.LoadCertPool(*caBundle); err != nil {
+			log.Fatalf("error loading trust bundle: %v\n", err)
+		}
+	}
+
 	domains, err := domainsList()
 	if err != nil {
 		log.Fatalf("error getting domains: %v\n", err)
@@ -54,7 +63,7 @@ func main() {
 		tcpProxy := runHTTPTests(newProxyClient(true, nil), domains)
 
 		// Test with Proxy and injecting root CA (L7/HTTPS)
-		httpsProxy := runHTTPTests(newProxyClient(true, cfssl.CertPool()), domains)
+		httpsProxy := runHTTPTests(newProxyClient(true, certPool), domains)
 
 		results = append(results, fmt.Sprintf("%s,%d,%d,%d\n", time.Now().Format("02-Jan-2006 15:04:05"), len(noProxy), len(tcpProxy), len(httpsProxy)))
 
@@ -0,0 +1,80 @@
+#!/usr/bin/env bash
+# Checks transparent mode from a client in its own network namespace, whose TLS and HTTP traffic is redirected
+# to Envoy on the host. Start the stack with docker-compose.transparent.yml first, then run as root:
+#   sudo ./e2e/transparent.sh
+set -euo pipefail
+
+NS=${NS:-egress-client}
+LISTENER_PORT=${LISTENER_PORT:-8443}
+HTTP_PORT=${HTTP_PORT:-8000}
+# badssl.com serves TLS on 1012 too, it shows that the port survives the redirect
+TLS_PORTS=${TLS_PORTS:-443,1012}
+CA=${CA:-./cfssl/combined.crt}
+
+HOST_IF=veth-egress
+NS_IF=veth-client
+SUBNET=10.200.0.0/24
+
+cleanup() {
+	iptables -t nat -D PREROUTING -i "$HOST_IF" -p tcp -m multiport --dports "$TLS_PORTS" -j REDIRECT --to-ports "$LISTENER_PORT" 2>/dev/null || true
+	iptables -t nat -D PREROUTING -i "$HOST_IF" -p tcp --dport 80 -j REDIRECT --to-ports "$HTTP_PORT" 2>/dev/null || true
+	iptables -t nat -D POSTROUTING -s "$SUBNET" -j MASQUERADE 2>/dev/null || true
+	ip netns del "$NS" 2>/dev/null || true
+	rm -rf "/etc/netns/$NS"
+}
+trap cleanup EXIT
+cleanup
+
+ip netns add "$NS"
+ip link add "$HOST_IF" type veth peer name "$NS_IF" netns "$NS"
+ip addr add 10.200.0.1/24 dev "$HOST_IF"
+ip link set "$HOST_IF" up
+ip -n "$NS" addr add 10.200.0.2/24 dev "$NS_IF"
+ip -n "$NS" link set "$NS_IF" up
+ip -n "$NS" link set lo up
+ip -n "$NS" route add default via 10.200.0.1
+
+mkdir -p "/etc/netns/$NS"
+echo "nameserver ${NAMESERVER:-1.1.1.1}" >"/etc/netns/$NS/resolv.conf"
+
+sysctl -qw net.ipv4.ip_forward=1
+# Everything else, DNS included, is routed out as usual
+iptables -t nat -A POSTROUTING -s "$SUBNET" -j MASQUERADE
+iptables -t nat -A PREROUTING -i "$HOST_IF" -p tcp -m multiport --dports "$TLS_PORTS" -j REDIRECT --to-ports "$LISTENER_PORT"
+iptables -t nat -A PREROUTING -i "$HOST_IF" -p tcp --dport 80 -j REDIRECT --to-ports "$HTTP_PORT"
+
+client() {
+	ip netns exec "$NS" "$@"
+}
+
+check() {
+	local name=$1
+	shift
+	if "$@" >/dev/null 2>&1; then
+		echo "ok   $name"
+	else
+		echo "FAIL $name"
+		failed=1
+	fi
+}
+
+failed=0
+
+# The first connection to a host is passed through to its original destination and mints a certificate,
+# the next ones are intercepted and trust our CA instead of the public one. Earlier runs may have minted
+# already, the first check only cares that the connection gets there.
+check "first connection on 443" client curl -sSfk -o /dev/null https://example.com
+sleep "${MINT_WAIT:-5}"
+check "intercepted on 443" client curl -sSf -o /dev/null --cacert "$CA" https://example.com
+
+check "first connection on 1012" client curl -sSfk -o /dev/null https://tls-v1-2.badssl.com:1012
+sleep "${MINT_WAIT:-5}"
+check "intercepted on 1012" client curl -sSf -o /dev/null --cacert "$CA" https://tls-v1-2.badssl.com:1012
+
+# Without a server name the original destination is all Envoy has to go on
+ip=$(client getent ahostsv4 example.com | awk 'NR == 1 { print $1 }')
+check "tls without sni" client sh -c "openssl s_client -connect $ip:443 -noservername </dev/null | grep -q 'BEGIN CERTIFICATE'"
+
+check "plaintext http" client curl -sSf -o /dev/null http://example.com
+
+exit "$failed"
@@ -0,0 +1,82 @@
+// Package hostname validates and normalizes the SNI values we mint certificates for.
+package hostname
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	maxNameLength  = 253
+	maxLabelLength = 63
+)
+
+var (
+	ErrEmpty     = errors.New("empty hostname")
+	ErrIPAddress = errors.New("hostname is an IP address")
+	ErrTooLong   = errors.New("hostname too long")
+	ErrInvalid   = errors.New("invalid hostname")
+	// ErrPublicSuffix is returned by Registrable for names that are themselves a public suffix
+	ErrPublicSuffix = errors.New("hostname is a public suffix")
+)
+
+// Normalize returns the canonical form of name: lowercase, punycode encoded and without a trailing dot.
+// Empty values, IP literals and anything that is not a valid DNS name are rejected.
+func Normalize(name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return "", ErrEmpty
+	}
+
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return "", fmt.Errorf("%w: %q", ErrIPAddress, name)
+	}
+
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %v", ErrInvalid, name, err)
+	}
+
+	if len(ascii) > maxNameLength {
+		return "", fmt.Errorf("%w: %d characters", ErrTooLong, len(ascii))
+	}
+
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" {
+			return "", fmt.Errorf("%w: %q has an empty label", ErrInvalid, name)
+		}
+
+		if len(label) > maxLabelLength {
+			return "", fmt.Errorf("%w: label %q exceeds %d characters", ErrTooLong, label, maxLabelLength)
+		}
+	}
+
+	// Punycode may still decode into something that looks like an IP
+	if net.ParseIP(ascii) != nil {
+		return "", fmt.Errorf("%w: %q", ErrIPAddress, name)
+	}
+
+	return ascii, nil
+}
+
+// IsCanonical reports whether name is already in its normalized form.
+func IsCanonical(name string) bool {
+	normalized, err := Normalize(name)
+	return err == nil && normalized == name
+}
+
+// Registrable returns the registrable domain of a normalized name according to the public suffix list,
+// i.e. example.com for www.example.com and example.co.uk for a.b.example.co.uk.
+func Registrable(name string) (string, error) {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", ErrPublicSuffix, name)
+	}
+
+	return domain, nil
+}
@@ -0,0 +1,91 @@
+package hostname_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/epk/envoy-egress-mitm/hostname"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "example.com", want: "example.com"},
+		{in: "WWW.Example.COM", want: "www.example.com"},
+		{in: "example.com.", want: "example.com"},
+		{in: "bücher.example", want: "xn--bcher-kva.example"},
+		{in: "xn--bcher-kva.example", want: "xn--bcher-kva.example"},
+		{in: "", wantErr: hostname.ErrEmpty},
+		{in: ".", wantErr: hostname.ErrEmpty},
+		{in: "127.0.0.1", wantErr: hostname.ErrIPAddress},
+		{in: "::1", wantErr: hostname.ErrIPAddress},
+		{in: "[2001:db8::1]", wantErr: hostname.ErrIPAddress},
+		{in: "../etc/passwd", wantErr: hostname.ErrInvalid},
+		{in: "foo/bar.com", wantErr: hostname.ErrInvalid},
+		{in: `foo\bar.com`, wantErr: hostname.ErrInvalid},
+		{in: "foo..com", wantErr: hostname.ErrInvalid},
+		{in: "example.com..", wantErr: hostname.ErrInvalid},
+		{in: "*.example.com", wantErr: hostname.ErrInvalid},
+		{in: strings.Repeat("a", 64) + ".com", wantErr: hostname.ErrTooLong},
+		{in: strings.Repeat("a.", 127) + "com", wantErr: hostname.ErrTooLong},
+	}
+
+	for _, tt := range tests {
+		got, err := hostname.Normalize(tt.in)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Normalize(%q) error = %v, want %v", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Normalize(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRegistrable(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr error
+	}{
+		{in: "example.com", want: "example.com"},
+		{in: "www.example.com", want: "example.com"},
+		{in: "a.b.example.co.uk", want: "example.co.uk"},
+		// Private suffixes belong to different owners, each one gets its own domain
+		{in: "foo.github.io", want: "foo.github.io"},
+		{in: "a.foo.github.io", want: "foo.github.io"},
+		{in: "com", wantErr: hostname.ErrPublicSuffix},
+		{in: "github.io", wantErr: hostname.ErrPublicSuffix},
+	}
+
+	for _, tt := range tests {
+		got, err := hostname.Registrable(tt.in)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Registrable(%q) error = %v, want %v", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Registrable(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Registrable(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// File holds the policy loaded from a file and reloads it when the file changes.
+type File struct {
+	path    string
+	current atomic.Pointer[Policy]
+}
+
+// Load reads the policy at path. An empty path intercepts everything and never changes.
+func Load(path string) (*File, error) {
+	f := &File{path: path}
+
+	if path == "" {
+		f.current.Store(Default())
+		return f, nil
+	}
+
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Policy returns the most recently loaded policy.
+func (f *File) Policy() *Policy {
+	if f == nil {
+		return nil
+	}
+
+	return f.current.Load()
+}
+
+// Watch reloads the policy whenever the file changes and sends a value on the returned channel after
+// every successful reload. A policy that fails to parse is logged and the previous one stays in effect.
+func (f *File) Watch(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+
+	if f.path == "" {
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+		return ch, nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// Watch the directory, editors and ConfigMap mounts replace the file rather than writing to it
+	if err := watcher.Add(filepath.Dir(f.path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer close(ch)
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(event.Name) != filepath.Clean(f.path) || event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				if err := f.reload(); err != nil {
+					log.Println("[policy] keeping previous policy:", err)
+					continue
+				}
+
+				log.Println("[policy] reloaded", f.path)
+
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("[policy] error watching policy file:", err)
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func (f *File) reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("error reading policy: %w", err)
+	}
+
+	p, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	f.current.Store(p)
+	return nil
+}
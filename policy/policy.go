@@ -0,0 +1,283 @@
+// Package policy decides which hosts may be intercepted.
+//
+// A policy is a YAML file with an ordered list of rules, the first rule that matches a host wins:
+//
+//	default: intercept
+//	rules:
+//	- exact: accounts.google.com
+//	  action: passthrough
+//	- wildcard: "*.apple.com"
+//	  action: passthrough
+//	- suffix: bank.example
+//	  action: passthrough
+//
+// Keys picks the key algorithms of minted certificates, policy wide or per rule. The first one is used for the
+// certificate and every other one for an alternate certificate, so that both RSA and ECDSA clients are served:
+//
+//	keys: [ecdsa-p256, rsa-2048]
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/epk/envoy-egress-mitm/hostname"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+type Action string
+
+const (
+	// Intercept hosts get a minted certificate and an L7 filter chain
+	Intercept Action = "intercept"
+	// Passthrough hosts are never minted and always stay on the L4 path
+	Passthrough Action = "passthrough"
+)
+
+type Policy struct {
+	Default Action               `yaml:"default,omitempty"`
+	Keys    []types.KeyAlgorithm `yaml:"keys,omitempty"`
+	Rules   []*Rule              `yaml:"rules,omitempty"`
+}
+
+// Rule matches hosts by exactly one of Exact, Wildcard or Suffix.
+type Rule struct {
+	// Exact matches a single host
+	Exact string `yaml:"exact,omitempty"`
+	// Wildcard is of the form *.example.com and matches exactly one label below example.com
+	Wildcard string `yaml:"wildcard,omitempty"`
+	// Suffix matches the domain itself and everything below it
+	Suffix string `yaml:"suffix,omitempty"`
+
+	Action Action `yaml:"action"`
+	// Keys overrides the key algorithms of the policy for the hosts the rule intercepts
+	Keys []types.KeyAlgorithm `yaml:"keys,omitempty"`
+}
+
+// Decision is the outcome of evaluating a host, Rule is nil when the default applied.
+type Decision struct {
+	Action Action
+	Rule   *Rule
+	// Index of Rule in the policy
+	Index int
+	// Keys to mint intercepted hosts with, types.DefaultKeyAlgorithm when empty
+	Keys []types.KeyAlgorithm
+}
+
+// Default intercepts everything, it is used when no policy file is configured.
+func Default() *Policy {
+	return &Policy{Default: Intercept}
+}
+
+// Parse reads and validates a policy, rule patterns are normalized like hosts are.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("error parsing policy: %w", err)
+	}
+
+	if p.Default == "" {
+		p.Default = Intercept
+	}
+
+	if err := validAction(p.Default); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+
+	if err := validKeys(p.Keys); err != nil {
+		return nil, fmt.Errorf("keys: %w", err)
+	}
+
+	for i, rule := range p.Rules {
+		if err := rule.normalize(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Decide evaluates host against the rules in order.
+func (p *Policy) Decide(host string) Decision {
+	if p == nil {
+		return Decision{Action: Intercept, Index: -1}
+	}
+
+	for i, rule := range p.Rules {
+		if rule.Matches(host) {
+			keys := rule.Keys
+			if len(keys) == 0 {
+				keys = p.Keys
+			}
+
+			return Decision{Action: rule.Action, Rule: rule, Index: i, Keys: keys}
+		}
+	}
+
+	return Decision{Action: p.Default, Index: -1, Keys: p.Keys}
+}
+
+// Intercepts reports whether host may be minted and moved to L7.
+func (p *Policy) Intercepts(host string) bool {
+	return p.Decide(host).Action == Intercept
+}
+
+// ErrUnconstrained is returned by PermittedDomains for policies that intercept every host by default.
+var ErrUnconstrained = errors.New("policy intercepts every host by default")
+
+// PermittedDomains returns the DNS name constraints covering every host the policy may intercept, for an
+// intermediate CA that can't sign for anything else. The constraints are as tight as X.509 allows: an exact
+// rule also permits the hosts below it, and passthrough rules aren't excluded.
+func (p *Policy) PermittedDomains() ([]string, error) {
+	if p == nil || p.Default == Intercept {
+		return nil, ErrUnconstrained
+	}
+
+	seen := map[string]bool{}
+	var domains []string
+	for _, rule := range p.Rules {
+		if rule.Action != Intercept {
+			continue
+		}
+
+		domain := rule.Constraint()
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, errors.New("policy does not intercept any host")
+	}
+
+	return domains, nil
+}
+
+// Constraint renders the rule as a DNS name constraint, .example.com only permits the hosts below example.com.
+func (r *Rule) Constraint() string {
+	switch {
+	case r.Exact != "":
+		return r.Exact
+	case r.Wildcard != "":
+		return strings.TrimPrefix(r.Wildcard, "*")
+	default:
+		return r.Suffix
+	}
+}
+
+func (r *Rule) Matches(host string) bool {
+	switch {
+	case r.Exact != "":
+		return host == r.Exact
+	case r.Wildcard != "":
+		parent := strings.TrimPrefix(r.Wildcard, "*.")
+		label := strings.TrimSuffix(host, "."+parent)
+		return label != host && label != "" && !strings.Contains(label, ".")
+	case r.Suffix != "":
+		return host == r.Suffix || strings.HasSuffix(host, "."+r.Suffix)
+	}
+
+	return false
+}
+
+// Regex renders the rule as an RE2 expression matching the same hosts as Matches, for Envoy to evaluate.
+func (r *Rule) Regex() string {
+	switch {
+	case r.Exact != "":
+		return "^" + regexp.QuoteMeta(r.Exact) + "$"
+	case r.Wildcard != "":
+		return `^[^.]+\.` + regexp.QuoteMeta(strings.TrimPrefix(r.Wildcard, "*.")) + "$"
+	default:
+		return `^(?:.+\.)?` + regexp.QuoteMeta(r.Suffix) + "$"
+	}
+}
+
+func (r *Rule) String() string {
+	switch {
+	case r.Exact != "":
+		return fmt.Sprintf("exact: %s", r.Exact)
+	case r.Wildcard != "":
+		return fmt.Sprintf("wildcard: %s", r.Wildcard)
+	default:
+		return fmt.Sprintf("suffix: %s", r.Suffix)
+	}
+}
+
+func (d Decision) String() string {
+	if d.Rule == nil {
+		return fmt.Sprintf("%s (default)", d.Action)
+	}
+
+	return fmt.Sprintf("%s (rule %d, %s)", d.Action, d.Index, d.Rule)
+}
+
+// validKeys checks keys like types.ValidKeyAlgorithms, and that Envoy can serve at least one of them.
+func validKeys(keys []types.KeyAlgorithm) error {
+	if err := types.ValidKeyAlgorithms(keys); err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if key.Servable() {
+			return nil
+		}
+	}
+
+	return errors.New("no key Envoy can serve, ed25519 needs an rsa or ecdsa key next to it")
+}
+
+func (r *Rule) normalize() error {
+	if err := validAction(r.Action); err != nil {
+		return err
+	}
+
+	if err := validKeys(r.Keys); err != nil {
+		return fmt.Errorf("keys: %w", err)
+	}
+
+	set := 0
+	for _, pattern := range []string{r.Exact, r.Wildcard, r.Suffix} {
+		if pattern != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of exact, wildcard or suffix must be set")
+	}
+
+	var err error
+	switch {
+	case r.Exact != "":
+		r.Exact, err = hostname.Normalize(r.Exact)
+	case r.Wildcard != "":
+		if !strings.HasPrefix(r.Wildcard, "*.") {
+			return fmt.Errorf("wildcard %q must start with *.", r.Wildcard)
+		}
+
+		var parent string
+		parent, err = hostname.Normalize(strings.TrimPrefix(r.Wildcard, "*."))
+		r.Wildcard = "*." + parent
+	case r.Suffix != "":
+		r.Suffix, err = hostname.Normalize(strings.TrimPrefix(r.Suffix, "."))
+	}
+
+	return err
+}
+
+func validAction(action Action) error {
+	switch action {
+	case Intercept, Passthrough:
+		return nil
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
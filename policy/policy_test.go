@@ -0,0 +1,208 @@
+package policy_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/policy"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+const testPolicy = `
+default: intercept
+rules:
+- exact: Accounts.Google.com
+  action: passthrough
+- wildcard: "*.apple.com"
+  action: passthrough
+- suffix: .bank.example
+  action: passthrough
+- suffix: example.com
+  action: intercept
+`
+
+func TestDecide(t *testing.T) {
+	p, err := policy.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host  string
+		want  policy.Action
+		index int
+	}{
+		{host: "accounts.google.com", want: policy.Passthrough, index: 0},
+		{host: "www.google.com", want: policy.Intercept, index: -1},
+		{host: "swscan.apple.com", want: policy.Passthrough, index: 1},
+		{host: "apple.com", want: policy.Intercept, index: -1},
+		{host: "a.b.apple.com", want: policy.Intercept, index: -1},
+		{host: "bank.example", want: policy.Passthrough, index: 2},
+		{host: "www.online.bank.example", want: policy.Passthrough, index: 2},
+		{host: "notbank.example", want: policy.Intercept, index: -1},
+		{host: "www.example.com", want: policy.Intercept, index: 3},
+	}
+
+	for _, tt := range tests {
+		got := p.Decide(tt.host)
+		if got.Action != tt.want || got.Index != tt.index {
+			t.Errorf("Decide(%q) = %s, want %s at index %d", tt.host, got, tt.want, tt.index)
+		}
+	}
+}
+
+func TestRegex(t *testing.T) {
+	p, err := policy.Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := []string{
+		"accounts.google.com", "xaccounts.google.com", "swscan.apple.com", "apple.com", "a.b.apple.com",
+		"bank.example", "www.online.bank.example", "notbank.example", "www.example.com", "example.com",
+	}
+
+	for _, rule := range p.Rules {
+		re := regexp.MustCompile(rule.Regex())
+		for _, host := range hosts {
+			if got, want := re.MatchString(host), rule.Matches(host); got != want {
+				t.Errorf("%s: regex %q matches %q = %v, want %v", rule, rule.Regex(), host, got, want)
+			}
+		}
+	}
+}
+
+func TestPermittedDomains(t *testing.T) {
+	p, err := policy.Parse([]byte(`
+default: passthrough
+rules:
+- suffix: internal.example
+  action: passthrough
+- suffix: Example.com
+  action: intercept
+- wildcard: "*.cdn.example.net"
+  action: intercept
+- exact: api.example.org
+  action: intercept
+- exact: api.example.org
+  keys: [ecdsa-p256]
+  action: intercept
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := p.PermittedDomains()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"example.com", ".cdn.example.net", "api.example.org"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if _, err := policy.Default().PermittedDomains(); !errors.Is(err, policy.ErrUnconstrained) {
+		t.Fatalf("expected ErrUnconstrained, got %v", err)
+	}
+
+	p, err = policy.Parse([]byte("default: passthrough\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.PermittedDomains(); err == nil {
+		t.Fatal("expected a policy that intercepts nothing to be rejected")
+	}
+}
+
+func TestDecideKeys(t *testing.T) {
+	p, err := policy.Parse([]byte(`
+keys: [ecdsa-p256, rsa-2048]
+rules:
+- suffix: legacy.example
+  action: intercept
+  keys: [rsa-4096]
+- exact: www.example.com
+  action: intercept
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]types.KeyAlgorithm{
+		"a.legacy.example": {types.RSA4096},
+		"www.example.com":  {types.ECDSAP256, types.RSA2048},
+		"example.org":      {types.ECDSAP256, types.RSA2048},
+	}
+
+	for host, want := range tests {
+		if got := p.Decide(host).Keys; !reflect.DeepEqual(got, want) {
+			t.Errorf("Decide(%q).Keys = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"unknown action":   "rules:\n- exact: example.com\n  action: block\n",
+		"unknown field":    "rules:\n- domain: example.com\n  action: passthrough\n",
+		"no pattern":       "rules:\n- action: passthrough\n",
+		"two patterns":     "rules:\n- exact: example.com\n  suffix: example.com\n  action: passthrough\n",
+		"bad wildcard":     "rules:\n- wildcard: example.com\n  action: passthrough\n",
+		"invalid host":     "rules:\n- exact: ../example.com\n  action: passthrough\n",
+		"unknown default":  "default: block\n",
+		"unknown key":      "keys: [dsa-1024]\n",
+		"duplicate family": "keys: [rsa-2048, rsa-4096]\n",
+		"only ed25519":     "keys: [ed25519]\n",
+		"rule ed25519":     "rules:\n- exact: example.com\n  action: intercept\n  keys: [ed25519]\n",
+		"bad rule key":     "rules:\n- exact: example.com\n  action: intercept\n  keys: [ecdsa-p521]\n",
+	} {
+		if _, err := policy.Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFileReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("default: intercept\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updateCh, err := f.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Policy().Intercepts("example.com") {
+		t.Fatal("expected example.com to be intercepted")
+	}
+
+	if err := os.WriteFile(path, []byte("default: passthrough\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-updateCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+
+	if f.Policy().Intercepts("example.com") {
+		t.Fatal("expected example.com to pass through after reload")
+	}
+}
@@ -0,0 +1,209 @@
+// Package revocation keeps track of revoked leaf certificates and serves their status over OCSP and a CRL.
+package revocation
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entry is a revoked certificate.
+type Entry struct {
+	// Serial is the hex encoded serial number
+	Serial string `json:"serial"`
+	// AuthorityKeyID is the hex encoded subject key ID of the issuer, each issuer only lists its own certificates
+	AuthorityKeyID string    `json:"authority_key_id,omitempty"`
+	SNI            string    `json:"sni"`
+	RevokedAt      time.Time `json:"revoked_at"`
+	// Reason is an RFC 5280 CRLReason, see the constants in golang.org/x/crypto/ocsp
+	Reason int `json:"reason"`
+}
+
+// List is the set of revoked certificates, persisted as a JSON file so that it survives restarts.
+// Other processes may append to the file, it is reloaded whenever it changes on disk.
+type List struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	modTime time.Time
+	size    int64
+}
+
+// Open loads the list at path, a missing file is an empty list.
+func Open(path string) (*List, error) {
+	l := &List{
+		path:    path,
+		entries: map[string]*Entry{},
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Revoke records cert as revoked.
+func (l *List) Revoke(cert *x509.Certificate, sni string, reason int, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Pick up revocations made by others so that we don't overwrite them
+	if err := l.reload(); err != nil {
+		return err
+	}
+
+	key := cert.SerialNumber.Text(16)
+	if _, ok := l.entries[key]; ok {
+		return nil
+	}
+
+	l.entries[key] = &Entry{
+		Serial:         key,
+		AuthorityKeyID: hex.EncodeToString(cert.AuthorityKeyId),
+		SNI:            sni,
+		RevokedAt:      now.UTC(),
+		Reason:         reason,
+	}
+
+	return l.save()
+}
+
+// RevokedBy reports whether the entry belongs to the issuer with subject key ID keyID.
+// Entries recorded before issuers were told apart belong to every issuer.
+func (e *Entry) RevokedBy(keyID []byte) bool {
+	return e.AuthorityKeyID == "" || e.AuthorityKeyID == hex.EncodeToString(keyID)
+}
+
+// Lookup returns the entry of serial if it has been revoked.
+func (l *List) Lookup(serial *big.Int) (*Entry, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.reload(); err != nil {
+		return nil, false, err
+	}
+
+	entry, ok := l.entries[serial.Text(16)]
+	return entry, ok, nil
+}
+
+// Entries returns every revoked certificate, oldest first. The second value is when the list last changed.
+func (l *List) Entries() ([]*Entry, time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.reload(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].RevokedAt.Equal(entries[j].RevokedAt) {
+			return entries[i].RevokedAt.Before(entries[j].RevokedAt)
+		}
+		return entries[i].Serial < entries[j].Serial
+	})
+
+	return entries, l.modTime, nil
+}
+
+// reload reads the file if it changed since it was last read, l.mu must be held.
+func (l *List) reload() error {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading revocation list: %w", err)
+	}
+
+	if info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("error reading revocation list: %w", err)
+	}
+
+	var entries []*Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("error parsing revocation list %s: %w", l.path, err)
+	}
+
+	l.entries = make(map[string]*Entry, len(entries))
+	for _, entry := range entries {
+		l.entries[entry.Serial] = entry
+	}
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+
+	return nil
+}
+
+// save atomically replaces the file, l.mu must be held.
+func (l *List) save() error {
+	entries := make([]*Entry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Serial < entries[j].Serial })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding revocation list: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("error writing revocation list: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".revoked-*")
+	if err != nil {
+		return fmt.Errorf("error writing revocation list: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing revocation list: %w", err)
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing revocation list: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing revocation list: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return fmt.Errorf("error writing revocation list: %w", err)
+	}
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("error reading revocation list: %w", err)
+	}
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package revocation_test
+
+import (
+	"crypto/x509"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/epk/envoy-egress-mitm/revocation"
+)
+
+func TestList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations", "revoked.json")
+
+	list, err := revocation.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, revoked, err := list.Lookup(big.NewInt(1)); err != nil || revoked {
+		t.Fatalf("unexpected lookup result %v, %v", revoked, err)
+	}
+
+	now := time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC)
+	if err := list.Revoke(&x509.Certificate{SerialNumber: big.NewInt(1)}, "example.com", ocsp.KeyCompromise, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another process, e.g. the revoke command, sees and extends the list
+	other, err := revocation.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, revoked, err := other.Lookup(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked || entry.SNI != "example.com" || entry.Reason != ocsp.KeyCompromise || !entry.RevokedAt.Equal(now) {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	if err := other.Revoke(&x509.Certificate{SerialNumber: big.NewInt(255)}, "example.org", ocsp.Unspecified, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _, err := list.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Serial != "1" || entries[1].Serial != "ff" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	// Revoking again keeps the original entry
+	if err := list.Revoke(&x509.Certificate{SerialNumber: big.NewInt(1)}, "example.com", ocsp.Superseded, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, _, err = other.Lookup(big.NewInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Reason != ocsp.KeyCompromise {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
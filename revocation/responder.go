@@ -0,0 +1,290 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/epk/envoy-egress-mitm/signer"
+)
+
+const (
+	// Paths the responder serves, signer.SetRevocationURLs points minted certificates at them
+	OCSPPath = "/ocsp"
+	CRLPath  = "/crl"
+
+	maxRequestSize = 10 << 10
+)
+
+var (
+	oidReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+	errUnknownIssuer = errors.New("unknown issuer")
+)
+
+// Responder answers OCSP requests and serves a CRL for the certificates of every issuer that still has a key.
+// CRLs are regenerated when the list changes or at least every refresh.
+type Responder struct {
+	// issuers is keyed by name
+	issuers map[string]*signer.Issuer
+	list    *List
+	refresh time.Duration
+
+	mu   sync.Mutex
+	crls map[string]*cachedCRL
+}
+
+type cachedCRL struct {
+	der       []byte
+	updated   time.Time
+	listAsOf  time.Time
+	nextCheck time.Time
+}
+
+func NewResponder(issuers []*signer.Issuer, list *List, refresh time.Duration) *Responder {
+	r := &Responder{
+		issuers: map[string]*signer.Issuer{},
+		list:    list,
+		refresh: refresh,
+		crls:    map[string]*cachedCRL{},
+	}
+
+	// Retired issuers can't sign responses
+	for _, issuer := range issuers {
+		if issuer.Key != nil {
+			r.issuers[issuer.Name] = issuer
+		}
+	}
+
+	return r
+}
+
+// Handler serves OCSP at OCSPPath, the CRL of signer.DefaultIssuer at CRLPath and that of every other issuer
+// at CRLPath/<issuer>.
+func (r *Responder) Handler() http.Handler {
+	// Not a ServeMux, its path cleaning collapses the "//" a base64 encoded GET request may contain
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch path := req.URL.Path; {
+		case path == OCSPPath || strings.HasPrefix(path, OCSPPath+"/"):
+			r.serveOCSP(w, req)
+		case path == CRLPath || strings.HasPrefix(path, CRLPath+"/"):
+			r.serveCRL(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+}
+
+// serveOCSP handles both POST requests and GET requests with the base64 encoded request in the path, see RFC 6960 A.1.
+func (r *Responder) serveOCSP(w http.ResponseWriter, req *http.Request) {
+	var der []byte
+	switch req.Method {
+	case http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxRequestSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		der = body
+	case http.MethodGet:
+		encoded, err := url.PathUnescape(strings.TrimPrefix(req.URL.EscapedPath(), OCSPPath+"/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		der, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(r.OCSP(der, time.Now()))
+}
+
+func (r *Responder) serveCRL(w http.ResponseWriter, req *http.Request) {
+	name := signer.DefaultIssuer
+	if req.URL.Path != CRLPath {
+		name = strings.TrimPrefix(req.URL.Path, CRLPath+"/")
+	}
+
+	crl, err := r.CRL(name, time.Now())
+	if errors.Is(err, errUnknownIssuer) {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		log.Println("Error creating CRL:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// OCSP answers a DER encoded OCSP request. Serials we never revoked are reported as good,
+// we don't keep track of everything we issued.
+func (r *Responder) OCSP(der []byte, now time.Time) []byte {
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse
+	}
+
+	issuer := r.issuerOf(req)
+	if issuer == nil {
+		return ocsp.UnauthorizedErrorResponse
+	}
+
+	entry, revoked, err := r.list.Lookup(req.SerialNumber)
+	if err != nil {
+		log.Println("Error reading revocation list:", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(r.refresh),
+	}
+	if revoked && entry.RevokedBy(issuer.Cert.SubjectKeyId) {
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = entry.RevokedAt
+		tmpl.RevocationReason = entry.Reason
+	}
+
+	resp, err := ocsp.CreateResponse(issuer.Cert, issuer.Cert, tmpl, issuer.Key)
+	if err != nil {
+		log.Println("Error creating OCSP response:", err)
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	return resp
+}
+
+// issuerOf returns the issuer req asks about, or nil if it isn't one of ours.
+func (r *Responder) issuerOf(req *ocsp.Request) *signer.Issuer {
+	if !req.HashAlgorithm.Available() {
+		return nil
+	}
+
+	for _, issuer := range r.issuers {
+		var spki struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}
+		if _, err := asn1.Unmarshal(issuer.Cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+			continue
+		}
+
+		h := req.HashAlgorithm.New()
+		h.Write(spki.PublicKey.RightAlign())
+		keyHash := h.Sum(nil)
+
+		h = req.HashAlgorithm.New()
+		h.Write(issuer.Cert.RawSubject)
+		nameHash := h.Sum(nil)
+
+		if bytes.Equal(keyHash, req.IssuerKeyHash) && bytes.Equal(nameHash, req.IssuerNameHash) {
+			return issuer
+		}
+	}
+
+	return nil
+}
+
+// CRL returns the DER encoded CRL of the issuer named name, regenerating it when it is due or the list changed.
+func (r *Responder) CRL(name string, now time.Time) ([]byte, error) {
+	issuer, ok := r.issuers[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownIssuer, name)
+	}
+
+	entries, asOf, err := r.list.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cached := r.crls[name]
+	if cached == nil {
+		cached = &cachedCRL{}
+		r.crls[name] = cached
+	}
+
+	if cached.der != nil && asOf.Equal(cached.listAsOf) && now.Before(cached.nextCheck) {
+		return cached.der, nil
+	}
+
+	revoked := make([]pkix.RevokedCertificate, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.RevokedBy(issuer.Cert.SubjectKeyId) {
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(entry.Serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q in revocation list", entry.Serial)
+		}
+
+		revokedCert := pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: entry.RevokedAt,
+		}
+
+		if entry.Reason != ocsp.Unspecified {
+			reason, err := asn1.Marshal(asn1.Enumerated(entry.Reason))
+			if err != nil {
+				return nil, fmt.Errorf("error encoding revocation reason: %w", err)
+			}
+			revokedCert.Extensions = []pkix.Extension{{Id: oidReasonCode, Value: reason}}
+		}
+
+		revoked = append(revoked, revokedCert)
+	}
+
+	// CRL numbers must increase, a timestamp does as long as we don't regenerate twice a second
+	number := now.Unix()
+	if number <= cached.updated.Unix() {
+		number = cached.updated.Unix() + 1
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(number),
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(r.refresh),
+		RevokedCertificates: revoked,
+	}, issuer.Cert, issuer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error signing CRL: %w", err)
+	}
+
+	cached.der = der
+	cached.updated = time.Unix(number, 0)
+	cached.listAsOf = asOf
+	cached.nextCheck = now.Add(r.refresh / 2)
+
+	return der, nil
+}
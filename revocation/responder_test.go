@@ -0,0 +1,432 @@
+package revocation_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/revocation"
+	"github.com/epk/envoy-egress-mitm/signer"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestResponder(t *testing.T) {
+	s := newTestSigner(t)
+	issuer := s.Active().Cert
+
+	list, err := revocation.Open(filepath.Join(t.TempDir(), "revoked.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(revocation.NewResponder(s.Issuers(), list, time.Hour).Handler())
+	defer srv.Close()
+
+	store := certstore.NewFileStore(t.TempDir(), time.Minute)
+	defer store.Close()
+
+	ctx := context.Background()
+
+	cert, err := s.Issue([]types.KeyAlgorithm{types.ECDSAP256, types.RSA2048}, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, cert); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alternate, err := (&types.Certificate{Cert: cert.Alternates[0].Cert}).Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := queryOCSP(t, srv.URL, http.MethodPost, leaf, issuer); got.Status != ocsp.Good {
+		t.Fatalf("unexpected status %d", got.Status)
+	}
+
+	if err := revocation.RevokeCertificate(ctx, store, list, cert, ocsp.KeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get(ctx, "example.com"); !errors.Is(err, certstore.ErrNotFound) {
+		t.Fatalf("certificate was not evicted: %v", err)
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodGet} {
+		for _, c := range []*x509.Certificate{leaf, alternate} {
+			got := queryOCSP(t, srv.URL, method, c, issuer)
+			if got.Status != ocsp.Revoked || got.RevocationReason != ocsp.KeyCompromise {
+				t.Fatalf("%s: unexpected status %d, reason %d", method, got.Status, got.RevocationReason)
+			}
+		}
+	}
+
+	resp, err := http.Get(srv.URL + revocation.CRLPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	der, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked := map[string]bool{}
+	for _, entry := range crl.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = true
+	}
+
+	if len(revoked) != 2 || !revoked[leaf.SerialNumber.String()] || !revoked[alternate.SerialNumber.String()] {
+		t.Fatalf("unexpected revoked certificates %v", revoked)
+	}
+}
+
+func TestResponderUnknownIssuer(t *testing.T) {
+	s := newTestSigner(t)
+
+	list, err := revocation.Open(filepath.Join(t.TempDir(), "revoked.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := newTestSigner(t)
+	otherIssuer := other.Active().Cert
+
+	cert, err := other.Sign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := ocsp.CreateRequest(leaf, otherIssuer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := revocation.NewResponder(s.Issuers(), list, time.Hour).OCSP(req, time.Now())
+	if !bytes.Equal(resp, ocsp.UnauthorizedErrorResponse) {
+		t.Fatal("expected an unauthorized response")
+	}
+}
+
+func TestResponderGETSlashes(t *testing.T) {
+	s := newTestSigner(t)
+	issuer := s.Active().Cert
+
+	list, err := revocation.Open(filepath.Join(t.TempDir(), "revoked.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(revocation.NewResponder(s.Issuers(), list, time.Hour).Handler())
+	defer srv.Close()
+
+	cert, err := s.Issue([]types.KeyAlgorithm{types.ECDSAP256}, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A serial of all ones encodes to a run of slashes
+	req.SerialNumber, _ = new(big.Int).SetString("7fffffffffffffff", 16)
+	der, err = req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(der)
+	if !strings.Contains(encoded, "//") {
+		t.Fatalf("%s doesn't contain //", encoded)
+	}
+
+	resp, err := http.Get(srv.URL + revocation.OCSPPath + "/" + encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ocsp.ParseResponse(body, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Status != ocsp.Good || parsed.SerialNumber.Cmp(req.SerialNumber) != 0 {
+		t.Fatalf("unexpected status %d for serial %x", parsed.Status, parsed.SerialNumber)
+	}
+}
+
+func TestCRLNumber(t *testing.T) {
+	s := newTestSigner(t)
+	issuer := s.Active().Cert
+
+	list, err := revocation.Open(filepath.Join(t.TempDir(), "revoked.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder := revocation.NewResponder(s.Issuers(), list, time.Hour)
+
+	now := time.Now()
+	first := parseCRL(t, responder, now)
+
+	// Served from cache until half the refresh interval passed
+	if cached := parseCRL(t, responder, now.Add(time.Minute)); cached.Number.Cmp(first.Number) != 0 {
+		t.Fatalf("CRL regenerated too early, number %s", cached.Number)
+	}
+
+	// A revocation shows up right away
+	if err := list.Revoke(&x509.Certificate{SerialNumber: big.NewInt(42), AuthorityKeyId: issuer.SubjectKeyId}, "example.com", ocsp.Unspecified, now); err != nil {
+		t.Fatal(err)
+	}
+
+	second := parseCRL(t, responder, now.Add(2*time.Minute))
+	if second.Number.Cmp(first.Number) <= 0 {
+		t.Fatalf("CRL number did not increase: %s <= %s", second.Number, first.Number)
+	}
+	if len(second.RevokedCertificates) != 1 {
+		t.Fatalf("unexpected revoked certificates %v", second.RevokedCertificates)
+	}
+
+	third := parseCRL(t, responder, now.Add(time.Hour))
+	if third.Number.Cmp(second.Number) <= 0 {
+		t.Fatalf("CRL number did not increase: %s <= %s", third.Number, second.Number)
+	}
+	if !third.NextUpdate.After(now.Add(time.Hour)) {
+		t.Fatalf("unexpected next update %s", third.NextUpdate)
+	}
+}
+
+func TestResponderRotation(t *testing.T) {
+	s := newTestSigner(t)
+
+	newCertPEM, newKeyPEM := newTestCA(t)
+	if err := s.AddIssuer("intermediate-ca-2", newCertPEM, newKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := s.Sign("old.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Activate("intermediate-ca-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := s.Sign("new.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := revocation.Open(filepath.Join(t.TempDir(), "revoked.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(revocation.NewResponder(s.Issuers(), list, time.Hour).Handler())
+	defer srv.Close()
+
+	store := certstore.NewFileStore(t.TempDir(), time.Minute)
+	defer store.Close()
+
+	for _, cert := range []*types.Certificate{old, current} {
+		if err := store.Put(context.Background(), cert); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := revocation.RevokeCertificate(context.Background(), store, list, cert, ocsp.Superseded); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, cert := range map[string]*types.Certificate{
+		revocation.CRLPath:                        old,
+		revocation.CRLPath + "/intermediate-ca-2": current,
+	} {
+		leaf, err := cert.Leaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		issuer := s.IssuerOf(cert)
+		if issuer == nil || issuer.Name != cert.Issuer {
+			t.Fatalf("%s: unexpected issuer %v", path, issuer)
+		}
+
+		if got := queryOCSP(t, srv.URL, http.MethodPost, leaf, issuer.Cert); got.Status != ocsp.Revoked {
+			t.Fatalf("%s: unexpected status %d", path, got.Status)
+		}
+
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		der, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := crl.CheckSignatureFrom(issuer.Cert); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+
+		// Each issuer only lists the certificates it issued
+		if len(crl.RevokedCertificates) != 1 || crl.RevokedCertificates[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+			t.Fatalf("%s: unexpected revoked certificates %v", path, crl.RevokedCertificates)
+		}
+	}
+}
+
+func parseCRL(t *testing.T, responder *revocation.Responder, now time.Time) *x509.RevocationList {
+	t.Helper()
+
+	der, err := responder.CRL(signer.DefaultIssuer, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return crl
+}
+
+func queryOCSP(t *testing.T, base, method string, cert, issuer *x509.Certificate) *ocsp.Response {
+	t.Helper()
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp *http.Response
+	if method == http.MethodGet {
+		resp, err = http.Get(base + revocation.OCSPPath + "/" + url.PathEscape(base64.StdEncoding.EncodeToString(req)))
+	} else {
+		resp, err = http.Post(base+revocation.OCSPPath, "application/ocsp-request", bytes.NewReader(req))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	der, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func newTestSigner(t *testing.T) *signer.Signer {
+	t.Helper()
+
+	s, err := signer.New(newTestCA(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func newTestCA(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test intermediate CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -0,0 +1,37 @@
+package revocation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/certstore"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// RevokeCertificate revokes every key pair of cert and evicts it from store, so that
+// its host falls back to L4 passthrough until a new certificate is minted.
+func RevokeCertificate(ctx context.Context, store certstore.Store, list *List, cert *types.Certificate, reason int) error {
+	certs := []*types.Certificate{cert}
+	for _, alternate := range cert.Alternates {
+		certs = append(certs, &types.Certificate{SNI: cert.SNI, Key: alternate.Key, Cert: alternate.Cert})
+	}
+
+	now := time.Now()
+	for _, c := range certs {
+		leaf, err := c.Leaf()
+		if err != nil {
+			return fmt.Errorf("error parsing certificate for %s: %w", cert.SNI, err)
+		}
+
+		if err := list.Revoke(leaf, cert.SNI, reason, now); err != nil {
+			return err
+		}
+	}
+
+	if err := store.Delete(ctx, cert.SNI); err != nil {
+		return fmt.Errorf("error deleting certificate for %s: %w", cert.SNI, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+// ConstraintError is returned when a name is outside the name constraints of the active issuer.
+type ConstraintError struct {
+	Name   string
+	Issuer string
+	// Permitted are the DNS subtrees the issuer may sign for
+	Permitted []string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%s is outside the name constraints of issuer %q (permitted: %s)", e.Name, e.Issuer, strings.Join(e.Permitted, ", "))
+}
+
+// Permits reports whether the active issuer may sign for every name.
+func (s *Signer) Permits(names ...string) bool {
+	return s.checkConstraints(names) == nil
+}
+
+// checkConstraints returns a *ConstraintError for the first name the active issuer may not sign for.
+// We check before signing, clients would reject the certificate anyway.
+func (s *Signer) checkConstraints(names []string) error {
+	for _, name := range names {
+		if !permitted(s.active.Cert, name) {
+			return &ConstraintError{
+				Name:      name,
+				Issuer:    s.active.Name,
+				Permitted: s.active.Cert.PermittedDNSDomains,
+			}
+		}
+	}
+
+	return nil
+}
+
+// permittedNames returns the names the active issuer may sign for.
+func (s *Signer) permittedNames(names []string) []string {
+	var out []string
+	for _, name := range names {
+		if permitted(s.active.Cert, name) {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
+
+func (s *Signer) permittedIPs(ips []net.IP) []net.IP {
+	var out []net.IP
+	for _, ip := range ips {
+		if permitted(s.active.Cert, ip.String()) {
+			out = append(out, ip)
+		}
+	}
+
+	return out
+}
+
+// permitted reports whether ca may sign for name according to its name constraints.
+// Like in RFC 5280, constraints only apply to the name types they are given for.
+func permitted(ca *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		for _, excluded := range ca.ExcludedIPRanges {
+			if excluded.Contains(ip) {
+				return false
+			}
+		}
+
+		if len(ca.PermittedIPRanges) == 0 {
+			return true
+		}
+
+		for _, permitted := range ca.PermittedIPRanges {
+			if permitted.Contains(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, excluded := range ca.ExcludedDNSDomains {
+		if matchDomain(name, excluded) {
+			return false
+		}
+	}
+
+	if len(ca.PermittedDNSDomains) == 0 {
+		return true
+	}
+
+	for _, permitted := range ca.PermittedDNSDomains {
+		if matchDomain(name, permitted) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDomain matches name against a DNS name constraint: example.com matches itself and everything below,
+// .example.com only what is below.
+func matchDomain(name, constraint string) bool {
+	name = strings.ToLower(name)
+	constraint = strings.ToLower(constraint)
+
+	if constraint == "" {
+		return true
+	}
+
+	if strings.HasPrefix(constraint, ".") {
+		return len(name) > len(constraint) && strings.HasSuffix(name, constraint)
+	}
+
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// Intermediate describes an intermediate CA for NewIntermediate to create.
+type Intermediate struct {
+	CommonName string
+	Algorithm  types.KeyAlgorithm
+	Lifetime   time.Duration
+	// PermittedDNSDomains become the critical name constraints of the intermediate, it is unconstrained when empty
+	PermittedDNSDomains []string
+}
+
+// NewIntermediate creates a key and certificate for an intermediate CA, signed by the PEM encoded root.
+func NewIntermediate(rootCertPEM, rootKeyPEM []byte, spec Intermediate) (certPEM, keyPEM []byte, err error) {
+	block, _ := pem.Decode(rootCertPEM)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data found in root certificate")
+	}
+
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing root certificate: %w", err)
+	}
+
+	if !root.IsCA {
+		return nil, nil, fmt.Errorf("certificate %q is not a CA", root.Subject.CommonName)
+	}
+
+	rootKey, err := parsePrivateKey(rootKeyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing root key: %w", err)
+	}
+
+	key, _, err := generateKey(spec.Algorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error generating serial number: %w", err)
+	}
+
+	now := time.Now()
+	notAfter := now.Add(spec.Lifetime)
+	if notAfter.After(root.NotAfter) {
+		notAfter = root.NotAfter
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: spec.CommonName},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// Only leaves below us
+		MaxPathLenZero:              true,
+		PermittedDNSDomainsCritical: len(spec.PermittedDNSDomains) > 0,
+		PermittedDNSDomains:         spec.PermittedDNSDomains,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, root, key.Public(), rootKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error signing intermediate certificate: %w", err)
+	}
+
+	keyPEM, err = marshalPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, nil
+}
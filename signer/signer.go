@@ -0,0 +1,466 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+const (
+	// Matches the "certificate" profile in cfssl/cfssl.json
+	defaultExpiry = 240 * time.Hour
+	// Tolerate a little clock skew between us and the client
+	backdate = 5 * time.Minute
+)
+
+// DefaultIssuer is the name of the intermediate CA created by the README steps.
+const DefaultIssuer = "intermediate-ca"
+
+// Issuer is an intermediate CA known to the Signer. Retired issuers have no key,
+// their certificates are still recognized but nothing new is issued with them.
+type Issuer struct {
+	Name string
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Signer issues leaf certificates signed by the active intermediate CA.
+// The CAs are loaded once, every certificate is minted in-process.
+type Signer struct {
+	// issuers is sorted by name
+	issuers []*Issuer
+	active  *Issuer
+
+	expiry time.Duration
+
+	// Revocation endpoints put into the AIA and CDP extensions of every certificate, unset when empty
+	ocspURL string
+	crlURL  string
+}
+
+// Load reads every intermediate-ca*.crt in dir together with its .key and activates the issuer named active.
+// An issuer without a key file is retired.
+func Load(dir, active string) (*Signer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, DefaultIssuer+"*.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing intermediate CA certificates: %w", err)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("error reading intermediate CA certificate: no %s*.crt in %s", DefaultIssuer, dir)
+	}
+
+	s := &Signer{expiry: defaultExpiry}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".crt")
+
+		certPEM, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading intermediate CA certificate: %w", err)
+		}
+
+		keyPEM, err := os.ReadFile(filepath.Join(dir, name+".key"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error reading intermediate CA key: %w", err)
+		}
+
+		if err := s.AddIssuer(name, certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.Activate(active); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// New creates a Signer from a PEM encoded CA certificate and private key, the issuer is named DefaultIssuer.
+func New(certPEM, keyPEM []byte) (*Signer, error) {
+	s := &Signer{expiry: defaultExpiry}
+	if err := s.AddIssuer(DefaultIssuer, certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+
+	if err := s.Activate(DefaultIssuer); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// AddIssuer makes the PEM encoded CA certificate known as name. keyPEM may be empty for a retired issuer.
+func (s *Signer) AddIssuer(name string, certPEM, keyPEM []byte) error {
+	if s.Issuer(name) != nil {
+		return fmt.Errorf("duplicate issuer %q", name)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return errors.New("no PEM data found in CA certificate")
+	}
+
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("error parsing CA certificate: %w", err)
+	}
+
+	if !caCert.IsCA {
+		return fmt.Errorf("certificate %q is not a CA", caCert.Subject.CommonName)
+	}
+
+	issuer := &Issuer{Name: name, Cert: caCert}
+
+	if len(keyPEM) > 0 {
+		caKey, err := parsePrivateKey(keyPEM)
+		if err != nil {
+			return fmt.Errorf("error parsing CA key: %w", err)
+		}
+
+		if pub, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(caCert.PublicKey) {
+			return fmt.Errorf("CA key of issuer %q does not match its certificate", name)
+		}
+
+		issuer.Key = caKey
+	}
+
+	s.issuers = append(s.issuers, issuer)
+	sort.Slice(s.issuers, func(i, j int) bool { return s.issuers[i].Name < s.issuers[j].Name })
+
+	return nil
+}
+
+// Activate makes every certificate issued from now on come from the issuer named name.
+func (s *Signer) Activate(name string) error {
+	issuer := s.Issuer(name)
+	if issuer == nil {
+		return fmt.Errorf("unknown issuer %q", name)
+	}
+
+	if issuer.Key == nil {
+		return fmt.Errorf("issuer %q is retired, it has no key", name)
+	}
+
+	s.active = issuer
+	return nil
+}
+
+// Issuer returns the issuer named name, or nil.
+func (s *Signer) Issuer(name string) *Issuer {
+	for _, issuer := range s.issuers {
+		if issuer.Name == name {
+			return issuer
+		}
+	}
+
+	return nil
+}
+
+// Issuers returns every known issuer sorted by name.
+func (s *Signer) Issuers() []*Issuer {
+	return s.issuers
+}
+
+// Active returns the issuer new certificates are signed with.
+func (s *Signer) Active() *Issuer {
+	return s.active
+}
+
+// IssuerOf returns the issuer that signed cert, or nil if it was none of ours.
+func (s *Signer) IssuerOf(cert *types.Certificate) *Issuer {
+	leaf, err := cert.Leaf()
+	if err != nil {
+		return nil
+	}
+
+	for _, issuer := range s.issuers {
+		if leaf.CheckSignatureFrom(issuer.Cert) == nil {
+			return issuer
+		}
+	}
+
+	return nil
+}
+
+// SetRevocationURLs makes every certificate issued from now on point clients at the given OCSP responder and CRL.
+// Certificates of issuers other than DefaultIssuer point at crlURL/<issuer> instead, each issuer signs its own CRL.
+func (s *Signer) SetRevocationURLs(ocspURL, crlURL string) {
+	s.ocspURL = ocspURL
+	s.crlURL = crlURL
+}
+
+// Sign mints a new key pair and a leaf certificate for sni.
+func (s *Signer) Sign(sni string) (*types.Certificate, error) {
+	return s.Issue(nil, sni)
+}
+
+// Issue mints a leaf certificate valid for every name, the first one is the common name and the SNI of the
+// returned certificate. Names may be wildcards such as *.example.com. The certificate gets a key of the first
+// algorithm and an alternate for every other one, types.DefaultKeyAlgorithm is used when there are none.
+func (s *Signer) Issue(algorithms []types.KeyAlgorithm, names ...string) (*types.Certificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no names to issue a certificate for")
+	}
+
+	if len(algorithms) == 0 {
+		algorithms = []types.KeyAlgorithm{types.DefaultKeyAlgorithm}
+	}
+
+	if err := types.ValidKeyAlgorithms(algorithms); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkConstraints(names); err != nil {
+		return nil, err
+	}
+
+	var out *types.Certificate
+	for _, algorithm := range algorithms {
+		key, keyUsage, err := generateKey(algorithm)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		tmpl := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: names[0]},
+			NotBefore:             now.Add(-backdate),
+			NotAfter:              now.Add(s.expiry),
+			KeyUsage:              keyUsage,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			BasicConstraintsValid: true,
+		}
+
+		for _, name := range names {
+			if ip := net.ParseIP(name); ip != nil {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			} else {
+				tmpl.DNSNames = append(tmpl.DNSNames, name)
+			}
+		}
+
+		cert, err := s.sign(names[0], tmpl, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if out == nil {
+			out = cert
+			continue
+		}
+
+		out.Alternates = append(out.Alternates, &types.KeyPair{
+			Algorithm: algorithm,
+			Key:       cert.Key,
+			Cert:      cert.Cert,
+		})
+	}
+
+	return out, nil
+}
+
+// Mimic mints a leaf certificate for sni that looks like upstream, the certificate the real server presents:
+// same subject, SANs, key type and lifetime. sni is added to the SANs if upstream doesn't cover it, SANs outside
+// the name constraints of the issuer are left out.
+func (s *Signer) Mimic(sni string, upstream *x509.Certificate) (*types.Certificate, error) {
+	if err := s.checkConstraints([]string{sni}); err != nil {
+		return nil, err
+	}
+
+	key, keyUsage, err := generateKeyLike(upstream.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := upstream.NotAfter.Sub(upstream.NotBefore)
+	if lifetime <= 0 {
+		lifetime = s.expiry
+	}
+
+	now := time.Now()
+
+	subject := upstream.Subject
+	subject.Names = nil
+
+	tmpl := &x509.Certificate{
+		Subject:               subject,
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(lifetime - backdate),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           upstream.ExtKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              s.permittedNames(upstream.DNSNames),
+		IPAddresses:           s.permittedIPs(upstream.IPAddresses),
+		EmailAddresses:        upstream.EmailAddresses,
+		URIs:                  upstream.URIs,
+	}
+
+	if len(tmpl.ExtKeyUsage) == 0 {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	// Check against what is left of the SANs, a wildcard covering sni may have been outside the constraints
+	covered := &x509.Certificate{DNSNames: tmpl.DNSNames, IPAddresses: tmpl.IPAddresses}
+	if covered.VerifyHostname(sni) != nil {
+		tmpl.DNSNames = append([]string{sni}, tmpl.DNSNames...)
+	}
+
+	return s.sign(sni, tmpl, key)
+}
+
+// sign fills in the serial number and signs tmpl for key with the active issuer, cutting its lifetime short
+// if it would outlive the issuer.
+func (s *Signer) sign(sni string, tmpl *x509.Certificate, key crypto.Signer) (*types.Certificate, error) {
+	// A leaf that outlives its issuer is rejected by some clients, and renewed too late to replace the chain
+	if tmpl.NotAfter.After(s.active.Cert.NotAfter) {
+		tmpl.NotAfter = s.active.Cert.NotAfter
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("error generating serial number: %w", err)
+	}
+	tmpl.SerialNumber = serial
+
+	if s.ocspURL != "" {
+		tmpl.OCSPServer = []string{s.ocspURL}
+	}
+	if s.crlURL != "" {
+		crlURL := s.crlURL
+		if s.active.Name != DefaultIssuer {
+			crlURL += "/" + s.active.Name
+		}
+		tmpl.CRLDistributionPoints = []string{crlURL}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.active.Cert, key.Public(), s.active.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error signing certificate: %w", err)
+	}
+
+	keyPEM, err := marshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Serve the intermediate too, clients that only trust the root can then follow a rotation
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.active.Cert.Raw})...)
+
+	return &types.Certificate{
+		SNI:    sni,
+		Cert:   chain,
+		Key:    keyPEM,
+		Issuer: s.active.Name,
+	}, nil
+}
+
+// generateKeyLike generates a key of the same type and size as pub. Envoy can't serve Ed25519,
+// those and anything we don't mint get a P-256 key instead.
+func generateKeyLike(pub crypto.PublicKey) (crypto.Signer, x509.KeyUsage, error) {
+	algorithm := types.KeyAlgorithmOf(pub)
+	if algorithm == "" || algorithm == types.Ed25519 {
+		algorithm = types.ECDSAP256
+	}
+
+	return generateKey(algorithm)
+}
+
+func generateKey(algorithm types.KeyAlgorithm) (crypto.Signer, x509.KeyUsage, error) {
+	var key crypto.Signer
+	var err error
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	switch algorithm {
+	case types.RSA2048:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case types.RSA3072:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	case types.RSA4096:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	case types.ECDSAP256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case types.ECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case types.Ed25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, 0, fmt.Errorf("unknown key algorithm %q", algorithm)
+	}
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("error generating key: %w", err)
+	}
+
+	// RSA key exchange encrypts the premaster secret with the certificate key
+	if algorithm.Family() == "rsa" {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	return key, keyUsage, nil
+}
+
+func marshalPrivateKey(key crypto.Signer) ([]byte, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding key: %w", err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+	}
+}
+
+// parsePrivateKey accepts the PKCS#1, SEC 1 and PKCS#8 encodings cfssl may produce.
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key format %q", block.Type)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
@@ -0,0 +1,553 @@
+package signer_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/epk/envoy-egress-mitm/signer"
+	"github.com/epk/envoy-egress-mitm/types"
+)
+
+func TestSign(t *testing.T) {
+	caPEM, caKeyPEM, pool := newTestCA(t)
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Sign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.SNI != "example.com" {
+		t.Fatalf("unexpected SNI %q", cert.SNI)
+	}
+
+	block, _ := pem.Decode(cert.Cert)
+	if block == nil {
+		t.Fatal("no PEM data in certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: pool}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := leaf.NotAfter.Sub(leaf.NotBefore); got < 240*time.Hour {
+		t.Fatalf("unexpected validity %s", got)
+	}
+
+	keyBlock, _ := pem.Decode(cert.Key)
+	if keyBlock == nil {
+		t.Fatal("no PEM data in key")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !key.PublicKey.Equal(leaf.PublicKey) {
+		t.Fatal("key does not match certificate")
+	}
+}
+
+func TestIssueCappedAtIssuer(t *testing.T) {
+	caPEM, caKeyPEM, _ := newTestCAUntil(t, time.Now().Add(48*time.Hour))
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := s.Active().Cert
+
+	cert, err := s.Issue([]types.KeyAlgorithm{types.RSA2048, types.ECDSAP256}, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs := [][]byte{cert.Cert}
+	for _, alt := range cert.Alternates {
+		pairs = append(pairs, alt.Cert)
+	}
+
+	for _, pair := range pairs {
+		block, _ := pem.Decode(pair)
+		if block == nil {
+			t.Fatal("no PEM data in certificate")
+		}
+
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !leaf.NotAfter.Equal(ca.NotAfter) {
+			t.Fatalf("leaf expires %s, its issuer %s", leaf.NotAfter, ca.NotAfter)
+		}
+	}
+}
+
+func TestIssueWildcard(t *testing.T) {
+	caPEM, caKeyPEM, pool := newTestCA(t)
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Issue(nil, "example.com", "*.example.com", "*.cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(cert.Cert)
+	if block == nil {
+		t.Fatal("no PEM data in certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"example.com", "www.example.com", "a.cdn.example.com"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: pool}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "a.b.example.com", Roots: pool}); err == nil {
+		t.Error("wildcard must only cover a single label")
+	}
+}
+
+func TestIssueKeys(t *testing.T) {
+	caPEM, caKeyPEM, pool := newTestCA(t)
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, algorithm := range []types.KeyAlgorithm{types.RSA3072, types.ECDSAP384, types.Ed25519} {
+		cert, err := s.Issue([]types.KeyAlgorithm{algorithm}, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := cert.KeyAlgorithms()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0] != algorithm {
+			t.Errorf("%s: got %v", algorithm, got)
+		}
+
+		if _, err := tls.X509KeyPair(cert.Cert, cert.Key); err != nil {
+			t.Errorf("%s: %v", algorithm, err)
+		}
+	}
+
+	// Dual certificates carry the second key pair as an alternate
+	cert, err := s.Issue([]types.KeyAlgorithm{types.ECDSAP256, types.RSA2048}, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cert.Alternates) != 1 || cert.Alternates[0].Algorithm != types.RSA2048 {
+		t.Fatalf("unexpected alternates %v", cert.Alternates)
+	}
+
+	alternate := &types.Certificate{Cert: cert.Alternates[0].Cert, Key: cert.Alternates[0].Key}
+	leaf, err := alternate.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: pool}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair(alternate.Cert, alternate.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Issue([]types.KeyAlgorithm{types.RSA2048, types.RSA4096}, "example.com"); err == nil {
+		t.Fatal("expected two RSA keys to be rejected")
+	}
+}
+
+func TestMimic(t *testing.T) {
+	caPEM, caKeyPEM, pool := newTestCA(t)
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstreamKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com", Organization: []string{"Example Inc"}, Country: []string{"US"}},
+		DNSNames:     []string{"example.com", "www.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, upstreamKey.Public(), upstreamKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Mimic("api.example.com", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf.Subject.String() != upstream.Subject.String() {
+		t.Errorf("subject = %s, want %s", leaf.Subject, upstream.Subject)
+	}
+
+	for _, name := range []string{"api.example.com", "example.com", "www.example.com"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: pool}); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok || pub.Curve != elliptic.P384() {
+		t.Errorf("unexpected key type %T", leaf.PublicKey)
+	}
+
+	if got := leaf.NotAfter.Sub(leaf.NotBefore); got != 12*time.Hour {
+		t.Errorf("lifetime = %s, want 12h", got)
+	}
+
+	if _, err := tls.X509KeyPair(cert.Cert, cert.Key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevocationURLs(t *testing.T) {
+	caPEM, caKeyPEM, _ := newTestCA(t)
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Sign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leaf.OCSPServer) != 0 || len(leaf.CRLDistributionPoints) != 0 {
+		t.Fatalf("unexpected revocation URLs %v %v", leaf.OCSPServer, leaf.CRLDistributionPoints)
+	}
+
+	s.SetRevocationURLs("http://als:8080/ocsp", "http://als:8080/crl")
+
+	cert, err = s.Issue([]types.KeyAlgorithm{types.ECDSAP256, types.RSA2048}, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []*types.Certificate{cert, {Cert: cert.Alternates[0].Cert}} {
+		leaf, err := c.Leaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"http://als:8080/ocsp"}, leaf.OCSPServer); diff != "" {
+			t.Fatalf("unexpected OCSP servers (-want +got):\n%s", diff)
+		}
+
+		if diff := cmp.Diff([]string{"http://als:8080/crl"}, leaf.CRLDistributionPoints); diff != "" {
+			t.Fatalf("unexpected CRL distribution points (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestLoadIssuers(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string][]byte{}
+	pools := map[string]*x509.CertPool{}
+	for _, name := range []string{"intermediate-ca", "intermediate-ca-2", "intermediate-ca-retired"} {
+		certPEM, keyPEM, pool := newTestCA(t)
+		files[name+".crt"] = certPEM
+		if name != "intermediate-ca-retired" {
+			files[name+".key"] = keyPEM
+		}
+		pools[name] = pool
+	}
+
+	// The root is not an issuer
+	rootPEM, rootKeyPEM, _ := newTestCA(t)
+	files["ca.crt"] = rootPEM
+	files["ca.key"] = rootKeyPEM
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := signer.Load(dir, "intermediate-ca-retired"); err == nil {
+		t.Fatal("expected retired issuer to be rejected")
+	}
+
+	s, err := signer.Load(dir, "intermediate-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, issuer := range s.Issuers() {
+		names = append(names, issuer.Name)
+	}
+	if diff := cmp.Diff([]string{"intermediate-ca", "intermediate-ca-2", "intermediate-ca-retired"}, names); diff != "" {
+		t.Fatalf("unexpected issuers (-want +got):\n%s", diff)
+	}
+
+	old, err := s.Sign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetRevocationURLs("http://als:8080/ocsp", "http://als:8080/crl")
+	if err := s.Activate("intermediate-ca-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Sign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cert.Issuer != "intermediate-ca-2" || s.IssuerOf(cert) != s.Active() {
+		t.Fatalf("unexpected issuer %q", cert.Issuer)
+	}
+	if old.Issuer != "intermediate-ca" || s.IssuerOf(old) != s.Issuer("intermediate-ca") {
+		t.Fatalf("unexpected issuer %q", old.Issuer)
+	}
+
+	leaf, err := cert.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: pools["intermediate-ca-2"]}); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"http://als:8080/crl/intermediate-ca-2"}, leaf.CRLDistributionPoints); diff != "" {
+		t.Fatalf("unexpected CRL distribution points (-want +got):\n%s", diff)
+	}
+
+	// The intermediate is served after the leaf
+	tlsCert, err := tls.X509KeyPair(cert.Cert, cert.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsCert.Certificate) != 2 || !bytes.Equal(tlsCert.Certificate[1], s.Active().Cert.Raw) {
+		t.Fatalf("unexpected chain of %d certificates", len(tlsCert.Certificate))
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	rootPEM, rootKeyPEM, pool := newTestCA(t)
+
+	certPEM, keyPEM, err := signer.NewIntermediate(rootPEM, rootKeyPEM, signer.Intermediate{
+		CommonName:          "Constrained intermediate CA",
+		Algorithm:           types.ECDSAP256,
+		Lifetime:            time.Hour,
+		PermittedDNSDomains: []string{"example.com", ".cdn.example.net"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := signer.New(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"example.com", "www.example.com", "a.cdn.example.net"} {
+		cert, err := s.Sign(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		chain, err := tls.X509KeyPair(cert.Cert, cert.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		intermediates := x509.NewCertPool()
+		intermediate, err := x509.ParseCertificate(chain.Certificate[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		intermediates.AddCert(intermediate)
+
+		leaf, err := cert.Leaf()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: pool, Intermediates: intermediates}); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"example.org", "notexample.com", "cdn.example.net"} {
+		_, err := s.Sign(name)
+
+		var constraintErr *signer.ConstraintError
+		if !errors.As(err, &constraintErr) || constraintErr.Name != name {
+			t.Fatalf("%s: expected a constraint error, got %v", name, err)
+		}
+	}
+
+	if _, err := s.Issue(nil, "www.example.com", "example.org"); err == nil {
+		t.Fatal("expected a name outside the constraints to be refused")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "*.example.com"},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(time.Hour),
+		PublicKey: key.Public(),
+		DNSNames:  []string{"*.example.com", "example.org"},
+	}
+
+	// SANs outside the constraints are left out
+	mimicked, err := s.Mimic("www.example.com", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := mimicked.Leaf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]string{"*.example.com"}, leaf.DNSNames); diff != "" {
+		t.Fatalf("unexpected SANs (-want +got):\n%s", diff)
+	}
+
+	if _, err := s.Mimic("www.example.org", upstream); err == nil {
+		t.Fatal("expected a host outside the constraints to be refused")
+	}
+}
+
+func TestNewRejectsLeaf(t *testing.T) {
+	caPEM, caKeyPEM, _ := newTestCA(t)
+
+	s, err := signer.New(caPEM, caKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := s.Sign("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := signer.New(cert.Cert, cert.Key); err == nil {
+		t.Fatal("expected error when using a leaf certificate as CA")
+	}
+}
+
+func newTestCA(t *testing.T) ([]byte, []byte, *x509.CertPool) {
+	t.Helper()
+	return newTestCAUntil(t, time.Now().Add(365*24*time.Hour))
+}
+
+// newTestCAUntil returns a CA that expires at notAfter.
+func newTestCAUntil(t *testing.T, notAfter time.Time) ([]byte, []byte, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test intermediate CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		pool
+}
@@ -0,0 +1,156 @@
+// Package tenant describes the interception domains that share one Envoy. Every tenant has its own listener,
+// issuing CA, policy and namespace in the certificate store.
+package tenant
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// DefaultName is the tenant configured by the command line flags, its resources keep their unqualified names
+	DefaultName = "default"
+	// DefaultPort is the port of the default tenant's listener
+	DefaultPort = 8443
+)
+
+// Names end up in Envoy resource names, log names, store namespaces and URL paths
+var nameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Tenant is an interception domain.
+type Tenant struct {
+	Name string `yaml:"name"`
+	// Port the tenant's listener binds to
+	Port uint32 `yaml:"port"`
+	// ConnectPort the tenant's explicit forward proxy listener binds to, there is none when 0
+	ConnectPort uint32 `yaml:"connect_port,omitempty"`
+	// HTTPPort the tenant's plaintext HTTP listener binds to, there is none when 0
+	HTTPPort uint32 `yaml:"http_port,omitempty"`
+	// Policy file, every host is intercepted when empty
+	Policy string `yaml:"policy,omitempty"`
+	// CA is the directory holding the tenant's intermediate CAs
+	CA string `yaml:"ca,omitempty"`
+	// Issuer is the intermediate in CA that issues new certificates, signer.DefaultIssuer when empty
+	Issuer string `yaml:"issuer,omitempty"`
+}
+
+type file struct {
+	Tenants []*Tenant `yaml:"tenants"`
+}
+
+// Default returns the default tenant, listening on DefaultPort.
+func Default() *Tenant {
+	return &Tenant{Name: DefaultName, Port: DefaultPort}
+}
+
+// Load reads the tenants at path to serve besides def. An empty path has no tenants besides the default one.
+func Load(path string, def *Tenant) ([]*Tenant, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tenants: %w", err)
+	}
+
+	tenants, err := Parse(data, def)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenants %s: %w", path, err)
+	}
+
+	return tenants, nil
+}
+
+// Parse parses and validates the tenants in data to serve besides def. The default tenant is configured
+// on the command line and can't be listed.
+func Parse(data []byte, def *Tenant) ([]*Tenant, error) {
+	var f file
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{DefaultName: true}
+	ports := map[uint32]string{def.Port: DefaultName}
+	for _, port := range []uint32{def.ConnectPort, def.HTTPPort} {
+		if port != 0 {
+			ports[port] = DefaultName
+		}
+	}
+	for i, t := range f.Tenants {
+		if !nameRegex.MatchString(t.Name) {
+			return nil, fmt.Errorf("tenant %d: invalid name %q", i+1, t.Name)
+		}
+
+		if names[t.Name] {
+			return nil, fmt.Errorf("tenant %s: name is already taken", t.Name)
+		}
+		names[t.Name] = true
+
+		if t.Port == 0 || t.Port > 65535 {
+			return nil, fmt.Errorf("tenant %s: invalid port %d", t.Name, t.Port)
+		}
+
+		if t.ConnectPort > 65535 {
+			return nil, fmt.Errorf("tenant %s: invalid connect port %d", t.Name, t.ConnectPort)
+		}
+
+		if t.HTTPPort > 65535 {
+			return nil, fmt.Errorf("tenant %s: invalid http port %d", t.Name, t.HTTPPort)
+		}
+
+		for _, port := range []uint32{t.Port, t.ConnectPort, t.HTTPPort} {
+			if port == 0 {
+				continue
+			}
+
+			if other, ok := ports[port]; ok {
+				return nil, fmt.Errorf("tenant %s: port %d is already used by tenant %s", t.Name, port, other)
+			}
+			ports[port] = t.Name
+		}
+
+		if t.CA == "" {
+			return nil, fmt.Errorf("tenant %s: no CA directory", t.Name)
+		}
+	}
+
+	return f.Tenants, nil
+}
+
+// IsDefault reports whether t is the default tenant.
+func (t *Tenant) IsDefault() bool {
+	return t.Name == DefaultName
+}
+
+// Namespace is where the certificates of t are kept in the store, the default tenant uses the root.
+func (t *Tenant) Namespace() string {
+	if t.IsDefault() {
+		return ""
+	}
+
+	return t.Name
+}
+
+// Qualify prefixes name with the tenant, so that the resources of different tenants never collide.
+// Names of the default tenant are left alone.
+func (t *Tenant) Qualify(name string) string {
+	if t.IsDefault() {
+		return name
+	}
+
+	return t.Name + "/" + name
+}
+
+// ParseLogName splits an access log name qualified by Qualify into the tenant and the log name.
+func ParseLogName(logName string) (tenant, name string) {
+	if tenant, name, ok := strings.Cut(logName, "/"); ok {
+		return tenant, name
+	}
+
+	return DefaultName, logName
+}
@@ -0,0 +1,91 @@
+package tenant_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/epk/envoy-egress-mitm/tenant"
+)
+
+func TestParse(t *testing.T) {
+	tenants, err := tenant.Parse([]byte(`
+tenants:
+- name: team-a
+  port: 9443
+  policy: /app/policy/team-a.yaml
+  ca: /app/cfssl/team-a
+- name: team-b
+  port: 10443
+  ca: /app/cfssl/team-b
+  issuer: intermediate-ca-2
+`), tenant.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tenants) != 2 || tenants[0].Name != "team-a" || tenants[1].Port != 10443 || tenants[1].Issuer != "intermediate-ca-2" {
+		t.Fatalf("unexpected tenants %+v", tenants)
+	}
+
+	tests := []struct {
+		name    string
+		tenants string
+		want    string
+	}{
+		{name: "invalid name", tenants: "- {name: Team_A, port: 9443, ca: /ca}", want: "invalid name"},
+		{name: "default", tenants: "- {name: default, port: 9443, ca: /ca}", want: "already taken"},
+		{name: "duplicate", tenants: "- {name: a, port: 9443, ca: /ca}\n- {name: a, port: 9444, ca: /ca}", want: "already taken"},
+		{name: "default port", tenants: "- {name: a, port: 8443, ca: /ca}", want: "already used by tenant default"},
+		{name: "no port", tenants: "- {name: a, ca: /ca}", want: "invalid port"},
+		{name: "no CA", tenants: "- {name: a, port: 9443}", want: "no CA"},
+		{name: "connect port", tenants: "- {name: a, port: 9443, connect_port: 9443, ca: /ca}", want: "already used by tenant a"},
+		{name: "http port", tenants: "- {name: a, port: 9443, connect_port: 3129, http_port: 3129, ca: /ca}", want: "already used by tenant a"},
+		{name: "invalid connect port", tenants: "- {name: a, port: 9443, connect_port: 70000, ca: /ca}", want: "invalid connect port"},
+		{name: "unknown field", tenants: "- {name: a, port: 9443, ca: /ca, listener: x}", want: "not found"},
+	}
+
+	// The default tenant's port is configurable
+	if _, err := tenant.Parse([]byte("tenants:\n- {name: a, port: 9443, ca: /ca}"), &tenant.Tenant{Name: tenant.DefaultName, Port: 9443}); err == nil || !strings.Contains(err.Error(), "already used by tenant default") {
+		t.Fatalf("got error %v for the port of the default tenant", err)
+	}
+	if _, err := tenant.Parse([]byte("tenants:\n- {name: a, port: 3128, ca: /ca}"), &tenant.Tenant{Name: tenant.DefaultName, Port: 8443, ConnectPort: 3128}); err == nil || !strings.Contains(err.Error(), "already used by tenant default") {
+		t.Fatalf("got error %v for the connect port of the default tenant", err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tenant.Parse([]byte("tenants:\n"+tt.tenants), tenant.Default())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("got error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNames(t *testing.T) {
+	def := tenant.Default()
+	teamA := &tenant.Tenant{Name: "team-a", Port: 9443}
+
+	if got := def.Qualify("example.com"); got != "example.com" {
+		t.Errorf("default tenant qualified as %q", got)
+	}
+	if got := teamA.Qualify("example.com"); got != "team-a/example.com" {
+		t.Errorf("team-a qualified as %q", got)
+	}
+
+	if def.Namespace() != "" || teamA.Namespace() != "team-a" {
+		t.Errorf("unexpected namespaces %q and %q", def.Namespace(), teamA.Namespace())
+	}
+
+	for _, tt := range []struct {
+		logName      string
+		tenant, name string
+	}{
+		{logName: "tcp_ingress", tenant: tenant.DefaultName, name: "tcp_ingress"},
+		{logName: "team-a/tcp_ingress", tenant: "team-a", name: "tcp_ingress"},
+	} {
+		if tenant, name := tenant.ParseLogName(tt.logName); tenant != tt.tenant || name != tt.name {
+			t.Errorf("ParseLogName(%q) = %q, %q", tt.logName, tenant, name)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package types
+
+// Log names Envoy identifies its access log streams to als with.
+const (
+	// PassthroughLogName is logged by the L4 tcp_proxy, every host seen here is a candidate for minting
+	PassthroughLogName = "tcp_ingress"
+	// InterceptLogName is logged by the HTTP connection manager of intercepted hosts
+	InterceptLogName = "l7_ingress"
+	// ConnectLogName is logged by the explicit forward proxy listener, the authority of every CONNECT is a
+	// candidate for minting
+	ConnectLogName = "connect"
+	// HTTPLogName is logged by the plaintext HTTP listener for every request to a host the policy intercepts
+	HTTPLogName = "http_ingress"
+)
@@ -0,0 +1,100 @@
+package types
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"fmt"
+)
+
+// KeyAlgorithm is the type and size of the key of a minted certificate.
+type KeyAlgorithm string
+
+const (
+	RSA2048   KeyAlgorithm = "rsa-2048"
+	RSA3072   KeyAlgorithm = "rsa-3072"
+	RSA4096   KeyAlgorithm = "rsa-4096"
+	ECDSAP256 KeyAlgorithm = "ecdsa-p256"
+	ECDSAP384 KeyAlgorithm = "ecdsa-p384"
+	// Ed25519 certificates are minted, but Envoy only serves RSA and ECDSA certificates as of writing,
+	// see Servable
+	Ed25519 KeyAlgorithm = "ed25519"
+
+	DefaultKeyAlgorithm = RSA2048
+)
+
+// KeyPair is an additional certificate for the same names with a different key type.
+type KeyPair struct {
+	Algorithm KeyAlgorithm `json:"algorithm"`
+
+	Key  []byte `json:"key,omitempty"`
+	Cert []byte `json:"cert,omitempty"`
+}
+
+func (a KeyAlgorithm) Valid() error {
+	switch a {
+	case RSA2048, RSA3072, RSA4096, ECDSAP256, ECDSAP384, Ed25519:
+		return nil
+	default:
+		return fmt.Errorf("unknown key algorithm %q", a)
+	}
+}
+
+// Family is rsa, ecdsa or ed25519. Envoy picks between certificates by family, so it serves at most one of each.
+func (a KeyAlgorithm) Family() string {
+	switch a {
+	case RSA2048, RSA3072, RSA4096:
+		return "rsa"
+	case ECDSAP256, ECDSAP384:
+		return "ecdsa"
+	default:
+		return string(a)
+	}
+}
+
+// Servable reports whether Envoy can serve certificates with a key of the algorithm.
+func (a KeyAlgorithm) Servable() bool {
+	return a != Ed25519
+}
+
+// KeyAlgorithmOf returns the algorithm of pub, or an empty string when it isn't one we mint.
+func KeyAlgorithmOf(pub crypto.PublicKey) KeyAlgorithm {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		algorithm := KeyAlgorithm(fmt.Sprintf("rsa-%d", pub.N.BitLen()))
+		if algorithm.Valid() != nil {
+			return ""
+		}
+		return algorithm
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return ECDSAP256
+		case elliptic.P384():
+			return ECDSAP384
+		}
+	case ed25519.PublicKey:
+		return Ed25519
+	}
+
+	return ""
+}
+
+// ValidKeyAlgorithms checks that every algorithm is known and that no two share a family.
+func ValidKeyAlgorithms(algorithms []KeyAlgorithm) error {
+	families := map[string]bool{}
+	for _, algorithm := range algorithms {
+		if err := algorithm.Valid(); err != nil {
+			return err
+		}
+
+		if families[algorithm.Family()] {
+			return fmt.Errorf("more than one %s key", algorithm.Family())
+		}
+		families[algorithm.Family()] = true
+	}
+
+	return nil
+}
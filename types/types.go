@@ -1,8 +1,84 @@
 package types
 
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+)
+
 type Certificate struct {
 	SNI string `json:"sni,omitempty"`
 
 	Key  []byte `json:"key,omitempty"`
 	Cert []byte `json:"cert,omitempty"`
+
+	// Issuer names the intermediate CA that signed the certificate, Cert holds its certificate after the leaf
+	Issuer string `json:"issuer,omitempty"`
+
+	// Alternates are served next to Key and Cert, Envoy picks the one the client supports
+	Alternates []*KeyPair `json:"alternates,omitempty"`
+
+	// Wildcard certificates are keyed by the registrable domain in SNI and shared by every host in DNSNames
+	Wildcard bool     `json:"wildcard,omitempty"`
+	DNSNames []string `json:"dns_names,omitempty"`
+
+	// DemotedUntil keeps the host on the L4 path until then, it is set when the host keeps failing on L7
+	DemotedUntil *time.Time `json:"demoted_until,omitempty"`
+}
+
+// Demoted reports whether the host must stay on the L4 path at now.
+func (c *Certificate) Demoted(now time.Time) bool {
+	return c.DemotedUntil != nil && now.Before(*c.DemotedUntil)
+}
+
+// Leaf parses the leaf certificate, the first one in Cert.
+func (c *Certificate) Leaf() (*x509.Certificate, error) {
+	block, _ := pem.Decode(c.Cert)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// KeyAlgorithms returns the algorithm of every key pair, the primary one first.
+func (c *Certificate) KeyAlgorithms() ([]KeyAlgorithm, error) {
+	leaf, err := c.Leaf()
+	if err != nil {
+		return nil, err
+	}
+
+	algorithms := []KeyAlgorithm{KeyAlgorithmOf(leaf.PublicKey)}
+	for _, alternate := range c.Alternates {
+		algorithms = append(algorithms, alternate.Algorithm)
+	}
+
+	return algorithms, nil
+}
+
+// Validity returns the NotBefore and NotAfter of the leaf certificate.
+func (c *Certificate) Validity() (notBefore, notAfter time.Time, err error) {
+	leaf, err := c.Leaf()
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return leaf.NotBefore, leaf.NotAfter, nil
+}
+
+// NeedsRenewal reports whether the certificate expires within window of now. The window is capped at a third
+// of the certificate's lifetime so that short lived certificates aren't renewed over and over.
+// A certificate that can't be parsed can't be served either, so it needs renewal too.
+func (c *Certificate) NeedsRenewal(now time.Time, window time.Duration) bool {
+	notBefore, notAfter, err := c.Validity()
+	if err != nil {
+		return true
+	}
+
+	if lifetime := notAfter.Sub(notBefore); window > lifetime/3 {
+		window = lifetime / 3
+	}
+
+	return !now.Add(window).Before(notAfter)
 }
@@ -0,0 +1,87 @@
+// Package upstream fetches the certificates real servers present, for the signer to mimic.
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPort    = 443
+	defaultTimeout = 5 * time.Second
+)
+
+// Prober connects to upstreams the way the dynamic forward proxy does: IPv4 only, on Port (443 by default).
+type Prober struct {
+	Port    int
+	Timeout time.Duration
+
+	// LookupIP resolves hosts, net.DefaultResolver is used when nil
+	LookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+func NewProber() *Prober {
+	return &Prober{
+		Port:    defaultPort,
+		Timeout: defaultTimeout,
+	}
+}
+
+// Certificate returns the leaf certificate the upstream presents for sni.
+// It is deliberately not verified, we only look at it.
+func (p *Prober) Certificate(ctx context.Context, sni string) (*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	lookupIP := p.LookupIP
+	if lookupIP == nil {
+		lookupIP = net.DefaultResolver.LookupIP
+	}
+
+	ips, err := lookupIP(ctx, "ip4", sni)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", sni, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IPv4 address for %s", sni)
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		cert, err := p.certificate(ctx, net.JoinHostPort(ip.String(), strconv.Itoa(p.Port)), sni)
+		if err == nil {
+			return cert, nil
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (p *Prober) certificate(ctx context.Context, addr, sni string) (*x509.Certificate, error) {
+	dialer := &tls.Dialer{
+		Config: &tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: true,
+		},
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", addr)
+	}
+
+	return certs[0], nil
+}
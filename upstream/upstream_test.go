@@ -0,0 +1,57 @@
+package upstream_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/epk/envoy-egress-mitm/upstream"
+)
+
+func TestCertificate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	p := newLocalProber(t, srv.Listener.Addr())
+
+	got, err := p.Certificate(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Raw, srv.Certificate().Raw) {
+		t.Fatal("unexpected certificate")
+	}
+
+	srv.Close()
+	if _, err := p.Certificate(context.Background(), "example.com"); err == nil {
+		t.Fatal("expected an error once the upstream is gone")
+	}
+}
+
+// newLocalProber resolves every host to addr.
+func newLocalProber(t *testing.T, addr net.Addr) *upstream.Prober {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := upstream.NewProber()
+	p.Port, err = strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Timeout = 5 * time.Second
+	p.LookupIP = func(context.Context, string, string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP(host)}, nil
+	}
+
+	return p
+}